@@ -0,0 +1,29 @@
+package gatewayrpc
+
+import (
+	"github.com/gorilla/rpc/v2"
+	"github.com/gorilla/rpc/v2/json2"
+)
+
+// DefaultContentTypes are the content-types RegisterDefaultCodecs registers
+// the json2 codec under
+var DefaultContentTypes = []string{
+	"application/json",
+	"application/json-rpc",
+	"application/jsonrequest",
+}
+
+// CodecRegisterer is anything which codecs can be registered on, such as a
+// Server or a gateway.Gateway
+type CodecRegisterer interface {
+	RegisterCodec(codec rpc.Codec, contentType string)
+}
+
+// RegisterDefaultCodecs registers the json2 codec on the given Server or
+// Gateway under each of DefaultContentTypes
+func RegisterDefaultCodecs(s CodecRegisterer) {
+	codec := json2.NewCodec()
+	for _, ct := range DefaultContentTypes {
+		s.RegisterCodec(codec, ct)
+	}
+}
@@ -0,0 +1,47 @@
+package gateway
+
+import (
+	"time"
+
+	"github.com/levenlabs/go-llog"
+)
+
+// AuditRecord describes a single call to an Auditable method, see AuditSink
+type AuditRecord struct {
+	Method string
+
+	// Principal is who made the request, see Request.SetPrincipal
+	Principal string
+
+	// ParamsHash is a hash of the method and the request's params, as
+	// generated by DefaultKeyFunc, so that calls can be correlated without
+	// the params themselves being stored
+	ParamsHash string
+
+	// Err is set if the request failed for any reason, including the backend
+	// returning an error
+	Err error
+
+	// Time is when the request finished
+	Time time.Time
+}
+
+func (g *Gateway) audit(req *Request, ev RoutingEvent) {
+	if g.AuditSink == nil {
+		return
+	}
+	rec := AuditRecord{
+		Method:    ev.Method,
+		Principal: req.Principal(),
+		Err:       ev.Err,
+		Time:      time.Now(),
+	}
+	var err error
+	if rec.ParamsHash, err = DefaultKeyFunc(ev.Method, req.args); err != nil {
+		llog.Warn("error hashing params for audit record", llog.KV{
+			"method": ev.Method,
+			"err":    err,
+		})
+	}
+	g.AuditSink(rec)
+}
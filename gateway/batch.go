@@ -0,0 +1,229 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	"github.com/gorilla/rpc/v2"
+	"github.com/gorilla/rpc/v2/json2"
+	"github.com/levenlabs/go-llog"
+	"github.com/levenlabs/golib/rpcutil"
+)
+
+// DefaultMaxBatchSize is used if Gateway's MaxBatchSize isn't set
+const DefaultMaxBatchSize = 100
+
+// DefaultBatchConcurrency is used if Gateway's BatchConcurrency isn't set
+const DefaultBatchConcurrency = 10
+
+// errorRes is used to respond with an error when there's no single request to
+// respond to, e.g. for a batch which couldn't be split into its individual
+// requests, so the id is always null
+type errorRes struct {
+	Version string       `json:"jsonrpc"`
+	Error   *json2.Error `json:"error"`
+	ID      interface{}  `json:"id"`
+}
+
+// serveBatch checks if the request's body is a batch of rpc requests (a json
+// array) and, if so, handles each request in it concurrently, at most
+// BatchConcurrency at a time, and writes back an array of their responses.
+// Each request is handled exactly as if it had been sent on its own, so a
+// request which times out or errors only has an error in its own slot, while
+// the rest of the batch still returns its results. The forward timeout applies
+// to the batch as a whole, and requests which haven't finished by then get a
+// timeout error in their slot.
+//
+// Returns false if the request isn't a batch, in which case the body will have
+// been restored and the request should be handled as normal
+func (g *Gateway) serveBatch(w http.ResponseWriter, r *http.Request, codec rpc.Codec) bool {
+	body, err := peekBody(r)
+	if err != nil {
+		// let the codec deal with whatever's wrong with the body
+		return false
+	}
+	if b := bytes.TrimSpace(body); len(b) == 0 || b[0] != '[' {
+		return false
+	}
+
+	var reqs []json.RawMessage
+	if err := json.Unmarshal(body, &reqs); err != nil || len(reqs) == 0 {
+		msg := "invalid batch"
+		if err != nil {
+			msg = err.Error()
+		}
+		writeJSON(w, &errorRes{
+			Version: "2.0",
+			Error:   &json2.Error{Code: json2.E_INVALID_REQ, Message: msg},
+		})
+		return true
+	}
+	maxSize := g.MaxBatchSize
+	if maxSize <= 0 {
+		maxSize = DefaultMaxBatchSize
+	}
+	if len(reqs) > maxSize {
+		writeJSON(w, &errorRes{
+			Version: "2.0",
+			Error: &json2.Error{
+				Code:    json2.E_INVALID_REQ,
+				Message: fmt.Sprintf("batch has more than %d requests", maxSize),
+			},
+		})
+		return true
+	}
+
+	n := g.BatchConcurrency
+	if n <= 0 {
+		n = DefaultBatchConcurrency
+	}
+	// the whole batch shares one deadline, otherwise a batch could take many
+	// times longer than any single request is allowed to
+	ctx := r.Context()
+	if timeout := g.forwardTimeout(r); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	sem := make(chan struct{}, n)
+	ress := make([][]byte, len(reqs))
+	// once the deadline has passed any request which isn't done is given a
+	// timeout error, and anything it writes after that is ignored
+	var l sync.Mutex
+	done := make([]bool, len(reqs))
+	var timedOut bool
+	var wg sync.WaitGroup
+loop:
+	for i := range reqs {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			break loop
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			req := reqs[i]
+			// the codec treats a null id the same as a missing one, i.e. as a
+			// notification, but a request with a null id still gets a
+			// response. So it's given a placeholder id which is then nulled
+			// out in the response
+			nullID := hasNullID(req)
+			if nullID {
+				req = setID(req, nullIDPlaceholder)
+			}
+
+			subR := r.Clone(ctx)
+			subR.Body = ioutil.NopCloser(bytes.NewBuffer(req))
+			subR.ContentLength = int64(len(req))
+			kv := rpcutil.RequestKV(subR)
+			kv["batchIdx"] = i
+
+			rec := httptest.NewRecorder()
+			g.serveRequest(rec, subR, codec, kv)
+			res := bytes.TrimSpace(rec.Body.Bytes())
+			if nullID && len(res) > 0 {
+				res = setID(res, json.RawMessage("null"))
+			}
+			l.Lock()
+			defer l.Unlock()
+			if !timedOut {
+				ress[i], done[i] = res, true
+			}
+		}(i)
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-ctx.Done():
+	}
+	l.Lock()
+	timedOut = true
+	for i := range reqs {
+		if !done[i] {
+			ress[i] = timeoutRes(reqs[i])
+		}
+	}
+	l.Unlock()
+
+	// notifications don't have a response, so they're left out of the array
+	out := make([]json.RawMessage, 0, len(ress))
+	for _, res := range ress {
+		if len(res) > 0 {
+			out = append(out, res)
+		}
+	}
+	if len(out) == 0 {
+		return true
+	}
+	writeJSON(w, out)
+	return true
+}
+
+// timeoutRes returns the response for a request in a batch which didn't finish
+// before the batch's deadline, or nil if the request is a notification
+func timeoutRes(req json.RawMessage) []byte {
+	id := json.RawMessage("null")
+	var env map[string]json.RawMessage
+	if err := json.Unmarshal(req, &env); err == nil {
+		var ok bool
+		if id, ok = env["id"]; !ok {
+			return nil
+		}
+	}
+	b, err := json.Marshal(&errorRes{Version: "2.0", Error: errTimeout, ID: id})
+	if err != nil {
+		llog.Error("error encoding batch timeout response", llog.KV{"err": err})
+		return nil
+	}
+	return b
+}
+
+// nullIDPlaceholder is used in place of null ids in batches, see serveBatch
+var nullIDPlaceholder = json.RawMessage(`"gatewayrpc-null-id"`)
+
+// hasNullID returns whether the given request or response object has an id
+// which is explicitly null
+func hasNullID(b json.RawMessage) bool {
+	var env map[string]json.RawMessage
+	if err := json.Unmarshal(b, &env); err != nil {
+		return false
+	}
+	id, ok := env["id"]
+	return ok && bytes.Equal(bytes.TrimSpace(id), []byte("null"))
+}
+
+// setID returns the given request or response object with its id replaced.
+// If it isn't an object it's returned as-is
+func setID(b, id json.RawMessage) json.RawMessage {
+	var env map[string]json.RawMessage
+	if err := json.Unmarshal(b, &env); err != nil {
+		return b
+	}
+	env["id"] = id
+	b2, err := json.Marshal(env)
+	if err != nil {
+		return b
+	}
+	return b2
+}
+
+func writeJSON(w http.ResponseWriter, i interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(i); err != nil {
+		llog.Error("error writing json response", llog.KV{"err": err})
+	}
+}
@@ -0,0 +1,103 @@
+package gateway
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gorilla/rpc/v2/json2"
+)
+
+// DefaultBreakerCooldown is the BreakerCooldown NewGateway sets
+const DefaultBreakerCooldown = 10 * time.Second
+
+var errBreakerOpen = &json2.Error{
+	Code:    json2.E_SERVER,
+	Message: "service is unavailable",
+}
+
+// breaker tracks the failures of a single service's backend
+type breaker struct {
+	// the number of forwards in a row which have failed
+	failures int
+	// when the breaker is open this is when it may next let a probe through
+	openUntil time.Time
+	// set while a probe is in-flight, during which nothing else is let through
+	probing bool
+}
+
+// breakers keeps a breaker for each service. The zero value is ready to use
+type breakers struct {
+	l sync.Mutex
+	m map[string]*breaker
+}
+
+func (bs *breakers) get(service string) *breaker {
+	if bs.m == nil {
+		bs.m = map[string]*breaker{}
+	}
+	b, ok := bs.m[service]
+	if !ok {
+		b = &breaker{}
+		bs.m[service] = b
+	}
+	return b
+}
+
+// allow returns whether a request may be forwarded to the service. Once the
+// breaker is open and its cooldown has passed a single request is allowed
+// through, whose result determines whether the breaker closes again
+func (bs *breakers) allow(service string, threshold int) bool {
+	if threshold <= 0 {
+		return true
+	}
+	bs.l.Lock()
+	defer bs.l.Unlock()
+	b := bs.get(service)
+	if b.failures < threshold {
+		return true
+	} else if b.probing || time.Now().Before(b.openUntil) {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// record records the result of a forward which allow let through
+func (bs *breakers) record(service string, failed bool, threshold int, cooldown time.Duration) {
+	if threshold <= 0 {
+		return
+	}
+	bs.l.Lock()
+	defer bs.l.Unlock()
+	b := bs.get(service)
+	b.probing = false
+	if !failed {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= threshold {
+		b.openUntil = time.Now().Add(cooldown)
+	}
+}
+
+// release lets another probe through if the forward which allow let through
+// had no result, e.g. because the client went away, without counting it as a
+// success or failure
+func (bs *breakers) release(service string, threshold int) {
+	if threshold <= 0 {
+		return
+	}
+	bs.l.Lock()
+	defer bs.l.Unlock()
+	bs.get(service).probing = false
+}
+
+func (bs *breakers) isOpen(service string, threshold int) bool {
+	if threshold <= 0 {
+		return false
+	}
+	bs.l.Lock()
+	defer bs.l.Unlock()
+	return bs.get(service).failures >= threshold
+}
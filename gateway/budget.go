@@ -0,0 +1,86 @@
+package gateway
+
+import (
+	"sync"
+	"time"
+)
+
+// retryBudgetBuckets is the number of buckets a RetryBudget's window is split
+// into. The window rolls forward one bucket at a time
+const retryBudgetBuckets = 10
+
+type retryBudgetBucket struct {
+	start             time.Time
+	requests, retries int
+}
+
+// RetryBudget limits the number of retries the Gateway will make relative to
+// the number of requests it's forwarding, so that an outage of a backend
+// doesn't result in it being hit with even more load due to retries. Once the
+// budget is exhausted requests which fail aren't retried.
+type RetryBudget struct {
+	ratio      float64
+	minRetries int
+	window     time.Duration
+
+	mutex   sync.Mutex
+	buckets [retryBudgetBuckets]retryBudgetBucket
+}
+
+// NewRetryBudget returns a RetryBudget which allows the number of retries made
+// within the given rolling window to be up to ratio (e.g. 0.1 for 10%) of the
+// number of requests made in it. minRetries retries are always allowed within
+// the window, so that low traffic doesn't prevent retries completely.
+func NewRetryBudget(ratio float64, minRetries int, window time.Duration) *RetryBudget {
+	return &RetryBudget{
+		ratio:      ratio,
+		minRetries: minRetries,
+		window:     window,
+	}
+}
+
+// bucket returns the bucket for the current time, clearing it out if it was
+// last used for a previous window. Must be called with the mutex held
+func (rb *RetryBudget) bucket(now time.Time) *retryBudgetBucket {
+	size := rb.window / retryBudgetBuckets
+	if size <= 0 {
+		size = 1
+	}
+	start := now.Truncate(size)
+	b := &rb.buckets[(start.UnixNano()/int64(size))%retryBudgetBuckets]
+	if !b.start.Equal(start) {
+		*b = retryBudgetBucket{start: start}
+	}
+	return b
+}
+
+// totals returns the number of requests and retries within the window. Must
+// be called with the mutex held
+func (rb *RetryBudget) totals(now time.Time) (requests, retries int) {
+	for _, b := range rb.buckets {
+		if now.Sub(b.start) < rb.window {
+			requests += b.requests
+			retries += b.retries
+		}
+	}
+	return
+}
+
+func (rb *RetryBudget) recordRequest() {
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+	rb.bucket(time.Now()).requests++
+}
+
+// allowRetry returns whether a retry may be made, recording it if so
+func (rb *RetryBudget) allowRetry() bool {
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+	now := time.Now()
+	requests, retries := rb.totals(now)
+	if retries >= rb.minRetries && float64(retries+1) > rb.ratio*float64(requests) {
+		return false
+	}
+	rb.bucket(now).retries++
+	return true
+}
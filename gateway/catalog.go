@@ -0,0 +1,59 @@
+package gateway
+
+import (
+	"sort"
+
+	"github.com/levenlabs/gatewayrpc/gatewaytypes"
+)
+
+// CatalogService describes a service known to the Gateway, along with the
+// backends it's forwarded to
+type CatalogService struct {
+	gatewaytypes.Service
+
+	// Backend is the url the service was most recently added from. It's empty
+	// for services added using AddHandler
+	Backend string
+
+	// TaggedBackends are the tags of each url the service was added from using
+	// AddURLTagged
+	TaggedBackends map[string]map[string]string
+}
+
+// Catalog returns a snapshot of all the services known to the Gateway, sorted
+// by name. The snapshot is a deep copy, so it may be modified or transformed
+// (e.g. for embedding in another format) without affecting the Gateway, and
+// won't reflect any later changes to it
+func (g *Gateway) Catalog() []CatalogService {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+
+	services := make([]CatalogService, 0, len(g.services))
+	for _, rsrv := range g.services {
+		cs := CatalogService{
+			Service: rsrv.Service.Copy(),
+			Backend: rsrv.origURL,
+		}
+		if len(rsrv.tagged) > 0 {
+			cs.TaggedBackends = make(map[string]map[string]string, len(rsrv.tagged))
+			for _, tb := range rsrv.tagged {
+				tags := make(map[string]string, len(tb.tags))
+				for k, v := range tb.tags {
+					tags[k] = v
+				}
+				cs.TaggedBackends[tb.origURL] = tags
+			}
+		}
+		services = append(services, cs)
+	}
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].Name < services[j].Name
+	})
+	return services
+}
+
+// MarshalCatalog passes a snapshot of the Gateway's services (see Catalog) to
+// the given function, returning its result
+func (g *Gateway) MarshalCatalog(fn func([]CatalogService) ([]byte, error)) ([]byte, error) {
+	return fn(g.Catalog())
+}
@@ -0,0 +1,39 @@
+package gateway
+
+import (
+	"io"
+
+	"github.com/gorilla/rpc/v2"
+	"github.com/gorilla/rpc/v2/json2"
+)
+
+// ClientCodec may be implemented by a codec given to RegisterCodec which isn't
+// JSON RPC 2.0, so that requests made with it are forwarded to backends in the
+// same format, and their responses decoded with it, rather than using JSON RPC
+// 2.0. Since the gateway works with params and results as json, the codec's
+// CodecRequests must still be able to read params into a *json.RawMessage and
+// write a result from one.
+type ClientCodec interface {
+	rpc.Codec
+
+	// EncodeClientRequest encodes a request for the given method and args
+	EncodeClientRequest(method string, args interface{}) ([]byte, error)
+
+	// DecodeClientResponse decodes the response body into reply, returning
+	// the error from the response, if any
+	DecodeClientResponse(r io.Reader, reply interface{}) error
+}
+
+func (r *Request) encodeClientRequest(method string, args interface{}) ([]byte, error) {
+	if r.clientCodec != nil {
+		return r.clientCodec.EncodeClientRequest(method, args)
+	}
+	return json2.EncodeClientRequest(method, args)
+}
+
+func (r *Request) decodeClientResponse(body io.Reader, reply interface{}) error {
+	if r.clientCodec != nil {
+		return r.clientCodec.DecodeClientResponse(body, reply)
+	}
+	return json2.DecodeClientResponse(body, reply)
+}
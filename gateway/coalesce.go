@@ -0,0 +1,79 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+type coalescedCall struct {
+	done chan struct{}
+	rec  *limitedRecorder
+}
+
+// coalescer ensures that only one call for a given key is in-flight at a
+// time, with concurrent callers for the same key sharing its result. Its zero
+// value is ready to use
+type coalescer struct {
+	sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+// do calls fn in the background, unless a call for the same key is already
+// in-flight in which case it uses that call's result instead. Every caller is
+// returned its own copy of the result, and whether it was shared with another
+// caller. The call isn't tied to any one caller, so if ctx is done before it
+// finishes do returns early with a recorder holding ctx's error while the call
+// carries on for everyone else
+func (c *coalescer) do(ctx context.Context, key string, fn func() *limitedRecorder) (*limitedRecorder, bool) {
+	c.Lock()
+	if c.calls == nil {
+		c.calls = map[string]*coalescedCall{}
+	}
+	call, shared := c.calls[key]
+	if !shared {
+		call = &coalescedCall{done: make(chan struct{})}
+		c.calls[key] = call
+		go func() {
+			call.rec = fn()
+			c.Lock()
+			delete(c.calls, key)
+			c.Unlock()
+			close(call.done)
+		}()
+	}
+	c.Unlock()
+
+	select {
+	case <-call.done:
+		return call.rec.clone(), shared
+	case <-ctx.Done():
+		return &limitedRecorder{
+			ResponseRecorder: httptest.NewRecorder(),
+			forwardErr:       ctx.Err(),
+		}, shared
+	}
+}
+
+// detachedContext carries the values of the Context it wraps, but isn't
+// cancelled along with it
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// clone returns a copy of the recorder whose body can be read independently of
+// the original's
+func (lr *limitedRecorder) clone() *limitedRecorder {
+	lr2 := *lr
+	lr2.ResponseRecorder = httptest.NewRecorder()
+	lr2.Code = lr.Code
+	lr2.HeaderMap = lr.Header().Clone()
+	lr2.Body = bytes.NewBuffer(lr.Body.Bytes())
+	return &lr2
+}
@@ -0,0 +1,46 @@
+package gateway
+
+import "sync"
+
+// backendCompressionProbes is the number of uncompressed responses a backend
+// may send, without ever having sent a compressed one, before the gateway stops
+// asking it for compressed responses
+const backendCompressionProbes = 5
+
+type compressionState struct {
+	compressed   bool
+	uncompressed int
+}
+
+// compressionTracker keeps track of which backends (by host) have been seen to
+// compress their responses, so that backends which never do can stop being
+// asked to. Its zero value is ready to use
+type compressionTracker struct {
+	sync.Mutex
+	backends map[string]compressionState
+}
+
+// supported returns whether the backend at the given host should be asked for
+// compressed responses
+func (ct *compressionTracker) supported(host string) bool {
+	ct.Lock()
+	defer ct.Unlock()
+	s := ct.backends[host]
+	return s.compressed || s.uncompressed < backendCompressionProbes
+}
+
+// record records whether or not a response from the given host was compressed
+func (ct *compressionTracker) record(host string, compressed bool) {
+	ct.Lock()
+	defer ct.Unlock()
+	if ct.backends == nil {
+		ct.backends = map[string]compressionState{}
+	}
+	s := ct.backends[host]
+	if compressed {
+		s.compressed = true
+	} else {
+		s.uncompressed++
+	}
+	ct.backends[host] = s
+}
@@ -0,0 +1,104 @@
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/rpc/v2"
+	"github.com/levenlabs/go-llog"
+)
+
+// envelopeRes is the default response format for requests decoded using
+// EnvelopeDecoder, used if EnvelopeEncoder isn't set
+type envelopeRes struct {
+	Result json.RawMessage `json:"result"`
+	Error  *string         `json:"error"`
+}
+
+func defaultEnvelopeEncoder(result json.RawMessage, err error) ([]byte, error) {
+	res := envelopeRes{Result: result}
+	if err != nil {
+		msg := err.Error()
+		res.Error = &msg
+	}
+	return json.Marshal(res)
+}
+
+// envelopeCodec implements both rpc.Codec and rpc.CodecRequest for a request
+// which was decoded using EnvelopeDecoder, so that it can go through the same
+// forwarding as a normal rpc request
+type envelopeCodec struct {
+	method  string
+	params  json.RawMessage
+	encoder func(json.RawMessage, error) ([]byte, error)
+}
+
+func (ec *envelopeCodec) NewRequest(*http.Request) rpc.CodecRequest {
+	return ec
+}
+
+func (ec *envelopeCodec) Method() (string, error) {
+	if ec.method == "" {
+		return "", errors.New("no method given")
+	}
+	return ec.method, nil
+}
+
+func (ec *envelopeCodec) ReadRequest(args interface{}) error {
+	if len(ec.params) == 0 {
+		return nil
+	}
+	return json.Unmarshal(ec.params, args)
+}
+
+func (ec *envelopeCodec) WriteResponse(w http.ResponseWriter, reply interface{}) {
+	b, err := json.Marshal(reply)
+	if err != nil {
+		ec.WriteError(w, 500, err)
+		return
+	}
+	ec.write(w, b, nil)
+}
+
+func (ec *envelopeCodec) WriteError(w http.ResponseWriter, _ int, err error) {
+	ec.write(w, nil, err)
+}
+
+func (ec *envelopeCodec) write(w http.ResponseWriter, result json.RawMessage, resErr error) {
+	b, err := ec.encoder(result, resErr)
+	if err != nil {
+		llog.Error("error encoding envelope response", llog.KV{"err": err})
+		writeErrorf(w, 500, "error encoding response")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(b)
+}
+
+// serveEnvelope attempts to decode the request using EnvelopeDecoder and, if
+// successful, handles it. Returns false if the request couldn't be decoded, in
+// which case the body will have been restored and the request should be
+// handled as normal
+func (g *Gateway) serveEnvelope(w http.ResponseWriter, r *http.Request, kv llog.KV) bool {
+	body, err := peekBody(r)
+	if err != nil {
+		return false
+	}
+	method, params, err := g.EnvelopeDecoder(body)
+	if err != nil {
+		return false
+	}
+
+	ec := &envelopeCodec{
+		method:  method,
+		params:  params,
+		encoder: g.EnvelopeEncoder,
+	}
+	if ec.encoder == nil {
+		ec.encoder = defaultEnvelopeEncoder
+	}
+	kv["envelope"] = true
+	g.serveRequest(w, r, ec, kv)
+	return true
+}
@@ -0,0 +1,46 @@
+package gateway
+
+import "time"
+
+// eventsBufferSize is the size of the buffer of the channel returned from
+// Gateway's Events method
+const eventsBufferSize = 100
+
+// RoutingEvent describes the outcome of a single request which was forwarded
+// to a backend by the Gateway
+type RoutingEvent struct {
+	Method  string
+	Service string
+
+	// Backend is the url the request was forwarded to. It will be empty for
+	// requests handled by the BackupHandler or an in-process handler
+	Backend string
+
+	// Status is the http status code of the backend's response
+	Status int
+
+	// Duration is how long the backend took to respond
+	Duration time.Duration
+
+	// Err is set if the request failed for any reason, including the backend
+	// returning an error
+	Err error
+
+	// Labels are any extra labels for the request returned from the Gateway's
+	// MetricsLabeler
+	Labels map[string]string
+}
+
+// Events returns a channel which will receive a RoutingEvent for every request
+// which is forwarded. If the channel's buffer is full events will be dropped
+// rather than blocking requests, so it should be read from continuously.
+func (g *Gateway) Events() <-chan RoutingEvent {
+	return g.events
+}
+
+func (g *Gateway) emitEvent(ev RoutingEvent) {
+	select {
+	case g.events <- ev:
+	default:
+	}
+}
@@ -0,0 +1,182 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/rpc/v2/json2"
+	"github.com/levenlabs/go-llog"
+)
+
+// MergeStrategy describes how the results from each backend of a method which
+// is fanned out (see FanOut) are combined into a single result
+type MergeStrategy int
+
+const (
+	// MergeArrays expects each result to be an array, and concatenates them in
+	// the order the backends were given
+	MergeArrays MergeStrategy = iota
+
+	// MergeObjects expects each result to be an object, and merges their
+	// fields together. If multiple results have the same field the one from
+	// the backend given last wins
+	MergeObjects
+)
+
+type fanOut struct {
+	urls  []*url.URL
+	merge MergeStrategy
+}
+
+// FanOut causes requests for the given method ("Service.MethodName") to be
+// forwarded to every one of the given urls, rather than only to the one the
+// service was added from, with the results being combined using the given
+// MergeStrategy. This is useful for services which are sharded across multiple
+// backends. If any of the backends return an error then the client is sent a
+// single error whose data gives the indexes, in urls, of the ones which failed.
+//
+// The service must still have been added using AddURL for requests to it to be
+// accepted. The urls are resolved the same way as those given to AddURL.
+func (g *Gateway) FanOut(method string, merge MergeStrategy, urls ...string) error {
+	if len(urls) == 0 {
+		return errors.New("no urls given")
+	}
+	fo := fanOut{merge: merge}
+	for _, u := range urls {
+		if !strings.HasPrefix(u, "http") {
+			u = "http://" + u
+		}
+		uu, err := url.Parse(u)
+		if err != nil {
+			return err
+		}
+		fo.urls = append(fo.urls, uu)
+	}
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.fanOuts[method] = fo
+	return nil
+}
+
+func (g *Gateway) getFanOut(method string) (fanOut, bool) {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	fo, ok := g.fanOuts[method]
+	return fo, ok
+}
+
+// fanOutRes is what's written into the recorder returned from forwardFanOut, so
+// that it can be decoded like any other backend response
+type fanOutRes struct {
+	Version string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *json2.Error    `json:"error,omitempty"`
+	ID      int             `json:"id"`
+}
+
+// forwardFanOut forwards the request to all of the fanOut's urls concurrently
+// and returns a recorder containing either their merged results, or an error
+// giving the index of every backend which failed. The backends' urls and
+// errors are only logged, not sent to the client. Each backend's response is
+// decoded using decode
+func (g *Gateway) forwardFanOut(handler http.Handler, r *http.Request, b []byte, kv llog.KV, fo fanOut, decode func(io.Reader, interface{}) error, idempotent bool) *limitedRecorder {
+	results := make([]json.RawMessage, len(fo.urls))
+	errs := make([]error, len(fo.urls))
+	var wg sync.WaitGroup
+	for i := range fo.urls {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			u, err := g.resolveURL(fo.urls[i])
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			r2 := r.Clone(r.Context())
+			r2.URL = u
+			rec := g.forward(handler, r2, b, copyKV(kv), fo.urls[i], idempotent)
+			switch {
+			case rec.forwardErr != nil:
+				errs[i] = rec.forwardErr
+			case rec.exceeded:
+				errs[i] = errResponseTooLarge
+			default:
+				errs[i] = decode(rec.Body, &results[i])
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	res := fanOutRes{Version: "2.0"}
+	var failed []string
+	var failedIdxs []int
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", fo.urls[i], err))
+			failedIdxs = append(failedIdxs, i)
+		}
+	}
+	if len(failed) > 0 {
+		kv["errs"] = failed
+		llog.Warn("error fanning out request", kv)
+		delete(kv, "errs")
+		res.Error = &json2.Error{
+			Code:    json2.E_SERVER,
+			Message: fmt.Sprintf("%d of %d backends failed", len(failed), len(fo.urls)),
+			Data:    map[string][]int{"failedShards": failedIdxs},
+		}
+	} else if merged, err := mergeResults(results, fo.merge); err != nil {
+		res.Error = &json2.Error{Code: json2.E_SERVER, Message: err.Error()}
+	} else {
+		res.Result = merged
+	}
+
+	rec := &limitedRecorder{ResponseRecorder: httptest.NewRecorder()}
+	body, err := json.Marshal(res)
+	if err != nil {
+		rec.forwardErr = err
+		writeErrorf(rec, 500, "{}")
+		return rec
+	}
+	rec.Header().Set("Content-Type", defaultContentType)
+	rec.Body = bytes.NewBuffer(body)
+	return rec
+}
+
+// mergeResults combines the results using the given MergeStrategy
+func mergeResults(results []json.RawMessage, merge MergeStrategy) (json.RawMessage, error) {
+	switch merge {
+	case MergeArrays:
+		merged := []json.RawMessage{}
+		for _, res := range results {
+			var a []json.RawMessage
+			if err := json.Unmarshal(res, &a); err != nil {
+				return nil, fmt.Errorf("expected array result: %s", err)
+			}
+			merged = append(merged, a...)
+		}
+		return json.Marshal(merged)
+	case MergeObjects:
+		merged := map[string]json.RawMessage{}
+		for _, res := range results {
+			var m map[string]json.RawMessage
+			if err := json.Unmarshal(res, &m); err != nil {
+				return nil, fmt.Errorf("expected object result: %s", err)
+			}
+			for k, v := range m {
+				merged[k] = v
+			}
+		}
+		return json.Marshal(merged)
+	}
+	return nil, fmt.Errorf("unknown merge strategy: %d", merge)
+}
@@ -4,19 +4,25 @@ package gateway
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"mime"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
 
 	"github.com/gorilla/rpc/v2"
 	"github.com/gorilla/rpc/v2/json2"
@@ -32,39 +38,241 @@ type remoteService struct {
 	gatewaytypes.Service
 	*url.URL
 	origURL string
+
+	// handler is set for services which are handled in-process, see AddHandler
+	handler http.Handler
+
+	// backendName is the name the backend itself knows the service by, if it's
+	// different than the name it's registered under in the gateway
+	backendName string
+
+	// tagged are all of the backends the service was added from using
+	// AddURLTagged
+	tagged []taggedBackend
+
+	// contentTypes are the content types the backend accepts requests in, if
+	// it reported them
+	contentTypes []string
+
+	// lastRefresh is when the service was last successfully fetched from its
+	// backend. It's zero for services added with AddHandler, which never need
+	// refreshing
+	lastRefresh time.Time
+}
+
+// checkContentType returns an error if the backend reported which content
+// types it accepts, and the request's isn't one of them
+func (rsrv remoteService) checkContentType(r *http.Request) error {
+	ct := r.Header.Get("Content-Type")
+	if i := strings.Index(ct, ";"); i >= 0 {
+		ct = ct[:i]
+	}
+	ct = strings.TrimSpace(ct)
+	if ct == "" || len(rsrv.contentTypes) == 0 {
+		return nil
+	}
+	for _, accepted := range rsrv.contentTypes {
+		if strings.EqualFold(ct, accepted) {
+			return nil
+		}
+	}
+	return &json2.Error{
+		Code: json2.E_SERVER,
+		Message: fmt.Sprintf(
+			"codec mismatch: backend for %s doesn't accept %q, only %s",
+			rsrv.Name, ct, strings.Join(rsrv.contentTypes, ", "),
+		),
+	}
 }
 
-var externalHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-	res, err := http.DefaultClient.Do(r)
+// ErrServiceCollision is returned from AddURL when RejectCollisions is set and
+// the url has a service which was already added from a different url
+var ErrServiceCollision = errors.New("service already added from a different url")
+
+// DefaultRefreshInterval is how often a Gateway refreshes its services from
+// their backends, unless changed using SetRefreshInterval
+const DefaultRefreshInterval = 30 * time.Second
+
+// DefaultRefreshConcurrency is the RefreshConcurrency NewGateway sets
+const DefaultRefreshConcurrency = 4
+
+// DefaultMaxRefreshFailures is the MaxRefreshFailures NewGateway sets
+const DefaultMaxRefreshFailures = 3
+
+// DefaultMaxDecompressedBytes is used if Gateway's MaxDecompressedBytes isn't
+// set
+const DefaultMaxDecompressedBytes = 10 << 20
+
+// defaultContentType is used for backend responses if neither the response nor
+// the request had a Content-Type
+const defaultContentType = "application/json"
+
+var externalHandler = newExternalHandler(http.DefaultClient)
+
+// newExternalHandler returns a handler which forwards requests to backends
+// using the given client
+func newExternalHandler(client *http.Client) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwardExternal(client, w, r)
+	})
+}
+
+func forwardExternal(client *http.Client, w http.ResponseWriter, r *http.Request) {
+	res := doExternal(client, w, r)
+	if res == nil {
+		return
+	}
+	defer res.Body.Close()
+
+	if lr, ok := w.(*limitedRecorder); ok {
+		// Uncompressed is set if the transport transparently decompressed the
+		// response for us
+		lr.compressed = res.Uncompressed || res.Header.Get("Content-Encoding") != ""
+		lr.status = res.StatusCode
+	}
+
+	// keep the backend's headers in case any are meant to be passed back, see
+	// PassResponseHeaders
+	for k, vv := range res.Header {
+		w.Header()[k] = vv
+	}
+
+	w.Header().Set("Content-Type", responseContentType(res, r))
+	if err := copyResponse(r.Context(), w, res.Body); err != nil && err != errResponseTooLarge {
+		llog.Error("error copying backend response", llog.KV{
+			"url": r.URL.String(),
+			"err": err,
+		})
+	}
+}
+
+// doExternal sends the request to its backend. If it couldn't be sent then nil
+// is returned, and the error is written to w
+func doExternal(client *http.Client, w http.ResponseWriter, r *http.Request) *http.Response {
+	res, err := client.Do(r)
 	if err != nil {
 		if ue, ok := errctx.Base(err).(*url.Error); ok && ue.Err == context.Canceled {
 			err = context.Canceled
 		}
-		if err != context.Canceled {
+		if err != context.Canceled && r.Context().Err() != context.DeadlineExceeded {
 			llog.Error("error forwarding request", llog.KV{
 				"url": r.URL.String(),
 				"err": err,
 			})
 		}
+		if lr, ok := w.(*limitedRecorder); ok {
+			lr.forwardErr = err
+		}
 		writeErrorf(w, 500, "{}")
-		return
+		return nil
 	}
-	defer res.Body.Close()
+	return res
+}
 
-	//pass along the content-type
-	w.Header().Set("Content-Type", res.Header.Get("Content-Type"))
-	io.Copy(w, res.Body)
-})
+// responseContentType returns the Content-Type of the backend's response,
+// falling back to the request's if the backend didn't send one
+func responseContentType(res *http.Response, r *http.Request) string {
+	ct := res.Header.Get("Content-Type")
+	if ct == "" {
+		ct = r.Header.Get("Content-Type")
+	}
+	if ct == "" {
+		ct = defaultContentType
+	}
+	return ct
+}
 
 // Gateway is an http.Handler which implements the JSON RPC2 spec, but forwards
 // all of its requests onto backend services
 type Gateway struct {
 	services  map[string]remoteService
+	aliases   map[string]string
 	mutex     sync.RWMutex
 	codecs    map[string]rpc.Codec
-	poll      <-chan time.Time
+	poll      *time.Ticker
 	SRVClient *srvclient.SRVClient
 
+	// maintenance messages, keyed by service name. The empty key is for the
+	// gateway as a whole
+	maintenance map[string]string
+
+	middlewares []methodMiddleware
+
+	// see AddStreamTransformer
+	streamTransformers []streamTransformer
+
+	// set once any AddURL or AddHandler call has succeeded
+	discovered bool
+
+	// urls which couldn't be added, mapped to their tags, which are retried
+	// when refreshing
+	pending map[string]map[string]string
+
+	compression compressionTracker
+
+	signatureKeyLookup func(keyID string) ([]byte, error)
+
+	events chan RoutingEvent
+
+	// methods which are safe to send more than once, see MarkIdempotent
+	idempotent map[string]bool
+
+	coalescer coalescer
+
+	// methods which are sent to multiple backends, see FanOut
+	fanOuts map[string]fanOut
+
+	// path prefixes which are proxied, mapped to the service they go to
+	proxies map[string]string
+
+	// the number of instances each backend host resolved to, see
+	// InstanceCount. It has its own lock since it's updated on every request
+	instancesL sync.Mutex
+	instances  map[string]int
+
+	// the number of requests sent to each backend host using LBRoundRobin,
+	// also guarded by instancesL
+	roundRobin map[string]int
+
+	// the ResolveMode of each backend host, also guarded by instancesL. See
+	// AddURLResolveMode
+	resolveModes map[string]ResolveMode
+
+	// used in place of net.LookupHost and SRVClient.AllSRV, if set, so tests
+	// can see what was looked up
+	dnsLookup func(host string) ([]string, error)
+	srvLookup func(host string) ([]string, error)
+
+	slowRequests slowRequests
+
+	poolStats poolStats
+
+	// the circuit breaker of each service, see BreakerThreshold
+	breakers breakers
+
+	// set by SetBackendTLS, used for connecting to backends instead of the
+	// defaults
+	client   *http.Client
+	external http.Handler
+
+	// urls of backends which requests shouldn't be sent to, see DrainBackend
+	drained map[string]bool
+
+	// the number of times in a row each url has failed to be refreshed, see
+	// MaxRefreshFailures
+	refreshFailures map[string]int
+
+	// set while refreshURLs is running
+	refreshing int32
+
+	// methods whose large requests go to a different backend, see
+	// RouteBySize
+	sizeRoutes map[string]sizeRoute
+
+	// methods whose failed forwards are passed to DeadLetter, see
+	// MarkDeadLetter
+	deadLetter map[string]bool
+
 	// BackupHandler, if not nil, will be used to handle the requests which
 	// don't have a corresponding backend service to forward to (based on their
 	// method)
@@ -76,10 +284,318 @@ type Gateway struct {
 	// Request using a Write* method then no forwarding will be done
 	RequestCallback func(*Request)
 
+	// ErrorCodeMapper, if not nil, is called with the service name and code of
+	// every error response from a backend, and the code it returns is what's
+	// sent to the client instead. This can be used to normalize the codes of
+	// backends which use different conventions
+	ErrorCodeMapper func(service string, backendCode int) int
+
+	// PassthroughLarge, if true, causes the responses of backends to be
+	// streamed directly to the client as they're read, with their original
+	// status, rather than being buffered in memory, decoded, and re-encoded.
+	// This avoids holding large responses in memory. It only applies to
+	// requests using a *json2.Codec itself, not a wrapper around one, whose
+	// responses don't need to be changed, i.e. which won't be fanned out,
+	// hedged, or coalesced, and only when none of ResponseTranscoder,
+	// ErrorCodeMapper, and MaxResponseBytes are set. The Cache-Control header
+	// of Cacheable methods isn't sent for streamed responses
+	PassthroughLarge bool
+
+	// ResponseTranscoder, if not nil, is used to write the response to the
+	// client from the response of the backend, rather than JSON2Transcoder
+	// (or the ClientCodec of the request's codec, if it has one).
+	// ErrorCodeMapper and the Cache-Control header of Cacheable methods
+	// aren't applied to responses it writes
+	ResponseTranscoder ResponseTranscoder
+
+	// DryRun, if true, causes requests to be fully routed, but not actually
+	// forwarded. Instead what would have been forwarded is logged and passed to
+	// DryRunHook, and the client is sent back an empty object as the result
+	DryRun bool
+
+	// DryRunHook, if not nil, is called with every request which would have
+	// been forwarded while DryRun is set. backend is empty for requests which
+	// would have gone to the BackupHandler or an in-process handler
+	DryRunHook func(method, backend string, paramsSize int)
+
+	// MetricsLabeler, if not nil, is called for every request which is
+	// forwarded, and the labels it returns are included in the request's
+	// RoutingEvent (see Events). Care should be taken to keep the number of
+	// distinct labels low
+	MetricsLabeler func(*Request) map[string]string
+
+	// CallGraphHook, if not nil, will be called whenever a request's method is
+	// changed by RequestCallback or a method middleware, with the method which
+	// was called and the method which will actually be forwarded. This can be
+	// used to record the dependencies between services
+	CallGraphHook func(from, to string)
+
 	// CORSMatch, if not nil, will be used against the Origin header. and if it
 	// matches Access-Control-Allow-* headers will be sent back, including an
 	// Allow-Access-Control-Origin matching the sent in Origin
 	CORSMatch *regexp.Regexp
+
+	// MaxResponseBytes, if greater than zero, is the maximum number of bytes
+	// of a backend's response which will be buffered. If a backend's response
+	// exceeds it then the client is sent an internal error instead
+	MaxResponseBytes int64
+
+	// MaxBatchSize is the most requests a single batch may contain. Larger
+	// batches are rejected outright. Defaults to DefaultMaxBatchSize
+	MaxBatchSize int
+
+	// BatchConcurrency is the most requests from a single batch which will be
+	// handled at once. Defaults to DefaultBatchConcurrency
+	BatchConcurrency int
+
+	// MaxDecompressedBytes is the maximum size a gzip'd request body may be
+	// once decompressed. Larger requests are rejected with a 413. Defaults to
+	// DefaultMaxDecompressedBytes
+	MaxDecompressedBytes int64
+
+	// ForwardTimeout, if greater than zero, is the default amount of time a
+	// request to a backend is allowed to take before the client is sent a 504.
+	// It's measured from when forwarding begins, so time spent in
+	// RequestCallback and middleware isn't included. For batches it also
+	// limits how long the batch as a whole may take
+	ForwardTimeout time.Duration
+
+	// MaxRequestTimeout, if greater than zero, allows clients to specify their
+	// own forward timeout using the X-Request-Timeout-Ms header, overriding
+	// ForwardTimeout. Values which are invalid or greater than
+	// MaxRequestTimeout are ignored
+	MaxRequestTimeout time.Duration
+
+	// MissingParams determines what is done with requests which are missing
+	// their params entirely. See MissingParamsBehavior
+	MissingParams MissingParamsBehavior
+
+	// ValidateArgs, if true, causes the params of requests to be checked
+	// against the args of the method being called before being forwarded.
+	// Requests whose params don't match get an invalid params error
+	ValidateArgs bool
+
+	// AllowExtraFields determines whether, when ValidateArgs is true, fields in
+	// the params which aren't part of the method's args are allowed. NewGateway
+	// sets this to true
+	AllowExtraFields bool
+
+	// RequestIDHeader, if set, is the header used to identify requests. If a
+	// request doesn't have one then an id is generated for it. The id is
+	// forwarded to backends, sent back to the client, and included in logs.
+	// NewGateway sets this to DefaultRequestIDHeader
+	RequestIDHeader string
+
+	// SchemaVersionHeader, if set, is the header clients can use to pin the
+	// schema version of the backend their request is sent to. Requests are
+	// only sent to backends whose SchemaVersionTag matches it, and are sent
+	// back an error if there aren't any. Services which have no backends with
+	// a SchemaVersionTag ignore it. NewGateway sets this to
+	// DefaultSchemaVersionHeader
+	SchemaVersionHeader string
+
+	// DefaultCharset is used as the charset parameter of the Content-Type of
+	// all responses the gateway writes, other than those to proxied paths or
+	// those using a ResponseContentTyper codec. If empty the charset parameter
+	// is omitted. NewGateway sets this to "utf-8"
+	DefaultCharset string
+
+	// CoerceScalars, if true, causes strings in the params of requests to be
+	// converted into ints, floats, or bools where the args of the method being
+	// called expect those. Strings which can't be converted are left as-is.
+	// This is done before ValidateArgs is applied
+	CoerceScalars bool
+
+	// TimingHeaders, if true, causes an X-Gateway-Upstream-Duration-Ms header
+	// to be sent back with every forwarded request, containing the number of
+	// milliseconds spent waiting on the backend
+	TimingHeaders bool
+
+	// EnvelopeDecoder, if not nil, is given the body of every request before
+	// it's decoded as a normal rpc request, and can be used to support clients
+	// which send requests in some non-standard format. It should extract the
+	// method and params from the body, which are then routed as normal. If it
+	// returns an error the request is handled as a normal rpc request.
+	EnvelopeDecoder func([]byte) (method string, params json.RawMessage, err error)
+
+	// EnvelopeEncoder is used to encode the response to requests which were
+	// decoded by EnvelopeDecoder, and is given either the result of the call
+	// or the error. If nil then a json object with "result" and "error" fields
+	// is used.
+	EnvelopeEncoder func(result json.RawMessage, err error) ([]byte, error)
+
+	// Retries is the number of times a request will be retried if it couldn't
+	// be sent to its backend at all (e.g. the connection was refused). Requests
+	// for idempotent methods (see MarkIdempotent) are also retried if the
+	// connection failed after they were sent, e.g. it was reset before a
+	// response came back. The backend's url is resolved again before each
+	// retry, so it may be sent to a different instance. Requests which got back
+	// an error status aren't retried. Retries stop early if the forward's
+	// deadline would be exceeded
+	Retries int
+
+	// Backoff, if not nil, returns how long to wait before the given retry
+	// attempt (starting at 1). Defaults to DefaultBackoff
+	Backoff func(attempt int) time.Duration
+
+	// RetryBudget, if not nil, limits how many retries may be made relative to
+	// the number of requests being forwarded. See NewRetryBudget
+	RetryBudget *RetryBudget
+
+	// RealIPHeader, if set, is the header (e.g. X-Real-IP or X-Forwarded-For)
+	// which will be used to determine the ip of the client, for requests which
+	// come from one of the TrustedProxies. The ip is used for logging, is
+	// available to callbacks using Request.ClientIP, and is forwarded onto
+	// backends in the X-Forwarded-For chain and RealIPHeader.
+	RealIPHeader string
+
+	// TrustedProxies are the networks which are trusted to set RealIPHeader.
+	// See ParseCIDRs
+	TrustedProxies []*net.IPNet
+
+	// RejectCollisions, if true, causes AddURL to return ErrServiceCollision
+	// rather than overwriting a service which was already added from a
+	// different url
+	RejectCollisions bool
+
+	// SignatureMaxAge is how old a signature's timestamp may be when
+	// RequireSignature is being used. Defaults to DefaultSignatureMaxAge
+	SignatureMaxAge time.Duration
+
+	// Resolver, if not nil, is used to resolve the hosts of backends instead of
+	// SRVClient. If it returns an error then requests for the backend's
+	// services are sent back an error rather than being forwarded
+	Resolver func(host string) (string, error)
+
+	// InstanceResolver, if not nil, is used instead of Resolver and SRVClient
+	// to resolve the hosts of backends. It returns the addresses of all
+	// instances of the backend, one of which is picked using LBStrategy. See
+	// InstanceCount
+	InstanceResolver func(host string) ([]string, error)
+
+	// LBStrategy determines which instance is picked when a backend's host
+	// resolves to more than one, either through InstanceResolver or SRV
+	// records. Defaults to LBRandom
+	LBStrategy LBStrategy
+
+	// OnResolveError, if not nil, is called with the service name and error
+	// whenever resolving the backend for a request fails
+	OnResolveError func(service string, err error)
+
+	// RoutingHintHeader, if set, is the header clients can use to pick which
+	// of a service's tagged backends their request is sent to, by giving the
+	// value of the backend's RoutingHintTag. See AddURLTagged
+	RoutingHintHeader string
+
+	// RoutingHintTag is the tag of backends which is matched against the
+	// RoutingHintHeader, e.g. "region"
+	RoutingHintTag string
+
+	// SlowRequestsSize is how many of the slowest forwarded requests are kept
+	// for SlowestRequests. If zero none are kept. NewGateway sets this to
+	// DefaultSlowRequestsSize
+	SlowRequestsSize int
+
+	// SlowRequestsWindow is how long requests are kept for SlowestRequests. If
+	// zero they're kept until slower ones replace them. NewGateway sets this
+	// to DefaultSlowRequestsWindow
+	SlowRequestsWindow time.Duration
+
+	// RefreshConcurrency is the most urls which will be refreshed at once.
+	// NewGateway sets this to DefaultRefreshConcurrency
+	RefreshConcurrency int
+
+	// MaxRefreshFailures is the number of times in a row a url may fail to be
+	// refreshed before all of its services are removed, as if RemoveURL was
+	// called with it. The url is still retried when refreshing, and its
+	// services are added back once it succeeds. If zero services are never
+	// removed. NewGateway sets this to DefaultMaxRefreshFailures
+	MaxRefreshFailures int
+
+	// BreakerThreshold, if greater than zero, is the number of forwards to a
+	// service in a row which may fail, either by not reaching the backend,
+	// timing out, or getting back a 5xx, before the service's circuit breaker
+	// opens. While it's open requests for the service are sent back a 503
+	// without being forwarded, or are handled by BackupHandler if it's set.
+	// Once BreakerCooldown has passed a single request is let through, and if
+	// it succeeds the breaker closes again
+	BreakerThreshold int
+
+	// BreakerCooldown is how long a service's circuit breaker stays open
+	// before a request is let through to probe the backend. NewGateway sets
+	// this to DefaultBreakerCooldown
+	BreakerCooldown time.Duration
+
+	// RootHealthCheck, if true, causes GET requests to "/" which aren't rpc
+	// calls (see AllowGET) to be sent back a 200, rather than a 405, for load
+	// balancers which health check that path
+	RootHealthCheck bool
+
+	// MethodParser, if not nil, is used to split the method of every request
+	// into the name of the service and the name of the method within it.
+	// Requests are always forwarded to backends using "Service.Method".
+	// Defaults to DefaultMethodParser
+	MethodParser func(raw string) (service, method string, err error)
+
+	// AuditSink, if set, is called with an AuditRecord for every request for a
+	// method which its backend marked as Auditable, once the request has been
+	// forwarded
+	AuditSink func(AuditRecord)
+
+	// DeadLetter, if set, is called with the method and the full json rpc
+	// request body of requests which couldn't be forwarded to their backend,
+	// after all retries have been exhausted, so that they can be persisted and
+	// replayed later. Only methods marked with MarkDeadLetter are passed to it
+	DeadLetter func(method string, body []byte)
+
+	// AllowGET, if true, allows methods which are idempotent (see
+	// MarkIdempotent) to be called using a GET request, with the method, params
+	// (as json), and id given by the "method", "params", and "id" query
+	// parameters. GET requests for any other method get a 405
+	AllowGET bool
+
+	// RejectLegacyProtocol, if true, causes json rpc 1.0 requests to be sent
+	// back a 426 with an error telling the client to upgrade to json rpc 2.0,
+	// rather than being passed to the codec
+	RejectLegacyProtocol bool
+
+	// JSONTransportErrors, if true, causes requests which are rejected before
+	// being decoded (e.g. for having the wrong http method or Content-Type)
+	// to be sent back a JSON RPC error object rather than plain text
+	JSONTransportErrors bool
+
+	// HedgeAfter, if greater than zero, is how long to wait on a backend
+	// before sending the same request to a second instance of it, using
+	// whichever responds first. Only methods marked with MarkIdempotent are
+	// hedged
+	HedgeAfter time.Duration
+
+	// KeyFunc, if not nil, is used to generate the key which identifies
+	// requests with the same method and params, e.g. for CoalesceReads.
+	// Defaults to DefaultKeyFunc
+	KeyFunc func(method string, params json.RawMessage) (string, error)
+
+	// ForwardHeaders, if set, are the only headers of requests which are
+	// forwarded to backends, e.g. Authorization, along with those the gateway
+	// sets itself (e.g. RequestIDHeader and X-Forwarded-For). Hop-by-hop
+	// headers, such as Connection and Transfer-Encoding, are never forwarded
+	ForwardHeaders []string
+
+	// PassResponseHeaders are the headers which, if set on a backend's
+	// response, will be copied onto the response sent back to the client
+	PassResponseHeaders []string
+
+	// MaxCatalogStaleness, if greater than zero, is how long it may be since a
+	// service was last successfully refreshed from its backend before requests
+	// for it are rejected. Until then requests are routed using the last
+	// successfully fetched services, even if refreshing is failing
+	MaxCatalogStaleness time.Duration
+
+	// CoalesceReads, if true, causes concurrent requests for the same method
+	// with identical params to share a single backend call, with all of them
+	// receiving its response. Only methods marked with MarkIdempotent are
+	// coalesced
+	CoalesceReads bool
 }
 
 // NewGateway returns an instantiated Gateway object
@@ -88,26 +604,158 @@ func NewGateway() *Gateway {
 	srv.EnableCacheLast()
 	return &Gateway{
 		services:  map[string]remoteService{},
+		aliases:   map[string]string{},
 		codecs:    map[string]rpc.Codec{},
-		poll:      time.Tick(30 * time.Second),
+		poll:      time.NewTicker(DefaultRefreshInterval),
 		SRVClient: srv,
+
+		maintenance:      map[string]string{},
+		idempotent:       map[string]bool{},
+		proxies:          map[string]string{},
+		fanOuts:          map[string]fanOut{},
+		deadLetter:       map[string]bool{},
+		instances:        map[string]int{},
+		roundRobin:       map[string]int{},
+		resolveModes:     map[string]ResolveMode{},
+		sizeRoutes:       map[string]sizeRoute{},
+		refreshFailures:  map[string]int{},
+		drained:          map[string]bool{},
+		pending:          map[string]map[string]string{},
+		events:           make(chan RoutingEvent, eventsBufferSize),
+		AllowExtraFields: true,
+		DefaultCharset:   "utf-8",
+		RequestIDHeader:  DefaultRequestIDHeader,
+
+		SchemaVersionHeader: DefaultSchemaVersionHeader,
+		SlowRequestsSize:    DefaultSlowRequestsSize,
+		SlowRequestsWindow:  DefaultSlowRequestsWindow,
+		MaxRefreshFailures:  DefaultMaxRefreshFailures,
+		RefreshConcurrency:  DefaultRefreshConcurrency,
+		BreakerCooldown:     DefaultBreakerCooldown,
+	}
+}
+
+// SetRefreshInterval changes how often the Gateway refreshes its services from
+// their backends. Refreshes are only ever started by requests being served, so
+// they may happen less often than this if requests are infrequent. If d isn't
+// positive then periodic refreshes are disabled.
+func (g *Gateway) SetRefreshInterval(d time.Duration) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	// the stopped ticker is kept when disabling, since its channel will never
+	// be sent on
+	g.poll.Stop()
+	if d > 0 {
+		g.poll = time.NewTicker(d)
 	}
 }
 
 // resolveURL returns a copy of the given url, with the host potentially
-// resolved using a srv request
-func (g *Gateway) resolveURL(uu *url.URL) *url.URL {
+// resolved using a srv request, or using InstanceResolver or Resolver if either
+// is set. Everything other than the host, e.g. the path and query, is kept
+// as-is. The number of instances the host resolved to is recorded for
+// InstanceCount
+func (g *Gateway) resolveURL(uu *url.URL) (*url.URL, error) {
 	uu2 := *uu
-	uu2.Host = g.SRVClient.MaybeSRV(uu.Host)
-	return &uu2
+	host, n, err := g.resolveHost(uu.Host)
+	if err != nil {
+		return nil, err
+	}
+	uu2.Host = host
+
+	g.instancesL.Lock()
+	g.instances[uu.Host] = n
+	g.instancesL.Unlock()
+	return &uu2, nil
+}
+
+// resolveHost returns the address the given host should be connected to, along
+// with how many instances were found for it
+func (g *Gateway) resolveHost(host string) (string, int, error) {
+	if g.InstanceResolver != nil {
+		addrs, err := g.InstanceResolver(host)
+		if err != nil {
+			return "", 0, err
+		} else if len(addrs) == 0 {
+			return "", 0, fmt.Errorf("no instances found for %q", host)
+		}
+		return g.pickInstance(host, addrs), len(addrs), nil
+	} else if g.Resolver != nil {
+		addr, err := g.Resolver(host)
+		return addr, 1, err
+	}
+	return g.resolveByMode(host)
+}
+
+// InstanceCount returns how many instances the given service's backend host
+// resolved to the last time it was resolved. An error is returned if the
+// service is unknown, is handled in-process, or hasn't been resolved yet
+func (g *Gateway) InstanceCount(service string) (int, error) {
+	g.mutex.RLock()
+	rsrv, ok := g.services[service]
+	g.mutex.RUnlock()
+	if !ok {
+		return 0, fmt.Errorf("unknown service %q", service)
+	} else if rsrv.URL == nil {
+		return 0, errors.New("service is handled in-process")
+	}
+
+	g.instancesL.Lock()
+	defer g.instancesL.Unlock()
+	n, ok := g.instances[rsrv.URL.Host]
+	if !ok {
+		return 0, fmt.Errorf("service %q hasn't been resolved", service)
+	}
+	return n, nil
+}
+
+// getServices performs the RPC.GetServices request against the given url
+func (g *Gateway) getServices(u string, res interface{}) error {
+	b, err := json2.EncodeClientRequest("RPC.GetServices", &struct{}{})
+	if err != nil {
+		return err
+	}
+	resp, err := g.httpClient().Post(u, defaultContentType, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json2.DecodeClientResponse(resp.Body, res)
 }
 
 // AddURL performs the RPC.GetServices request against the given url, and will
 // add all returned services to its mapping.
 //
 // All DNS will be attempted to be resolved using SRV records first, and will
-// use a normal DNS request as a backup
+// use a normal DNS request as a backup.
+//
+// The url's path and query (e.g. "/api/rpc") are used verbatim for every
+// request forwarded to the backend, regardless of the path the request was
+// made to the gateway on.
+//
+// If the backend couldn't be reached the url is remembered, and will be tried
+// again whenever the gateway refreshes its services and by WarmUp
 func (g *Gateway) AddURL(u string) error {
+	return g.addURL(u, nil)
+}
+
+// AddURLTagged is like AddURL, but the backend is tagged with the given
+// metadata (e.g. {"region": "eu"}). A service may be added from multiple urls
+// with different tags, in which case requests with a RoutingHintHeader will be
+// sent to the backend whose RoutingHintTag matches it, and requests with a
+// SchemaVersionHeader only to backends whose SchemaVersionTag matches it. Requests without a
+// hint, or whose hint doesn't match any backend, are sent to the url the
+// service was most recently added from.
+//
+// RejectCollisions doesn't apply to tagged urls.
+func (g *Gateway) AddURLTagged(u string, tags map[string]string) error {
+	if tags == nil {
+		tags = map[string]string{}
+	}
+	return g.addURL(u, tags)
+}
+
+func (g *Gateway) addURL(u string, tags map[string]string) error {
 	if !strings.HasPrefix(u, "http") {
 		u = "http://" + u
 	}
@@ -119,13 +767,20 @@ func (g *Gateway) AddURL(u string) error {
 		return errors.New("invalid url specified")
 	}
 
-	u2 := g.resolveURL(uu).String()
+	ruu, err := g.resolveURL(uu)
+	if err != nil {
+		g.setPending(u, tags)
+		return err
+	}
+	u2 := ruu.String()
 	llog.Debug("resolved add url", llog.KV{"originalURL": u, "resolvedURL": u2})
 
 	res := struct {
-		Services []gatewaytypes.Service `json:"services"`
+		Services     []gatewaytypes.Service `json:"services"`
+		ContentTypes []string               `json:"contentTypes"`
 	}{}
-	if err = rpcutil.JSONRPC2Call(u2, &res, "RPC.GetServices", &struct{}{}); err != nil {
+	if err = g.getServices(u2, &res); err != nil {
+		g.setPending(u, tags)
 		return err
 	}
 
@@ -137,48 +792,486 @@ func (g *Gateway) AddURL(u string) error {
 
 	g.mutex.Lock()
 	defer g.mutex.Unlock()
+	if g.RejectCollisions && tags == nil {
+		for _, srv := range res.Services {
+			if existing, ok := g.services[srv.Name]; ok && existing.origURL != u && !existing.hasTagged(u) {
+				llog.Warn("service collision", llog.KV{
+					"service":     srv.Name,
+					"url":         u,
+					"existingURL": existing.origURL,
+				})
+				return ErrServiceCollision
+			}
+		}
+	}
+	now := time.Now()
 	for _, srv := range res.Services {
+		tagged := g.services[srv.Name].tagged
+		if tags != nil {
+			tagged = withTaggedBackend(tagged, taggedBackend{URL: uu, origURL: u, tags: tags})
+		}
 		g.services[srv.Name] = remoteService{
+			Service:     srv,
+			URL:         uu,
+			origURL:     u,
+			lastRefresh: now,
+			tagged:      tagged,
+
+			contentTypes: res.ContentTypes,
+		}
+	}
+	delete(g.pending, u)
+	g.discovered = true
+	return nil
+}
+
+// AddURLResult is the outcome of adding a single url using AddURLsDetailed
+type AddURLResult struct {
+	URL string
+	Err error
+}
+
+// AddURLsDetailed calls AddURL on each of the given urls concurrently, and
+// returns the result for each one in the same order as the urls were given
+func (g *Gateway) AddURLsDetailed(urls []string) []AddURLResult {
+	results := make([]AddURLResult, len(urls))
+	var wg sync.WaitGroup
+	for i := range urls {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = AddURLResult{URL: urls[i], Err: g.AddURL(urls[i])}
+		}(i)
+	}
+	wg.Wait()
+	return results
+}
+
+// AddURLs is like AddURLsDetailed, but returns a single error describing all of
+// the urls which couldn't be added, if any
+func (g *Gateway) AddURLs(urls []string) error {
+	var failed []string
+	for _, res := range g.AddURLsDetailed(urls) {
+		if res.Err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", res.URL, res.Err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d urls failed: %s", len(failed), len(urls), strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// RemoveURL removes all services which were added from the given url, so that
+// requests for them are no longer forwarded to it. If a service was also added
+// from other urls using AddURLTagged then the most recently added of those
+// becomes its url instead. An error is returned if no services were added from
+// the url.
+func (g *Gateway) RemoveURL(u string) error {
+	if !strings.HasPrefix(u, "http") {
+		u = "http://" + u
+	}
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	var removed bool
+	for name, rsrv := range g.services {
+		if rsrv.origURL != u && !rsrv.hasTagged(u) {
+			continue
+		}
+		removed = true
+
+		tagged := make([]taggedBackend, 0, len(rsrv.tagged))
+		for _, tb := range rsrv.tagged {
+			if tb.origURL != u {
+				tagged = append(tagged, tb)
+			}
+		}
+		rsrv.tagged = tagged
+		if rsrv.origURL == u {
+			if len(tagged) == 0 {
+				delete(g.services, name)
+				continue
+			}
+			last := tagged[len(tagged)-1]
+			rsrv.URL, rsrv.origURL = last.URL, last.origURL
+		}
+		g.services[name] = rsrv
+	}
+	if _, ok := g.pending[u]; ok {
+		delete(g.pending, u)
+		removed = true
+	}
+
+	if !removed {
+		return fmt.Errorf("no services were added from %q", u)
+	}
+	return nil
+}
+
+// AddHandler performs the RPC.GetServices request against the given handler,
+// and will add all returned services to its mapping. Requests for those
+// services are passed directly to the handler rather than being forwarded over
+// the network, which is useful for backends living in the same process as the
+// gateway.
+//
+// If name is given then the handler's service will be added under that name
+// instead of its own, and requests will have their method renamed before being
+// passed to the handler. In that case the handler must have exactly one
+// service.
+func (g *Gateway) AddHandler(h http.Handler, name string) error {
+	res := struct {
+		Services []gatewaytypes.Service `json:"services"`
+	}{}
+	if err := rpcutil.JSONRPC2CallHandler(h, &res, "RPC.GetServices", &struct{}{}); err != nil {
+		return err
+	}
+	if name != "" && len(res.Services) != 1 {
+		return fmt.Errorf("handler has %d services, can only rename one", len(res.Services))
+	}
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	for _, srv := range res.Services {
+		rsrv := remoteService{
 			Service: srv,
-			URL:     uu,
-			origURL: u,
+			handler: h,
+		}
+		if name != "" {
+			rsrv.backendName = srv.Name
+			rsrv.Name = name
 		}
+		llog.Debug("adding handler service", llog.KV{"service": rsrv.Name})
+		g.services[rsrv.Name] = rsrv
 	}
+	g.discovered = true
 	return nil
 }
 
+// LivenessHandler returns an http.Handler which always responds with a 200,
+// for use as a liveness probe
+func (g *Gateway) LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	})
+}
+
+// isRootHealthCheck returns whether the request is a GET for "/" which isn't
+// an rpc call
+func isRootHealthCheck(r *http.Request) bool {
+	if r.Method != "GET" || (r.URL.Path != "/" && r.URL.Path != "") {
+		return false
+	}
+	return r.URL.Query().Get("method") == ""
+}
+
+// ReadinessHandler returns an http.Handler for use as a readiness probe. It
+// responds with a 503 until services have been successfully discovered from at
+// least one backend using AddURL or AddHandler, and a 200 after that
+func (g *Gateway) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		g.mutex.RLock()
+		discovered := g.discovered
+		g.mutex.RUnlock()
+		if !discovered {
+			writeErrorf(w, 503, "no backends discovered")
+			return
+		}
+		w.WriteHeader(200)
+	})
+}
+
 func (g *Gateway) refreshURLs() {
+	// ticks can queue up while a slow refresh is running, there's no point in
+	// starting another on top of it
+	if !atomic.CompareAndSwapInt32(&g.refreshing, 0, 1) {
+		llog.Debug("refresh already running, skipping")
+		return
+	}
+	defer atomic.StoreInt32(&g.refreshing, 0)
+
 	llog.Debug("refreshing urls")
 	g.mutex.RLock()
-	srvs := make([]remoteService, 0, len(g.services))
+	// each url is only refreshed once, even if it has many services. The
+	// services' own urls are refreshed after their other tagged urls so that
+	// they remain the ones requests go to by default
+	tagged := map[string]map[string]string{}
+	own := map[string]map[string]string{}
 	for _, srv := range g.services {
-		srvs = append(srvs, srv)
+		// services added with AddHandler don't have a url to refresh
+		if srv.origURL == "" {
+			continue
+		}
+		for _, tb := range srv.tagged {
+			if tb.origURL != srv.origURL {
+				tagged[tb.origURL] = tb.tags
+			}
+		}
+		own[srv.origURL] = nil
+	}
+	pending := make(map[string]map[string]string, len(g.pending))
+	for u, tags := range g.pending {
+		pending[u] = tags
+	}
+	g.mutex.RUnlock()
+
+	g.eachURL(pending, func(u string, tags map[string]string) {
+		if err := g.addURL(u, tags); err != nil {
+			llog.Error("error adding pending url", llog.KV{
+				"url": u,
+				"err": err,
+			})
+		}
+	})
+	g.eachURL(tagged, func(u string, tags map[string]string) {
+		g.refreshed(u, tags, g.addURL(u, tags))
+	})
+	g.eachURL(own, func(u string, _ map[string]string) {
+		g.refreshed(u, nil, g.AddURL(u))
+	})
+}
+
+// eachURL calls fn for each of the urls, with at most RefreshConcurrency
+// calls running at once, and returns once they're all done
+func (g *Gateway) eachURL(urls map[string]map[string]string, fn func(string, map[string]string)) {
+	n := g.RefreshConcurrency
+	if n < 1 {
+		n = 1
+	}
+	sem := make(chan struct{}, n)
+	var wg sync.WaitGroup
+	for u, tags := range urls {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(u string, tags map[string]string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			fn(u, tags)
+		}(u, tags)
+	}
+	wg.Wait()
+}
+
+// refreshed records the outcome of refreshing the given url, which was added
+// with the given tags, removing its services if it's failed MaxRefreshFailures
+// times in a row. A removed url is kept pending so that its services are added
+// back once it recovers
+func (g *Gateway) refreshed(u string, tags map[string]string, err error) {
+	g.mutex.Lock()
+	if err == nil {
+		delete(g.refreshFailures, u)
+		g.mutex.Unlock()
+		return
+	}
+	g.refreshFailures[u]++
+	failures := g.refreshFailures[u]
+	remove := g.MaxRefreshFailures > 0 && failures >= g.MaxRefreshFailures
+	if remove {
+		delete(g.refreshFailures, u)
+	}
+	g.mutex.Unlock()
+
+	kv := llog.KV{"url": u, "err": err, "failures": failures}
+	llog.Error("error refreshing url", kv)
+	if !remove {
+		return
+	}
+	llog.Warn("removing services of url which keeps failing to refresh", kv)
+	if err := g.RemoveURL(u); err != nil {
+		kv["err"] = err
+		llog.Error("error removing url", kv)
+	}
+	g.setPending(u, tags)
+}
+
+// AliasMethod causes all requests for the from method ("Service.MethodName") to
+// be forwarded as if they were for the to method instead. The params are left
+// intact. This is useful when renaming a backend method while clients are still
+// using the old name
+func (g *Gateway) AliasMethod(from, to string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.aliases[from] = to
+}
+
+func (g *Gateway) getAlias(m string) (string, bool) {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	to, ok := g.aliases[m]
+	return to, ok
+}
+
+// MarkIdempotent marks the given method (e.g. "Service.Method") as being safe
+// to send to backends more than once, or to share the response of between
+// clients, which enables HedgeAfter, CoalesceReads, and AllowGET for it. Only
+// methods which are idempotent and whose responses don't depend on who is
+// calling them should be marked. Methods which their backend has marked as
+// Idempotent are treated the same as those marked with this.
+func (g *Gateway) MarkIdempotent(method string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.idempotent[method] = true
+}
+
+func (g *Gateway) isIdempotent(method string) bool {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	return g.idempotent[method]
+}
+
+// MarkDeadLetter marks the given method (e.g. "Service.Method") as being
+// eligible to be passed to DeadLetter if it can't be forwarded
+func (g *Gateway) MarkDeadLetter(method string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.deadLetter[method] = true
+}
+
+func (g *Gateway) isDeadLetter(method string) bool {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	return g.deadLetter[method]
+}
+
+// SetMaintenance puts the whole gateway into, or takes it out of, maintenance
+// mode. While in maintenance mode all requests are sent back a 503 with an
+// error containing the given message
+func (g *Gateway) SetMaintenance(on bool, msg string) {
+	g.SetServiceMaintenance("", on, msg)
+}
+
+// SetServiceMaintenance is like SetMaintenance, but only applies to requests
+// for the given service
+func (g *Gateway) SetServiceMaintenance(service string, on bool, msg string) {
+	if msg == "" {
+		msg = "down for maintenance"
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if on {
+		g.maintenance[service] = msg
+	} else {
+		delete(g.maintenance, service)
+	}
+}
+
+// getMaintenance returns the maintenance message which applies to the given
+// method, if any
+func (g *Gateway) getMaintenance(mStr string) (string, bool) {
+	srvName, _, err := g.parseMethod(mStr)
+	if err != nil {
+		srvName = ""
+	}
+	return g.getServiceMaintenance(srvName)
+}
+
+// getServiceMaintenance returns the maintenance message which applies to the
+// given service, if any
+func (g *Gateway) getServiceMaintenance(srvName string) (string, bool) {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	if msg, ok := g.maintenance[""]; ok {
+		return msg, true
+	}
+	msg, ok := g.maintenance[srvName]
+	return msg, ok
+}
+
+// forwardTimeout returns the timeout which should be used when forwarding the
+// given request, or zero if there is none
+func (g *Gateway) forwardTimeout(r *http.Request) time.Duration {
+	if g.MaxRequestTimeout > 0 {
+		ms, err := strconv.ParseInt(r.Header.Get("X-Request-Timeout-Ms"), 10, 64)
+		d := time.Duration(ms) * time.Millisecond
+		if err == nil && d > 0 && d <= g.MaxRequestTimeout {
+			return d
+		}
+	}
+	return g.ForwardTimeout
+}
+
+// RegisterCodec is used to register an encoder/decoder which will operate on
+// requests with the given contentType. If the codec implements
+// ResponseContentTyper then its canonical Content-Type is used for all
+// responses to those requests. Requests are forwarded to backends as JSON RPC
+// 2.0, unless the codec implements ClientCodec.
+func (g *Gateway) RegisterCodec(codec rpc.Codec, contentType string) {
+	g.codecs[strings.ToLower(contentType)] = codec
+}
+
+// ResponseContentTyper may be implemented by codecs passed to RegisterCodec
+// which want their responses to always have a particular Content-Type,
+// regardless of the exact Content-Type the client sent in
+type ResponseContentTyper interface {
+	ResponseContentType() string
+}
+
+// contentTypeWriter adjusts the Content-Type of the response just before the
+// header is written. If contentType is set it replaces the Content-Type
+// entirely, otherwise the charset parameter of whatever Content-Type was set is
+// replaced with charset, or removed if charset is empty
+type contentTypeWriter struct {
+	http.ResponseWriter
+	contentType string
+	charset     string
+	wroteHeader bool
+}
+
+func (w *contentTypeWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if w.contentType != "" {
+			w.Header().Set("Content-Type", w.contentType)
+		} else if ct := w.Header().Get("Content-Type"); ct != "" {
+			w.Header().Set("Content-Type", withCharset(ct, w.charset))
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *contentTypeWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(200)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// withCharset returns the Content-Type with its charset parameter set to the
+// given one, or removed if charset is empty
+func withCharset(ct, charset string) string {
+	mediaType, params, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return ct
 	}
-	g.mutex.RUnlock()
+	delete(params, "charset")
+	if charset != "" {
+		params["charset"] = charset
+	}
+	return mime.FormatMediaType(mediaType, params)
+}
 
-	for _, srv := range srvs {
-		if err := g.AddURL(srv.origURL); err != nil {
-			llog.Error("error refreshing url", llog.KV{
-				"url": srv.origURL,
-				"err": err,
-			})
-		}
+// DefaultMethodParser is the default MethodParser. It splits the method on
+// its first period, e.g. "Service.Method"
+func DefaultMethodParser(raw string) (string, string, error) {
+	parts := strings.SplitN(raw, ".", 2)
+	if len(parts) != 2 {
+		return "", "", errors.New("invalid method endpoint given")
 	}
+	return parts[0], parts[1], nil
 }
 
-// RegisterCodec is used to register an encoder/decoder which will operate on
-// requests with the given contentType
-func (g *Gateway) RegisterCodec(codec rpc.Codec, contentType string) {
-	g.codecs[strings.ToLower(contentType)] = codec
+func (g *Gateway) parseMethod(mStr string) (string, string, error) {
+	if g.MethodParser != nil {
+		return g.MethodParser(mStr)
+	}
+	return DefaultMethodParser(mStr)
 }
 
 func (g *Gateway) getMethod(mStr string) (rsrv remoteService, m gatewaytypes.Method, err error) {
-	parts := strings.SplitN(mStr, ".", 2)
-	if len(parts) != 2 {
-		err = errors.New("invalid method endpoint given")
+	srvName, mName, err := g.parseMethod(mStr)
+	if err != nil {
 		return
 	}
-	srvName, mName := parts[0], parts[1]
 
 	var ok bool
 	g.mutex.RLock()
@@ -187,10 +1280,28 @@ func (g *Gateway) getMethod(mStr string) (rsrv remoteService, m gatewaytypes.Met
 		err = errors.New("no remote service for given name")
 	} else if m, ok = rsrv.Methods[mName]; !ok {
 		err = errors.New("remote service cannot handle this method")
+	} else if g.isStale(rsrv) {
+		err = errors.New("remote service has not been refreshed recently enough")
 	}
 	return
 }
 
+func (g *Gateway) isStale(rsrv remoteService) bool {
+	return g.MaxCatalogStaleness > 0 &&
+		!rsrv.lastRefresh.IsZero() &&
+		time.Since(rsrv.lastRefresh) > g.MaxCatalogStaleness
+}
+
+// LastRefresh returns when the given service was last successfully fetched
+// from its backend. It returns false if the service isn't known, and a zero
+// time for services added with AddHandler
+func (g *Gateway) LastRefresh(service string) (time.Time, bool) {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	rsrv, ok := g.services[service]
+	return rsrv.lastRefresh, ok
+}
+
 // GetMethodURL returns the url which should be used to call the given method
 // ("Service.MethodName"). If the service was originally resolved using a srv
 // request it will be re-resolved everytime this is called, in order to
@@ -200,8 +1311,10 @@ func (g *Gateway) GetMethodURL(mStr string) (*url.URL, error) {
 	rsrv, _, err := g.getMethod(mStr)
 	if err != nil {
 		return nil, err
+	} else if rsrv.URL == nil {
+		return nil, errors.New("service is handled in-process")
 	}
-	return g.resolveURL(rsrv.URL), nil
+	return g.resolveURL(rsrv.URL)
 }
 
 // We really only need the params part of this, we can get everything else from
@@ -213,18 +1326,40 @@ type serverRequest struct {
 
 // ServeHTTP satisfies Gateway being a http.Handler
 func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.ServeHTTPContext(r.Context(), w, r)
+}
+
+// ServeHTTPContext is like ServeHTTP, but uses the given context rather than
+// the request's for the forwarding of the request, so deadlines and
+// cancellation from the context will apply to the backend call
+func (g *Gateway) ServeHTTPContext(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	r = r.WithContext(ctx)
+
 	// Periodically we want to refresh the services that gateway knows about. We
 	// do it in a new goroutine so we don't block this actual request. We don't
 	// want to simply have a dedicated go routine looping over the poll channel
 	// to do this because having an http.Handler spawn up its own routine that's
 	// making requests and doing stuff is kind of unexpected behavior
+	g.mutex.RLock()
+	poll := g.poll.C
+	g.mutex.RUnlock()
 	select {
-	case <-g.poll:
+	case <-poll:
 		go g.refreshURLs()
 	default:
 	}
 
 	kv := rpcutil.RequestKV(r)
+	if g.RealIPHeader != "" {
+		ip := g.clientIP(r)
+		kv["ip"] = ip
+		g.setForwardedHeaders(r, ip)
+	}
+	if g.RequestIDHeader != "" {
+		id := g.requestID(r)
+		kv["requestID"] = id
+		w.Header().Set(g.RequestIDHeader, id)
+	}
 	llog.Debug("ServeHTTP called", kv)
 
 	// Possibly check CORS and set the headers to send back if it matches
@@ -236,55 +1371,218 @@ func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Access-Control-Allow-Headers", "DNT, User-Agent, X-Requested-With, Content-Type")
 	}
 
+	if service, ok := g.getProxy(r); ok {
+		if g.signatureKeyLookup != nil {
+			if err := g.verifySignature(r); err != nil {
+				kv["err"] = err
+				llog.Warn("invalid request signature", kv)
+				writeErrorf(w, 401, "%s", errBadSignature.Message)
+				return
+			}
+		}
+		g.serveProxy(w, r, service, kv)
+		return
+	}
+
+	ctw := &contentTypeWriter{ResponseWriter: w, charset: g.DefaultCharset}
+	w = ctw
+
 	// We allow OPTIONS so that preflighted requests can get CORS back
 	if r.Method == "OPTIONS" {
 		return
 	}
 
+	if g.RootHealthCheck && isRootHealthCheck(r) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(200)
+		w.Write([]byte("OK\n"))
+		return
+	}
+
+	if r.Method == "GET" && g.AllowGET {
+		if status, err := g.getToPost(r); err != nil {
+			kv["err"] = err
+			llog.Warn("invalid GET request", kv)
+			g.writeTransportError(w, status, json2.E_INVALID_REQ, "rpc: %s", err)
+			return
+		}
+	}
+
 	if r.Method != "POST" {
 		kv["method"] = r.Method
 		llog.Warn("invalid method sent", kv)
-		writeErrorf(w, 405, "rpc: POST method required, received %q", r.Method)
+		g.writeTransportError(w, 405, json2.E_INVALID_REQ, "rpc: POST method required, received %q", r.Method)
+		return
+	}
+
+	// the signature covers the body as it was received, so it's checked before
+	// the body is decompressed or handed off as an envelope or batch
+	if g.signatureKeyLookup != nil {
+		if err := g.verifySignature(r); err != nil {
+			kv["err"] = err
+			llog.Warn("invalid request signature", kv)
+			if codec, _ := g.getCodec(r); codec != nil {
+				writeStatusError(w, codec.NewRequest(r), 401, errBadSignature)
+			} else {
+				g.writeTransportError(w, 401, json2.E_INVALID_REQ, "rpc: %s", errBadSignature.Message)
+			}
+			return
+		}
+	}
+
+	if strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") {
+		gr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			kv["err"] = err
+			llog.Warn("invalid gzip body", kv)
+			g.writeTransportError(w, 400, json2.E_PARSE, "rpc: invalid gzip body: %s", err)
+			return
+		}
+		defer gr.Close()
+		max := g.MaxDecompressedBytes
+		if max <= 0 {
+			max = DefaultMaxDecompressedBytes
+		}
+		b, err := ioutil.ReadAll(io.LimitReader(gr, max+1))
+		if err != nil {
+			kv["err"] = err
+			llog.Warn("invalid gzip body", kv)
+			g.writeTransportError(w, 400, json2.E_PARSE, "rpc: invalid gzip body: %s", err)
+			return
+		} else if int64(len(b)) > max {
+			kv["maxDecompressedBytes"] = max
+			llog.Warn("decompressed body too large", kv)
+			g.writeTransportError(w, 413, json2.E_INVALID_REQ, "rpc: decompressed body larger than %d bytes", max)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(b))
+		r.ContentLength = int64(len(b))
+		// the body is re-encoded when being forwarded, and it won't be gzip'd
+		r.Header.Del("Content-Encoding")
+	}
+
+	if g.EnvelopeDecoder != nil && g.serveEnvelope(w, r, kv) {
+		return
+	}
+
+	codec, contentType := g.getCodec(r)
+	if codec == nil {
+		kv["contentType"] = contentType
+		llog.Warn("unknown content-type sent", kv)
+		g.writeTransportError(w, 415, json2.E_INVALID_REQ, "rpc: unrecognized Content-Type: %q", contentType)
+		return
+	}
+
+	if ct, ok := codec.(ResponseContentTyper); ok {
+		ctw.contentType = ct.ResponseContentType()
+	}
+
+	if g.serveBatch(w, r, codec) {
 		return
 	}
+	g.serveRequest(w, r, codec, kv)
+}
 
+// getCodec returns the codec for the request's Content-Type, or nil if there
+// isn't one, along with the Content-Type
+func (g *Gateway) getCodec(r *http.Request) (rpc.Codec, string) {
 	contentType := r.Header.Get("Content-Type")
-	idx := strings.Index(contentType, ";")
-	if idx != -1 {
+	if idx := strings.Index(contentType, ";"); idx != -1 {
 		contentType = contentType[:idx]
 	}
-	var codec rpc.Codec
 	// if no contentType was sent, assume the first codec if only one in list
 	// see: https://github.com/gorilla/rpc/pull/42/
 	if contentType == "" && len(g.codecs) == 1 {
 		// since codecs is a map we just need to loop and stop after the first
 		for _, c := range g.codecs {
-			codec = c
-			break
+			return c, contentType
 		}
-	} else if codec = g.codecs[strings.ToLower(contentType)]; codec == nil {
-		kv["contentType"] = contentType
-		llog.Warn("unknown content-type sent", kv)
-		writeErrorf(w, 415, "rpc: unrecognized Content-Type: %q", contentType)
+	}
+	return g.codecs[strings.ToLower(contentType)], contentType
+}
+
+// serveRequest handles a single rpc request using the given codec, forwarding
+// it to its backend service and writing back the response
+func (g *Gateway) serveRequest(w http.ResponseWriter, r *http.Request, codec rpc.Codec, kv llog.KV) {
+	// buffer the raw body so it's still available to the BackupHandler if the
+	// codec can't make sense of it
+	rawBody, err := peekBody(r)
+	if err != nil {
+		kv["err"] = err
+		llog.Warn("error reading request body", kv)
+		writeErrorf(w, 400, "rpc: error reading body: %s", err)
+		return
+	}
+
+	// the codec would ignore anything after the first json value, but it
+	// could be meant for something which reads the body differently
+	if id, ok := trailingData(rawBody); ok {
+		llog.Warn("trailing data after request", kv)
+		res := &errorRes{Version: "2.0", Error: errTrailingData}
+		if len(id) > 0 {
+			res.ID = id
+		}
+		writeJSON(w, res)
 		return
 	}
+
+	if g.RejectLegacyProtocol {
+		if id, ok := legacyProtocol(rawBody); ok {
+			llog.Warn("rejecting json rpc 1.0 request", kv)
+			res := &errorRes{Version: "2.0", Error: errLegacyProtocol, ID: id}
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(426)
+			writeJSON(w, res)
+			return
+		}
+	}
+
 	// note: this will consume the r.Body
 	codecReq := codec.NewRequest(r)
 
 	m, err := codecReq.Method()
-	if err != nil {
+	if err != nil && g.BackupHandler != nil {
+		kv["err"] = err
+		llog.Debug("error retrieving method from codec, using backup handler", kv)
+		r.Body = ioutil.NopCloser(bytes.NewBuffer(rawBody))
+		g.BackupHandler.ServeHTTP(w, r)
+		return
+	} else if err != nil {
 		kv["err"] = err
 		llog.Warn("error retrieving method from codec", kv)
 		codecReq.WriteError(w, 400, err)
 		return
 	}
 
+	if !validMethod(m) {
+		kv["method"] = sanitizeMethod(m)
+		llog.Warn("invalid method sent", kv)
+		codecReq.WriteError(w, 400, errInvalidMethod)
+		return
+	}
+
 	kv["method"] = m
 	llog.Debug("Received method call", kv)
 
+	if msg, ok := g.getMaintenance(m); ok {
+		llog.Debug("rejecting request due to maintenance", kv)
+		writeStatusError(w, codecReq, 503, &json2.Error{
+			Code:    json2.E_SERVER,
+			Message: msg,
+		})
+		return
+	}
+
+	var newMethod string
+	if to, ok := g.getAlias(m); ok {
+		kv["aliasOf"] = to
+		newMethod, m = to, to
+	}
+
 	var handler http.Handler
 	rsrv, rpcMethod, err := g.getMethod(m)
-	if err != nil {
+	found := err == nil
+	if !found {
 		// if they passed a backup handler then use that instead of erroring
 		if g.BackupHandler != nil {
 			handler = g.BackupHandler
@@ -294,9 +1592,23 @@ func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			codecReq.WriteError(w, 400, err)
 			return
 		}
+	} else if rsrv.handler != nil {
+		handler = rsrv.handler
 	} else {
 		// if there wasn't an error then we found an appropriate remote
-		handler = externalHandler
+		handler = g.externalHandler()
+	}
+
+	// methods given in some other form than what backends expect, see
+	// MethodParser
+	if canon := rsrv.Name + "." + rpcMethod.Name; found && m != canon {
+		kv["canonicalMethod"] = canon
+		newMethod, m = canon, canon
+	}
+
+	if rsrv.backendName != "" {
+		newMethod = rsrv.backendName + "." + rpcMethod.Name
+		kv["backendMethod"] = newMethod
 	}
 
 	req := &Request{
@@ -305,16 +1617,89 @@ func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		RemoteMethod: rpcMethod,
 		respWriter:   w,
 		codecReq:     codecReq,
+		newMethod:    newMethod,
+		clientIP:     g.clientIP(r),
+	}
+	// the fields of custom envelopes aren't part of the rpc request
+	if _, ok := codec.(*envelopeCodec); !ok {
+		req.extra = envelopeExtras(rawBody)
+	}
+	req.clientCodec, _ = codec.(ClientCodec)
+	if err := rsrv.checkContentType(r); err != nil {
+		kv["err"] = err
+		llog.Error("backend doesn't accept request's codec", kv)
+		codecReq.WriteError(w, 500, err)
+		return
 	}
-	// resolve the url so we can forward it, if this is a remote request
+
+	// resolve the url so we can forward it, if this is a remote request. The
+	// unresolved url is kept so that retries and hedges can resolve it again
+	var unresolved *url.URL
 	if rsrv.URL != nil {
-		r.URL = g.resolveURL(rsrv.URL)
+		backend, err := g.backendURL(rsrv, r)
+		if err != nil {
+			kv["err"] = err
+			llog.Warn("no backend available for request", kv)
+			if err == errBackendDrained {
+				writeStatusError(w, codecReq, 503, err)
+			} else {
+				codecReq.WriteError(w, 400, err)
+			}
+			return
+		}
+		unresolved = backend
+		if r.URL, err = g.resolveURL(backend); err != nil {
+			if g.OnResolveError != nil {
+				g.OnResolveError(rsrv.Name, err)
+			}
+			kv["err"] = err
+			llog.Error("error resolving backend url", kv)
+			codecReq.WriteError(w, 500, errResolve)
+			return
+		}
+		kv["target"] = r.URL.Host
 	} else {
-		// this must be a request going to BackupHandler
+		// this must be a request going to BackupHandler, or to an in-process
+		// handler
 		r.URL = nil
 	}
 	r.RequestURI = ""
 
+	if found {
+		if err := req.handleMissingParams(g.MissingParams); err != nil {
+			kv["err"] = err
+			llog.Warn("error handling missing params", kv)
+			codecReq.WriteError(w, 400, err)
+			return
+		}
+		if g.CoerceScalars {
+			if err := req.coerceScalars(); err != nil {
+				kv["err"] = err
+				llog.Warn("error coercing params", kv)
+				codecReq.WriteError(w, 400, err)
+				return
+			}
+		}
+		if g.ValidateArgs {
+			if err := req.validateArgs(g.AllowExtraFields); err != nil {
+				kv["err"] = err
+				llog.Warn("invalid params sent", kv)
+				codecReq.WriteError(w, 400, err)
+				return
+			}
+		}
+	}
+
+	origNewMethod := req.newMethod
+	if err := g.runMiddlewares(m, req); err != nil {
+		if !req.responded {
+			kv["err"] = err
+			llog.Debug("middleware returned error", kv)
+			req.WriteError(400, err)
+		}
+		return
+	}
+
 	if g.RequestCallback != nil {
 		g.RequestCallback(req)
 	}
@@ -325,6 +1710,10 @@ func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if g.CallGraphHook != nil && req.newMethod != origNewMethod {
+		g.CallGraphHook(m, req.newMethod)
+	}
+
 	// make a new request to send to the backend since the request
 	// might've been changed
 	// also when we called codec.NewRequest earlier that read r.Body
@@ -336,29 +1725,440 @@ func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		codecReq.WriteError(w, 500, err)
 		return
 	}
-	r.Body = ioutil.NopCloser(bytes.NewBuffer(b))
-	// since we overwrote the body, we need to update Content-Length
+	// since we overwrite the body, we need to update Content-Length
 	r.ContentLength = int64(len(b))
-	rec := httptest.NewRecorder()
+
+	if large, ok := g.sizeRouteURL(m, len(b)); ok && r.URL != nil {
+		kv["bodySize"] = len(b)
+		unresolved = large
+		if r.URL, err = g.resolveURL(large); err != nil {
+			if g.OnResolveError != nil {
+				g.OnResolveError(rsrv.Name, err)
+			}
+			kv["err"] = err
+			llog.Error("error resolving large request backend url", kv)
+			codecReq.WriteError(w, 500, errResolve)
+			return
+		}
+		kv["target"] = r.URL.Host
+	}
+
+	if g.DryRun {
+		var backend string
+		if r.URL != nil {
+			backend = r.URL.String()
+		}
+		kv["backend"] = backend
+		kv["paramsSize"] = len(req.args)
+		llog.Info("dry run, not forwarding request", kv)
+		if g.DryRunHook != nil {
+			g.DryRunHook(m, backend, len(req.args))
+		}
+		codecReq.WriteResponse(w, &struct{}{})
+		return
+	}
+
+	if r.URL != nil {
+		g.filterForwardHeaders(r)
+	}
 
 	// remove all accepted encoding's since we want plain-text
 	proxyutil.FilterEncodings(r)
+	// the http client will ask for a gzip'd response and transparently
+	// decompress it, unless an encoding is set. There's no point in doing that
+	// for backends which never compress
+	remote := r.URL != nil
+	if remote && !g.compression.supported(r.URL.Host) {
+		r.Header.Set("Accept-Encoding", "identity")
+	}
+
+	// the breaker is only tracked for requests actually sent to the backend
+	breaker := remote
+	if remote && !g.breakers.allow(rsrv.Name, g.BreakerThreshold) {
+		if g.BackupHandler == nil {
+			llog.Warn("circuit breaker open, rejecting request", kv)
+			writeStatusError(w, codecReq, 503, errBreakerOpen)
+			return
+		}
+		llog.Warn("circuit breaker open, using backup handler", kv)
+		handler, remote, breaker, r.URL = g.BackupHandler, false, false, nil
+	}
+
+	timeout := g.forwardTimeout(r)
+	if timeout > 0 {
+		kv["timeout"] = timeout.String()
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+	if fn := g.getStreamTransformer(m); fn != nil && remote {
+		r = r.WithContext(withStreamTransformer(r.Context(), fn))
+	}
 
 	// since we wrote a new client request, we need to buffer the response
 	// and rewrite it using our original codec request
-	handler.ServeHTTP(rec, r)
+	ev := RoutingEvent{Method: m, Service: rsrv.Name}
+	if g.MetricsLabeler != nil {
+		ev.Labels = g.MetricsLabeler(req)
+	}
+	defer func() {
+		logForwarded(kv)
+		g.emitEvent(ev)
+		g.recordSlowRequest(ev)
+		if rpcMethod.Auditable {
+			g.audit(req, ev)
+		}
+	}()
+
+	start := time.Now()
+	idempotent := found && (rpcMethod.Idempotent || g.isIdempotent(m))
+	// fanned out responses are merged into a JSON RPC 2.0 response, regardless
+	// of the format of the individual responses
+	fo, fanOut := g.getFanOut(m)
+	fanOut = fanOut && remote
+	decode := req.decodeClientResponse
+	if fanOut {
+		decode = json2.DecodeClientResponse
+	}
+
+	if rpcMethod.Deprecated != "" {
+		w.Header().Set("Warning", "299 - "+strconv.Quote("Deprecated: "+rpcMethod.Deprecated))
+	}
+
+	if g.canPassthrough(req, codec, remote, fanOut, idempotent) {
+		// the backend's response is passed back as-is, so the forwarded request
+		// must have the client's id
+		if id := rpcID(rawBody); id != nil {
+			if b2, err := withRPCID(b, id); err == nil {
+				b = b2
+				r.ContentLength = int64(len(b))
+				handler = g.newPassthroughHandler(w, start)
+				kv["passthrough"] = true
+			}
+		}
+	}
+	forward := func(r *http.Request, kv llog.KV) *limitedRecorder {
+		if fanOut {
+			return g.forwardFanOut(handler, r, b, kv, fo, req.decodeClientResponse, idempotent)
+		}
+		if remote && g.HedgeAfter > 0 && idempotent {
+			var rec *limitedRecorder
+			rec, r.URL = g.forwardHedged(handler, r, b, kv, unresolved)
+			return rec
+		}
+		return g.forward(handler, r, b, kv, unresolved, idempotent)
+	}
+	// record updates what's tracked about the backend with the result of
+	// forwarding r, which is only done by the caller which actually forwarded
+	// it
+	record := func(r *http.Request, rec *limitedRecorder, kv llog.KV) {
+		if breaker {
+			failed := rec.forwardErr != nil || rec.Code >= 500 || rec.status >= 500 || r.Context().Err() == context.DeadlineExceeded
+			g.breakers.record(rsrv.Name, failed, g.BreakerThreshold, g.BreakerCooldown)
+		}
+		if remote && rec.forwardErr == nil {
+			g.compression.record(r.URL.Host, rec.compressed)
+		}
+		if rec.forwardErr != nil && g.DeadLetter != nil && g.isDeadLetter(m) {
+			llog.Warn("passing failed request to dead letter", kv)
+			g.DeadLetter(m, b)
+		}
+	}
+	if found {
+		g.poolStats.start(rsrv.Name)
+	}
+	var rec *limitedRecorder
+	// set if the forward was made in the background on behalf of every caller
+	// with the same key, in which case it has already been recorded
+	var coalesced bool
+	if g.CoalesceReads && idempotent {
+		key, err := g.key(m, req.args)
+		// responses encoded by a ClientCodec can't be shared with clients
+		// using a different codec
+		if req.clientCodec != nil {
+			key = r.Header.Get("Content-Type") + " " + key
+		}
+		if err != nil {
+			kv["err"] = err
+			llog.Warn("error generating key to coalesce request", kv)
+			delete(kv, "err")
+			rec = forward(r, kv)
+		} else {
+			// the forward mustn't be cut short if this caller goes away, since
+			// others may be sharing it
+			r2, kv2 := r.Clone(detachedContext{r.Context()}), copyKV(kv)
+			var shared bool
+			rec, shared = g.coalescer.do(r.Context(), key, func() *limitedRecorder {
+				if timeout > 0 {
+					ctx, cancel := context.WithTimeout(r2.Context(), timeout)
+					defer cancel()
+					r2 = r2.WithContext(ctx)
+				}
+				rec := forward(r2, kv2)
+				record(r2, rec, kv2)
+				return rec
+			})
+			coalesced = true
+			kv["coalesced"] = shared
+		}
+	} else {
+		rec = forward(r, kv)
+	}
+	if found {
+		g.poolStats.finish(rsrv.Name, rec.retries)
+	}
+	// the request may have ended up somewhere else due to retries or hedging
+	if remote {
+		ev.Backend = r.URL.String()
+		kv["target"] = r.URL.Host
+	}
+	ev.Duration = time.Since(start)
+	ev.Status = rec.Code
+	ev.Err = rec.forwardErr
+
+	// the forward is cancelled along with the client's request, in which case
+	// there's no one to respond to, and the backend isn't at fault
+	if r.Context().Err() == context.Canceled {
+		llog.Debug("client went away while forwarding request", kv)
+		ev.Err = context.Canceled
+		if breaker && !coalesced {
+			g.breakers.release(rsrv.Name, g.BreakerThreshold)
+		}
+		return
+	}
+	if !coalesced {
+		record(r, rec, kv)
+	}
+	// everything has already been sent to the client
+	if rec.streamed {
+		return
+	}
+
+	if g.TimingHeaders {
+		ms := time.Since(start).Nanoseconds() / int64(time.Millisecond)
+		w.Header().Set("X-Gateway-Upstream-Duration-Ms", strconv.FormatInt(ms, 10))
+	}
+
+	if r.Context().Err() == context.DeadlineExceeded {
+		llog.Warn("timed out forwarding request", kv)
+		ev.Err = errTimeout
+		writeStatusError(w, codecReq, 504, errTimeout)
+		return
+	}
+
+	if rec.exceeded {
+		kv["maxResponseBytes"] = g.MaxResponseBytes
+		llog.Error("backend response exceeded max size", kv)
+		ev.Err = errResponseTooLarge
+		codecReq.WriteError(w, 500, errResponseTooLarge)
+		return
+	}
+
+	for _, h := range g.PassResponseHeaders {
+		if vv := rec.Header()[http.CanonicalHeaderKey(h)]; len(vv) > 0 {
+			w.Header()[http.CanonicalHeaderKey(h)] = vv
+		}
+	}
+
+	if g.ResponseTranscoder != nil {
+		if err := g.ResponseTranscoder.TranscodeResponse(w, codecReq, rec.Code, rec.Body); err != nil && ev.Err == nil {
+			ev.Err = err
+		}
+		return
+	}
 
 	// we don't actually care what the response was so just use a RawMessage
 	resRes := &json.RawMessage{}
-	if err = json2.DecodeClientResponse(rec.Body, resRes); err != nil {
+	if err = decode(rec.Body, resRes); err != nil {
+		if jsonErr, ok := err.(*json2.Error); ok && g.ErrorCodeMapper != nil {
+			mapped := *jsonErr
+			mapped.Code = json2.ErrorCode(g.ErrorCodeMapper(rsrv.Name, int(jsonErr.Code)))
+			err = &mapped
+		}
+		if ev.Err == nil {
+			ev.Err = err
+		}
 		codecReq.WriteError(w, rec.Code, err)
 	} else {
+		if rpcMethod.Cacheable > 0 {
+			w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int64(rpcMethod.Cacheable/time.Second)))
+		}
 		codecReq.WriteResponse(w, resRes)
 	}
 }
 
-func writeErrorf(w http.ResponseWriter, status int, msg string, args ...interface{}) {
+// logForwarded logs every request which was forwarded, once it's done. It's a
+// variable so that tests can see what was logged
+var logForwarded = func(kv llog.KV) {
+	llog.Debug("forwarded request", kv)
+}
+
+var errResponseTooLarge = &json2.Error{
+	Code:    json2.E_INTERNAL,
+	Message: "backend response too large",
+}
+
+var errResolve = &json2.Error{
+	Code:    json2.E_INTERNAL,
+	Message: "could not resolve backend",
+}
+
+var errInvalidMethod = &json2.Error{
+	Code:    json2.E_INVALID_REQ,
+	Message: "invalid method",
+}
+
+// maxMethodLength is the longest method name which will be accepted from a
+// client
+const maxMethodLength = 256
+
+// validMethod returns whether the method is short enough and free of control
+// characters, such that it's safe to log and look up
+func validMethod(m string) bool {
+	if len(m) > maxMethodLength {
+		return false
+	}
+	for _, c := range m {
+		if unicode.IsControl(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// sanitizeMethod returns a version of an invalid method which is safe to log
+func sanitizeMethod(m string) string {
+	if len(m) > maxMethodLength {
+		m = m[:maxMethodLength]
+	}
+	return strconv.QuoteToASCII(m)
+}
+
+var errTrailingData = &json2.Error{
+	Code:    json2.E_INVALID_REQ,
+	Message: "unexpected data after request",
+}
+
+// trailingData returns whether there is anything other than whitespace after
+// the first json value in the body, along with the id of that first value.
+// Bodies whose first value can't be decoded are left for the codec to handle
+func trailingData(body []byte) (json.RawMessage, bool) {
+	d := json.NewDecoder(bytes.NewReader(body))
+	var first struct {
+		ID json.RawMessage `json:"id"`
+	}
+	if err := d.Decode(&first); err != nil {
+		return nil, false
+	}
+	if _, err := d.Token(); err == io.EOF {
+		return nil, false
+	}
+	return first.ID, true
+}
+
+var errLegacyProtocol = &json2.Error{
+	Code:    json2.E_INVALID_REQ,
+	Message: "json rpc 1.0 is not supported, upgrade to json rpc 2.0",
+}
+
+// legacyProtocol returns whether the body is a json rpc 1.0 request, i.e. one
+// with a method but no "jsonrpc" member (or one other than "2.0"), along with
+// its id
+func legacyProtocol(body []byte) (json.RawMessage, bool) {
+	var req struct {
+		Version *string         `json:"jsonrpc"`
+		Method  string          `json:"method"`
+		ID      json.RawMessage `json:"id"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil || req.Method == "" {
+		return nil, false
+	}
+	return req.ID, req.Version == nil || *req.Version != "2.0"
+}
+
+var errTimeout = &json2.Error{
+	Code:    json2.E_SERVER,
+	Message: "backend timed out",
+}
+
+// limitedRecorder is an httptest.ResponseRecorder which will refuse to buffer
+// more than max bytes, if max is greater than zero. Once max is exceeded all
+// writes return an error, which will cause any io.Copy into it to abort
+type limitedRecorder struct {
+	*httptest.ResponseRecorder
+	max      int64
+	written  int64
+	exceeded bool
+
+	// set if the request never made it to the backend
+	forwardErr error
+
+	// set if the backend compressed its response
+	compressed bool
+
+	// the status code of the backend's response, which isn't written to the
+	// recorder itself
+	status int
+
+	// the number of times the request was retried, see Gateway.Retries
+	retries int
+
+	// set if the backend's response was streamed straight to the client
+	// rather than into the recorder, see PassthroughLarge
+	streamed bool
+}
+
+func (lr *limitedRecorder) Write(b []byte) (int, error) {
+	if lr.max > 0 && lr.written+int64(len(b)) > lr.max {
+		lr.exceeded = true
+		return 0, errResponseTooLarge
+	}
+	lr.written += int64(len(b))
+	return lr.ResponseRecorder.Write(b)
+}
+
+// peekBody reads the full body of the request and returns it, replacing the
+// body so that it can still be read again later
+func peekBody(r *http.Request) ([]byte, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewBuffer(body))
+	return body, err
+}
+
+// writeStatusError writes the error using the codec, but with the given http
+// status code rather than the codec's default
+func writeStatusError(w http.ResponseWriter, codecReq rpc.CodecRequest, status int, err error) {
+	// the codec will set the Content-Type, but too late since we need to
+	// write the status first
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.WriteHeader(status)
+	codecReq.WriteError(w, status, err)
+}
+
+func writeErrorf(w http.ResponseWriter, status int, msg string, args ...interface{}) {
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
 	fmt.Fprint(w, fmt.Sprintf(msg, args...))
 }
+
+// writeTransportError writes an error for a request which was rejected before
+// it could be decoded, as plain text or as a JSON RPC error with the given code
+// depending on JSONTransportErrors
+func (g *Gateway) writeTransportError(w http.ResponseWriter, status int, code json2.ErrorCode, msg string, args ...interface{}) {
+	if !g.JSONTransportErrors {
+		writeErrorf(w, status, msg, args...)
+		return
+	}
+	b, err := json.Marshal(&errorRes{
+		Version: "2.0",
+		Error:   &json2.Error{Code: code, Message: fmt.Sprintf(msg, args...)},
+	})
+	if err != nil {
+		writeErrorf(w, status, msg, args...)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(b)
+}
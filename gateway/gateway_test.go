@@ -1,14 +1,34 @@
 package gateway
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	. "testing"
+	"time"
 
 	"github.com/gorilla/rpc/v2"
 	"github.com/gorilla/rpc/v2/json2"
 	"github.com/levenlabs/gatewayrpc"
+	"github.com/levenlabs/go-llog"
 	"github.com/levenlabs/golib/rpcutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -30,6 +50,11 @@ func (t TestEndpoint) Foo(r *http.Request, args *FooArgs, res *FooRes) error {
 	return nil
 }
 
+func (t TestEndpoint) Empty(r *http.Request, _ *struct{}, res *struct{ A int }) error {
+	res.A = 1
+	return nil
+}
+
 type BarArgs struct {
 	A int                    `json:"a"`
 	B []int                  `json:"b"`
@@ -41,6 +66,23 @@ func (t TestEndpoint) Bar(r *http.Request, args *BarArgs, _ *struct{}) error {
 	return nil
 }
 
+type SlowEndpoint struct{}
+
+type SleepArgs struct {
+	Ms int `json:"ms"`
+}
+
+// Sleep waits for the given number of milliseconds, or until the request is
+// cancelled
+func (SlowEndpoint) Sleep(r *http.Request, args *SleepArgs, _ *struct{}) error {
+	select {
+	case <-time.After(time.Duration(args.Ms) * time.Millisecond):
+		return nil
+	case <-r.Context().Done():
+		return r.Context().Err()
+	}
+}
+
 type TestEndpoint2 struct{}
 
 func (t2 TestEndpoint2) Wat(r *http.Request, _ *struct{}, res *struct{ A int }) error {
@@ -51,6 +93,19 @@ func (t2 TestEndpoint2) Wat(r *http.Request, _ *struct{}, res *struct{ A int })
 func init() {
 	h := gatewayrpc.NewServer()
 	h.RegisterService(TestEndpoint{}, "")
+	if err := h.SetCacheable("TestEndpoint", "Foo", time.Minute); err != nil {
+		panic(err)
+	}
+	if err := h.SetDeprecated("TestEndpoint", "Empty", "use Foo instead"); err != nil {
+		panic(err)
+	}
+	if err := h.SetIdempotent("TestEndpoint", "Foo"); err != nil {
+		panic(err)
+	}
+	if err := h.MarkAuditable("TestEndpoint", "Bar"); err != nil {
+		panic(err)
+	}
+	h.RegisterService(SlowEndpoint{}, "")
 	h.RegisterCodec(json2.NewCodec(), "application/json")
 	s := httptest.NewServer(h)
 	testURL = s.URL
@@ -61,6 +116,8 @@ func init() {
 		panic(err)
 	}
 
+	testGateway.AliasMethod("TestEndpoint.OldFoo", "TestEndpoint.Foo")
+
 	testGateway.RequestCallback = func(r *Request) {
 		if m, _ := r.Method(); m != "TestEndpoint.Bar" {
 			return
@@ -127,3 +184,3050 @@ func TestBackupHandler(t *T) {
 	require.Nil(t, rpcutil.JSONRPC2CallHandler(testGateway, &res, "TestEndpoint2.Wat", &struct{}{}))
 	assert.Equal(t, 5, res.A)
 }
+
+func newRawRequest(t *T, method string, args interface{}) *http.Request {
+	b, err := json2.EncodeClientRequest(method, args)
+	require.Nil(t, err)
+	return newBodyRequest(t, string(b))
+}
+
+func newBodyRequest(t *T, body string) *http.Request {
+	r, err := http.NewRequest("POST", "/", bytes.NewBufferString(body))
+	require.Nil(t, err)
+	r.Header.Set("Content-Type", "application/json")
+	return r
+}
+
+// callRaw performs the given rpc call against the given handler and returns the
+// recorder so the raw response can be inspected
+func callRaw(t *T, h http.Handler, method string, args interface{}) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, newRawRequest(t, method, args))
+	return rec
+}
+
+func TestCacheable(t *T) {
+	rec := callRaw(t, testGateway, "TestEndpoint.Foo", &FooArgs{})
+	assert.Equal(t, 200, rec.Code)
+	assert.Equal(t, "max-age=60", rec.Header().Get("Cache-Control"))
+
+	rec = callRaw(t, testGateway, "TestEndpoint.Bar", &BarArgs{})
+	assert.Equal(t, 200, rec.Code)
+	assert.Equal(t, "", rec.Header().Get("Cache-Control"))
+}
+
+// newTestGateway returns a Gateway, separate from testGateway, which forwards
+// to the test backend and can have its options changed freely
+func newTestGateway(t *T) *Gateway {
+	return newURLGateway(t, testURL)
+}
+
+// newURLGateway returns a new gateway using the json2 codec, which has added
+// the given url
+func newURLGateway(t *T, u string) *Gateway {
+	g := NewGateway()
+	g.RegisterCodec(json2.NewCodec(), "application/json")
+	require.Nil(t, g.AddURL(u))
+	return g
+}
+
+// newBackendHandler returns an rpc server with the given services registered
+// under their own names, using the json2 codec
+func newBackendHandler(t *T, services ...interface{}) *gatewayrpc.Server {
+	h := gatewayrpc.NewServer()
+	for _, srv := range services {
+		require.Nil(t, h.RegisterService(srv, ""))
+	}
+	h.RegisterCodec(json2.NewCodec(), "application/json")
+	return h
+}
+
+// newBackendGateway starts a backend serving the given services, see
+// newBackendHandler, and returns a new gateway which has added it along with
+// the backend, which must be closed once the test is done
+func newBackendGateway(t *T, services ...interface{}) (*Gateway, *httptest.Server) {
+	s := httptest.NewServer(newBackendHandler(t, services...))
+	return newURLGateway(t, s.URL), s
+}
+
+func TestMaxResponseBytes(t *T) {
+	g := newTestGateway(t)
+	g.MaxResponseBytes = 10
+
+	var res FooRes
+	err := rpcutil.JSONRPC2CallHandler(g, &res, "TestEndpoint.Foo", &FooArgs{A: 1, B: "one"})
+	require.NotNil(t, err)
+	assert.Equal(t, errResponseTooLarge.Message, err.Error())
+
+	g.MaxResponseBytes = 1 << 20
+	require.Nil(t, rpcutil.JSONRPC2CallHandler(g, &res, "TestEndpoint.Foo", &FooArgs{A: 1, B: "one"}))
+	assert.Equal(t, "one", res.B)
+}
+
+func TestServeHTTPContext(t *T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+
+	r := newRawRequest(t, "SlowEndpoint.Sleep", &SleepArgs{Ms: 5000})
+
+	start := time.Now()
+	rec := httptest.NewRecorder()
+	testGateway.ServeHTTPContext(ctx, rec, r)
+	assert.True(t, time.Since(start) < time.Second)
+
+	var res struct{}
+	assert.NotNil(t, json2.DecodeClientResponse(rec.Body, &res))
+}
+
+func TestAliasMethod(t *T) {
+	args := FooArgs{
+		A: 2,
+		B: "two",
+	}
+	var res FooRes
+	require.Nil(t, rpcutil.JSONRPC2CallHandler(testGateway, &res, "TestEndpoint.OldFoo", &args))
+	assert.Equal(t, args, res.FooArgs)
+}
+
+func TestMethodParser(t *T) {
+	g := newTestGateway(t)
+	g.MethodParser = func(raw string) (string, string, error) {
+		parts := strings.SplitN(raw, "/", 2)
+		if len(parts) != 2 {
+			return "", "", errors.New("invalid method endpoint given")
+		}
+		return parts[0], parts[1], nil
+	}
+
+	args := FooArgs{A: 3, B: "three"}
+	var res FooRes
+	require.Nil(t, rpcutil.JSONRPC2CallHandler(g, &res, "TestEndpoint/Foo", &args))
+	assert.Equal(t, args, res.FooArgs)
+
+	// the default format no longer routes
+	rec := callRaw(t, g, "TestEndpoint.Foo", &args)
+	assert.NotNil(t, json2.DecodeClientResponse(rec.Body, &res))
+
+	g.SetServiceMaintenance("TestEndpoint", true, "back soon")
+	rec = callRaw(t, g, "TestEndpoint/Foo", &args)
+	assert.Equal(t, 503, rec.Code)
+}
+
+func TestRequestTimeoutHeader(t *T) {
+	g := newTestGateway(t)
+	g.MaxRequestTimeout = 5 * time.Second
+
+	r := newRawRequest(t, "SlowEndpoint.Sleep", &SleepArgs{Ms: 5000})
+	r.Header.Set("X-Request-Timeout-Ms", "50")
+	start := time.Now()
+	rec := httptest.NewRecorder()
+	g.ServeHTTP(rec, r)
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Equal(t, 504, rec.Code)
+
+	// invalid and out of range values are ignored, so ForwardTimeout still
+	// applies
+	g.ForwardTimeout = 50 * time.Millisecond
+	for _, h := range []string{"foo", "-1", "10000"} {
+		r = newRawRequest(t, "SlowEndpoint.Sleep", &SleepArgs{Ms: 500})
+		r.Header.Set("X-Request-Timeout-Ms", h)
+		start = time.Now()
+		rec = httptest.NewRecorder()
+		g.ServeHTTP(rec, r)
+		assert.True(t, time.Since(start) < 400*time.Millisecond, "header: %q", h)
+		assert.Equal(t, 504, rec.Code, "header: %q", h)
+	}
+}
+
+func TestBatchLimits(t *T) {
+	g := newTestGateway(t)
+	g.MaxBatchSize = 3
+	g.BatchConcurrency = 1
+	call := func(n int) ([]json.RawMessage, time.Duration) {
+		reqs := make([]map[string]interface{}, n)
+		for i := range reqs {
+			reqs[i] = map[string]interface{}{
+				"jsonrpc": "2.0",
+				"method":  "SlowEndpoint.Sleep",
+				"params":  map[string]int{"ms": 30},
+				"id":      i,
+			}
+		}
+		body, err := json.Marshal(reqs)
+		require.Nil(t, err)
+		r, err := http.NewRequest("POST", "/", bytes.NewBuffer(body))
+		require.Nil(t, err)
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		start := time.Now()
+		g.ServeHTTP(w, r)
+		took := time.Since(start)
+
+		var ress []json.RawMessage
+		if json.Unmarshal(w.Body.Bytes(), &ress) != nil {
+			var res struct {
+				Error *json2.Error `json:"error"`
+			}
+			require.Nil(t, json.Unmarshal(w.Body.Bytes(), &res))
+			require.NotNil(t, res.Error)
+			return nil, took
+		}
+		return ress, took
+	}
+
+	// the requests are handled one at a time
+	ress, took := call(3)
+	assert.Len(t, ress, 3)
+	assert.True(t, took >= 90*time.Millisecond, "took: %s", took)
+
+	ress, _ = call(4)
+	assert.Nil(t, ress)
+
+	// the forward timeout applies to the whole batch, and requests which
+	// didn't finish by then time out
+	g.ForwardTimeout = 50 * time.Millisecond
+	ress, took = call(3)
+	assert.True(t, took < 90*time.Millisecond, "took: %s", took)
+	require.Len(t, ress, 3)
+	for i, raw := range ress {
+		var res struct {
+			Error *json2.Error `json:"error"`
+			ID    int          `json:"id"`
+		}
+		require.Nil(t, json.Unmarshal(raw, &res))
+		assert.Equal(t, i, res.ID)
+		if i == 0 {
+			assert.Nil(t, res.Error)
+		} else {
+			require.NotNil(t, res.Error, "request %d", i)
+			assert.Equal(t, errTimeout.Message, res.Error.Message)
+		}
+	}
+}
+
+func TestForwardTimeout(t *T) {
+	g := newTestGateway(t)
+	g.ForwardTimeout = 100 * time.Millisecond
+
+	r := newRawRequest(t, "SlowEndpoint.Sleep", &SleepArgs{Ms: 5000})
+	start := time.Now()
+	rec := httptest.NewRecorder()
+	g.ServeHTTP(rec, r)
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Equal(t, 504, rec.Code)
+	err := json2.DecodeClientResponse(rec.Body, &struct{}{})
+	require.NotNil(t, err)
+	assert.Equal(t, errTimeout.Message, err.Error())
+
+	// time spent before forwarding doesn't count
+	g.RequestCallback = func(*Request) {
+		time.Sleep(150 * time.Millisecond)
+	}
+	rec = callRaw(t, g, "SlowEndpoint.Sleep", &SleepArgs{Ms: 10})
+	assert.Equal(t, 200, rec.Code)
+	assert.Nil(t, json2.DecodeClientResponse(rec.Body, &struct{}{}))
+}
+
+func TestBatchPartialResults(t *T) {
+	g := newTestGateway(t)
+	g.ForwardTimeout = 100 * time.Millisecond
+
+	fooB, err := json2.EncodeClientRequest("TestEndpoint.Foo", &FooArgs{A: 1, B: "one"})
+	require.Nil(t, err)
+	sleepB, err := json2.EncodeClientRequest("SlowEndpoint.Sleep", &SleepArgs{Ms: 5000})
+	require.Nil(t, err)
+	var fooReq, sleepReq struct {
+		ID uint64 `json:"id"`
+	}
+	require.Nil(t, json.Unmarshal(fooB, &fooReq))
+	require.Nil(t, json.Unmarshal(sleepB, &sleepReq))
+
+	body, err := json.Marshal([]json.RawMessage{fooB, sleepB})
+	require.Nil(t, err)
+	r, err := http.NewRequest("POST", "/", bytes.NewBuffer(body))
+	require.Nil(t, err)
+	r.Header.Set("Content-Type", "application/json")
+
+	start := time.Now()
+	rec := httptest.NewRecorder()
+	g.ServeHTTP(rec, r)
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Equal(t, 200, rec.Code)
+
+	var ress []struct {
+		ID     uint64          `json:"id"`
+		Result json.RawMessage `json:"result"`
+		Error  *json2.Error    `json:"error"`
+	}
+	require.Nil(t, json.Unmarshal(rec.Body.Bytes(), &ress))
+	require.Len(t, ress, 2)
+	for _, res := range ress {
+		switch res.ID {
+		case fooReq.ID:
+			assert.Nil(t, res.Error)
+			assert.JSONEq(t, `{"args":{"a":1,"b":"one"}}`, string(res.Result))
+		case sleepReq.ID:
+			require.NotNil(t, res.Error)
+			assert.Equal(t, errTimeout.Message, res.Error.Message)
+		default:
+			t.Fatalf("unexpected id: %d", res.ID)
+		}
+	}
+}
+
+func TestMissingParams(t *T) {
+	g := newTestGateway(t)
+	call := func(method string, res interface{}) error {
+		r := newBodyRequest(t, `{"jsonrpc":"2.0","method":"`+method+`","id":1}`)
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, r)
+		return json2.DecodeClientResponse(rec.Body, res)
+	}
+
+	for _, b := range []MissingParamsBehavior{MissingParamsInject, MissingParamsError} {
+		g.MissingParams = b
+
+		// methods without args never need params
+		var emptyRes struct{ A int }
+		require.Nil(t, call("TestEndpoint.Empty", &emptyRes))
+		assert.Equal(t, 1, emptyRes.A)
+
+		var fooRes FooRes
+		err := call("TestEndpoint.Foo", &fooRes)
+		if b == MissingParamsInject {
+			require.Nil(t, err)
+			assert.Equal(t, FooArgs{}, fooRes.FooArgs)
+		} else {
+			require.NotNil(t, err)
+			assert.Equal(t, errMissingParams.Message, err.Error())
+		}
+	}
+}
+
+func TestTimingHeaders(t *T) {
+	g := newTestGateway(t)
+	rec := callRaw(t, g, "SlowEndpoint.Sleep", &SleepArgs{Ms: 20})
+	assert.Equal(t, "", rec.Header().Get("X-Gateway-Upstream-Duration-Ms"))
+
+	g.TimingHeaders = true
+	rec = callRaw(t, g, "SlowEndpoint.Sleep", &SleepArgs{Ms: 20})
+	ms, err := strconv.ParseInt(rec.Header().Get("X-Gateway-Upstream-Duration-Ms"), 10, 64)
+	require.Nil(t, err)
+	assert.True(t, ms >= 20)
+}
+
+func TestEnvelope(t *T) {
+	g := newTestGateway(t)
+	g.EnvelopeDecoder = func(b []byte) (string, json.RawMessage, error) {
+		var env struct {
+			Action string          `json:"action"`
+			Data   json.RawMessage `json:"data"`
+		}
+		if err := json.Unmarshal(b, &env); err != nil {
+			return "", nil, err
+		} else if env.Action == "" {
+			return "", nil, errors.New("not an envelope")
+		}
+		return env.Action, env.Data, nil
+	}
+	g.EnvelopeEncoder = func(res json.RawMessage, err error) ([]byte, error) {
+		env := map[string]interface{}{"ok": err == nil, "data": res}
+		return json.Marshal(env)
+	}
+
+	rec := httptest.NewRecorder()
+	g.ServeHTTP(rec, newBodyRequest(t, `{"action":"TestEndpoint.Foo","data":{"a":1,"b":"one"}}`))
+	assert.JSONEq(t, `{"ok":true,"data":{"args":{"a":1,"b":"one"}}}`, rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	g.ServeHTTP(rec, newBodyRequest(t, `{"action":"TestEndpoint.Nope"}`))
+	assert.JSONEq(t, `{"ok":false,"data":null}`, rec.Body.String())
+
+	// normal requests still work
+	var res FooRes
+	require.Nil(t, rpcutil.JSONRPC2CallHandler(g, &res, "TestEndpoint.Foo", &FooArgs{A: 1, B: "one"}))
+	assert.Equal(t, "one", res.B)
+}
+
+func TestAddHandler(t *T) {
+	h := newBackendHandler(t, TestEndpoint{})
+
+	g := NewGateway()
+	g.RegisterCodec(json2.NewCodec(), "application/json")
+	require.Nil(t, g.AddHandler(h, "First"))
+	require.Nil(t, g.AddHandler(h, "Second"))
+
+	args := FooArgs{A: 1, B: "one"}
+	for _, srv := range []string{"First", "Second"} {
+		var res FooRes
+		require.Nil(t, rpcutil.JSONRPC2CallHandler(g, &res, srv+".Foo", &args))
+		assert.Equal(t, args, res.FooArgs)
+	}
+
+	// the original name wasn't added
+	var res FooRes
+	assert.NotNil(t, rpcutil.JSONRPC2CallHandler(g, &res, "TestEndpoint.Foo", &args))
+
+	// a handler with multiple services can't be renamed
+	require.Nil(t, h.RegisterService(SlowEndpoint{}, ""))
+	assert.NotNil(t, g.AddHandler(h, "Third"))
+}
+
+func TestResolveError(t *T) {
+	g := newTestGateway(t)
+	resolveErr := errors.New("no such host")
+	g.Resolver = func(string) (string, error) {
+		return "", resolveErr
+	}
+	var gotService string
+	var gotErr error
+	g.OnResolveError = func(service string, err error) {
+		gotService, gotErr = service, err
+	}
+
+	var res FooRes
+	err := rpcutil.JSONRPC2CallHandler(g, &res, "TestEndpoint.Foo", &FooArgs{})
+	require.NotNil(t, err)
+	assert.Equal(t, errResolve.Message, err.Error())
+	assert.Equal(t, "TestEndpoint", gotService)
+	assert.Equal(t, resolveErr, gotErr)
+
+	_, err = g.GetMethodURL("TestEndpoint.Foo")
+	assert.Equal(t, resolveErr, err)
+}
+
+// newRefusingListener returns a listener which immediately closes every
+// connection made to it, sending the time of each connection on the returned
+// channel
+func newRefusingListener(t *T) (net.Listener, chan time.Time) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	ch := make(chan time.Time, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			ch <- time.Now()
+			conn.Close()
+		}
+	}()
+	return ln, ch
+}
+
+func TestRetryBackoff(t *T) {
+	ln, ch := newRefusingListener(t)
+	defer ln.Close()
+
+	g := newTestGateway(t)
+	g.Resolver = func(string) (string, error) {
+		return ln.Addr().String(), nil
+	}
+	g.Retries = 2
+	g.Backoff = func(attempt int) time.Duration {
+		return time.Duration(attempt) * 50 * time.Millisecond
+	}
+
+	var res FooRes
+	assert.NotNil(t, rpcutil.JSONRPC2CallHandler(g, &res, "TestEndpoint.Foo", &FooArgs{}))
+	require.Len(t, ch, 3)
+	first, second, third := <-ch, <-ch, <-ch
+	assert.True(t, second.Sub(first) >= 50*time.Millisecond)
+	assert.True(t, third.Sub(second) >= 100*time.Millisecond)
+
+	// retries don't go past the forward's deadline
+	g.Retries = 5
+	g.Backoff = func(int) time.Duration { return time.Second }
+	g.ForwardTimeout = 100 * time.Millisecond
+	start := time.Now()
+	assert.NotNil(t, rpcutil.JSONRPC2CallHandler(g, &res, "TestEndpoint.Foo", &FooArgs{}))
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Len(t, ch, 1)
+}
+
+func TestRetryResolves(t *T) {
+	ln, ch := newRefusingListener(t)
+	defer ln.Close()
+
+	g := newTestGateway(t)
+	var resolves int
+	g.Resolver = func(host string) (string, error) {
+		resolves++
+		if resolves == 1 {
+			return ln.Addr().String(), nil
+		}
+		return host, nil
+	}
+	g.Retries = 1
+	g.Backoff = func(int) time.Duration { return 0 }
+
+	args := FooArgs{A: 1, B: "one"}
+	var res FooRes
+	require.Nil(t, rpcutil.JSONRPC2CallHandler(g, &res, "TestEndpoint.Foo", &args))
+	assert.Equal(t, args, res.FooArgs)
+	assert.Equal(t, 2, resolves)
+	assert.Len(t, ch, 1)
+}
+
+func TestRetryNotIdempotent(t *T) {
+	ln, ch := newRefusingListener(t)
+	defer ln.Close()
+
+	// nothing listens on closed, so connections to it are refused
+	closedLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	closed := closedLn.Addr().String()
+	closedLn.Close()
+
+	g := newTestGateway(t)
+	addr := ln.Addr().String()
+	var resolves int
+	g.Resolver = func(string) (string, error) {
+		resolves++
+		return addr, nil
+	}
+	g.Retries = 2
+	g.Backoff = func(int) time.Duration { return 0 }
+
+	// Bar may have reached the backend, so it isn't retried
+	assert.NotNil(t, rpcutil.JSONRPC2CallHandler(g, nil, "TestEndpoint.Bar", &BarArgs{}))
+	assert.Equal(t, 1, resolves)
+	assert.Len(t, ch, 1)
+
+	// but it is if the connection was refused
+	resolves = 0
+	addr = closed
+	assert.NotNil(t, rpcutil.JSONRPC2CallHandler(g, nil, "TestEndpoint.Bar", &BarArgs{}))
+	assert.Equal(t, 3, resolves)
+}
+
+func TestMaintenance(t *T) {
+	g := newTestGateway(t)
+	args := FooArgs{A: 1, B: "one"}
+	assertMaintenance := func(method, msg string) {
+		rec := callRaw(t, g, method, &args)
+		var res FooRes
+		err := json2.DecodeClientResponse(rec.Body, &res)
+		if msg == "" {
+			assert.Equal(t, 200, rec.Code)
+			assert.Nil(t, err)
+		} else {
+			assert.Equal(t, 503, rec.Code)
+			require.NotNil(t, err)
+			assert.Equal(t, msg, err.Error())
+		}
+	}
+
+	g.SetMaintenance(true, "back soon")
+	assertMaintenance("TestEndpoint.Foo", "back soon")
+	g.SetMaintenance(false, "")
+	assertMaintenance("TestEndpoint.Foo", "")
+
+	g.SetServiceMaintenance("TestEndpoint", true, "")
+	assertMaintenance("TestEndpoint.Foo", "down for maintenance")
+	assertMaintenance("SlowEndpoint.Sleep", "")
+	g.SetServiceMaintenance("TestEndpoint", false, "")
+	assertMaintenance("TestEndpoint.Foo", "")
+}
+
+func TestClientIP(t *T) {
+	g := NewGateway()
+	var err error
+	g.TrustedProxies, err = ParseCIDRs("10.0.0.0/8")
+	require.Nil(t, err)
+
+	newReq := func(remote, xff string) *http.Request {
+		r, err := http.NewRequest("POST", "/", nil)
+		require.Nil(t, err)
+		r.RemoteAddr = remote + ":1234"
+		if xff != "" {
+			r.Header.Set("X-Forwarded-For", xff)
+		}
+		return r
+	}
+
+	// without a RealIPHeader nothing is trusted
+	assert.Equal(t, "10.0.0.1", g.clientIP(newReq("10.0.0.1", "1.1.1.1")))
+
+	g.RealIPHeader = "X-Forwarded-For"
+	assert.Equal(t, "1.1.1.1", g.clientIP(newReq("10.0.0.1", "1.1.1.1")))
+	assert.Equal(t, "1.1.1.1", g.clientIP(newReq("10.0.0.1", "6.6.6.6, 1.1.1.1, 10.0.0.2")))
+	assert.Equal(t, "10.0.0.1", g.clientIP(newReq("10.0.0.1", "")))
+
+	// spoofed from an untrusted source
+	r := newReq("2.2.2.2", "1.1.1.1")
+	assert.Equal(t, "2.2.2.2", g.clientIP(r))
+	g.setForwardedHeaders(r, "2.2.2.2")
+	assert.Equal(t, "2.2.2.2", r.Header.Get("X-Forwarded-For"))
+
+	r = newReq("10.0.0.1", "1.1.1.1")
+	g.setForwardedHeaders(r, "1.1.1.1")
+	assert.Equal(t, "1.1.1.1, 10.0.0.1", r.Header.Get("X-Forwarded-For"))
+
+	g.RealIPHeader = "X-Real-IP"
+	r = newReq("2.2.2.2", "")
+	r.Header.Set("X-Real-IP", "1.1.1.1")
+	assert.Equal(t, "2.2.2.2", g.clientIP(r))
+	g.setForwardedHeaders(r, "2.2.2.2")
+	assert.Equal(t, "2.2.2.2", r.Header.Get("X-Real-IP"))
+
+	r = newReq("10.0.0.1", "")
+	r.Header.Set("X-Real-IP", "1.1.1.1")
+	assert.Equal(t, "1.1.1.1", g.clientIP(r))
+}
+
+func TestExternalHandlerContentType(t *T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// prevent the content-type from being sniffed
+		w.Header()["Content-Type"] = nil
+		w.Write([]byte(`{"result":{}}`))
+	}))
+	defer s.Close()
+
+	for ct, expected := range map[string]string{
+		"application/json-rpc": "application/json-rpc",
+		"":                     defaultContentType,
+	} {
+		r, err := http.NewRequest("POST", s.URL, bytes.NewBufferString("{}"))
+		require.Nil(t, err)
+		if ct != "" {
+			r.Header.Set("Content-Type", ct)
+		}
+		rec := httptest.NewRecorder()
+		externalHandler.ServeHTTP(rec, r)
+		assert.Equal(t, expected, rec.Header().Get("Content-Type"))
+		assert.Equal(t, `{"result":{}}`, rec.Body.String())
+	}
+}
+
+func TestMethodMiddleware(t *T) {
+	g := newTestGateway(t)
+	var calls []string
+	require.Nil(t, g.AddMethodMiddleware("TestEndpoint.*", func(r *Request) error {
+		calls = append(calls, "first")
+		args := FooArgs{}
+		if err := r.ReadRequest(&args); err != nil {
+			return err
+		}
+		if args.A < 0 {
+			return errors.New("a must be positive")
+		}
+		return nil
+	}))
+	require.Nil(t, g.AddMethodMiddleware("TestEndpoint.Foo", func(r *Request) error {
+		calls = append(calls, "second")
+		args := FooArgs{}
+		if err := r.ReadRequest(&args); err != nil {
+			return err
+		}
+		args.B = strings.ToUpper(args.B)
+		return r.UpdateRequest("", &args)
+	}))
+	require.Nil(t, g.AddMethodMiddleware("SlowEndpoint.*", func(r *Request) error {
+		calls = append(calls, "never")
+		return nil
+	}))
+	assert.NotNil(t, g.AddMethodMiddleware("[", nil))
+
+	var res FooRes
+	require.Nil(t, rpcutil.JSONRPC2CallHandler(g, &res, "TestEndpoint.Foo", &FooArgs{A: 1, B: "one"}))
+	assert.Equal(t, "ONE", res.B)
+	assert.Equal(t, []string{"first", "second"}, calls)
+
+	calls = nil
+	err := rpcutil.JSONRPC2CallHandler(g, &res, "TestEndpoint.Foo", &FooArgs{A: -1, B: "one"})
+	require.NotNil(t, err)
+	assert.Equal(t, "a must be positive", err.Error())
+	assert.Equal(t, []string{"first"}, calls)
+}
+
+// upperB is a stream transformer which uppercases the value of every "b" field
+// as it's copied, without decoding the whole body. It doesn't handle escaped
+// quotes, which is fine for tests
+func upperB(r io.Reader, w io.Writer) error {
+	br := bufio.NewReader(r)
+	// the body alternates between being outside and inside of strings at
+	// every quote
+	var inString, upper bool
+	var lastString, sinceString string
+	for {
+		chunk, err := br.ReadString('"')
+		if inString && upper {
+			chunk = strings.ToUpper(chunk)
+		}
+		if _, werr := io.WriteString(w, chunk); werr != nil {
+			return werr
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if inString {
+			lastString = strings.TrimSuffix(chunk, `"`)
+		} else {
+			sinceString = strings.TrimSpace(strings.TrimSuffix(chunk, `"`))
+			upper = lastString == "b" && sinceString == ":"
+		}
+		inString = !inString
+	}
+}
+
+func TestStreamTransformer(t *T) {
+	g := newTestGateway(t)
+	require.Nil(t, g.AddStreamTransformer("TestEndpoint.Foo", upperB))
+	assert.NotNil(t, g.AddStreamTransformer("[", upperB))
+
+	var res FooRes
+	require.Nil(t, rpcutil.JSONRPC2CallHandler(g, &res, "TestEndpoint.Foo", &FooArgs{A: 1, B: "one"}))
+	assert.Equal(t, FooArgs{A: 1, B: "ONE"}, res.FooArgs)
+
+	// other methods are left alone
+	var res2 struct{ A int }
+	require.Nil(t, rpcutil.JSONRPC2CallHandler(g, &res2, "TestEndpoint.Empty", &struct{}{}))
+}
+
+func TestRejectCollisions(t *T) {
+	h := newBackendHandler(t, TestEndpoint{})
+	s := httptest.NewServer(h)
+	defer s.Close()
+
+	g := newTestGateway(t)
+	require.Nil(t, g.AddURL(s.URL))
+
+	g = newTestGateway(t)
+	g.RejectCollisions = true
+	// adding the same url again is fine, it's just a refresh
+	require.Nil(t, g.AddURL(testURL))
+	assert.Equal(t, ErrServiceCollision, g.AddURL(s.URL))
+
+	u, err := g.GetMethodURL("TestEndpoint.Foo")
+	require.Nil(t, err)
+	assert.Equal(t, testURL, u.String())
+}
+
+func TestBackupHandlerBadMethod(t *T) {
+	g := newTestGateway(t)
+	var gotBody string
+	g.BackupHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		require.Nil(t, err)
+		gotBody = string(b)
+		w.Write([]byte("ok"))
+	})
+
+	body := `{"jsonrpc":"2.0","id":1,"method":`
+	rec := httptest.NewRecorder()
+	g.ServeHTTP(rec, newBodyRequest(t, body))
+	assert.Equal(t, body, gotBody)
+	assert.Equal(t, "ok", rec.Body.String())
+}
+
+func TestReadiness(t *T) {
+	g := NewGateway()
+	g.RegisterCodec(json2.NewCodec(), "application/json")
+
+	assertCode := func(h http.Handler, code int) {
+		r, err := http.NewRequest("GET", "/", nil)
+		require.Nil(t, err)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		assert.Equal(t, code, rec.Code)
+	}
+
+	assertCode(g.LivenessHandler(), 200)
+	assertCode(g.ReadinessHandler(), 503)
+
+	// a failed discovery doesn't count
+	ln, _ := newRefusingListener(t)
+	defer ln.Close()
+	assert.NotNil(t, g.AddURL(ln.Addr().String()))
+	assertCode(g.ReadinessHandler(), 503)
+
+	require.Nil(t, g.AddURL(testURL))
+	assertCode(g.LivenessHandler(), 200)
+	assertCode(g.ReadinessHandler(), 200)
+}
+
+func TestBackendCompression(t *T) {
+	for _, compress := range []bool{false, true} {
+		h := gatewayrpc.NewServer()
+		require.Nil(t, h.RegisterService(TestEndpoint{}, ""))
+		if compress {
+			h.RegisterCodec(json2.NewCustomCodec(&rpc.CompressionSelector{}), "application/json")
+		} else {
+			h.RegisterCodec(json2.NewCodec(), "application/json")
+		}
+		var encodings []string
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			encodings = append(encodings, r.Header.Get("Accept-Encoding"))
+			h.ServeHTTP(w, r)
+		}))
+
+		g := newURLGateway(t, s.URL)
+		encodings = nil
+
+		args := FooArgs{A: 1, B: "one"}
+		for i := 0; i < backendCompressionProbes+1; i++ {
+			var res FooRes
+			require.Nil(t, rpcutil.JSONRPC2CallHandler(g, &res, "TestEndpoint.Foo", &args))
+			assert.Equal(t, args, res.FooArgs)
+		}
+		s.Close()
+
+		require.Len(t, encodings, backendCompressionProbes+1)
+		for _, enc := range encodings[:backendCompressionProbes] {
+			assert.Equal(t, "gzip", enc)
+		}
+		if compress {
+			assert.Equal(t, "gzip", encodings[backendCompressionProbes])
+		} else {
+			assert.Equal(t, "identity", encodings[backendCompressionProbes])
+		}
+	}
+}
+
+func TestRequireSignature(t *T) {
+	g := newTestGateway(t)
+	key := []byte("secret")
+	g.RequireSignature(func(keyID string) ([]byte, error) {
+		if keyID != "partner" {
+			return nil, errors.New("unknown key")
+		}
+		return key, nil
+	})
+
+	body, err := json2.EncodeClientRequest("TestEndpoint.Foo", &FooArgs{A: 1, B: "one"})
+	require.Nil(t, err)
+	call := func(r *http.Request) (*httptest.ResponseRecorder, error) {
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, r)
+		var res FooRes
+		return rec, json2.DecodeClientResponse(bytes.NewBuffer(rec.Body.Bytes()), &res)
+	}
+
+	r := newBodyRequest(t, string(body))
+	SignRequest(r, body, "partner", key)
+	rec, err := call(r)
+	assert.Equal(t, 200, rec.Code)
+	assert.Nil(t, err)
+
+	// unsigned
+	rec, err = call(newBodyRequest(t, string(body)))
+	assert.Equal(t, 401, rec.Code)
+	assert.NotNil(t, err)
+
+	// unknown key
+	r = newBodyRequest(t, string(body))
+	SignRequest(r, body, "other", key)
+	rec, _ = call(r)
+	assert.Equal(t, 401, rec.Code)
+
+	// tampered body
+	tampered := bytes.Replace(body, []byte(`"a":1`), []byte(`"a":2`), 1)
+	r = newBodyRequest(t, string(tampered))
+	SignRequest(r, body, "partner", key)
+	rec, err = call(r)
+	assert.Equal(t, 401, rec.Code)
+	require.NotNil(t, err)
+	assert.Equal(t, errBadSignature.Message, err.Error())
+
+	// stale timestamp
+	r = newBodyRequest(t, string(body))
+	ts := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	r.Header.Set("X-Signature-KeyId", "partner")
+	r.Header.Set("X-Timestamp", ts)
+	r.Header.Set("X-Signature", hex.EncodeToString(computeSignature(key, ts, body)))
+	rec, _ = call(r)
+	assert.Equal(t, 401, rec.Code)
+
+	// envelopes need a signature too
+	g.EnvelopeDecoder = func(b []byte) (string, json.RawMessage, error) {
+		var env struct {
+			Action string          `json:"action"`
+			Data   json.RawMessage `json:"data"`
+		}
+		if err := json.Unmarshal(b, &env); err != nil {
+			return "", nil, err
+		}
+		return env.Action, env.Data, nil
+	}
+	env := []byte(`{"action":"TestEndpoint.Foo","data":{"a":1}}`)
+	rec = httptest.NewRecorder()
+	g.ServeHTTP(rec, newBodyRequest(t, string(env)))
+	assert.Equal(t, 401, rec.Code)
+
+	r = newBodyRequest(t, string(env))
+	SignRequest(r, env, "partner", key)
+	rec = httptest.NewRecorder()
+	g.ServeHTTP(rec, r)
+	assert.Equal(t, 200, rec.Code)
+}
+
+func TestEvents(t *T) {
+	g := newTestGateway(t)
+	events := g.Events()
+
+	var res FooRes
+	require.Nil(t, rpcutil.JSONRPC2CallHandler(g, &res, "TestEndpoint.Foo", &FooArgs{A: 1}))
+	select {
+	case ev := <-events:
+		assert.Equal(t, "TestEndpoint.Foo", ev.Method)
+		assert.Equal(t, "TestEndpoint", ev.Service)
+		assert.Equal(t, testURL, ev.Backend)
+		assert.Equal(t, 200, ev.Status)
+		assert.True(t, ev.Duration > 0)
+		assert.Nil(t, ev.Err)
+	default:
+		t.Fatal("no event received")
+	}
+
+	require.NotNil(t, rpcutil.JSONRPC2CallHandler(g, &res, "TestEndpoint.Foo", "bad"))
+	ev := <-events
+	assert.NotNil(t, ev.Err)
+
+	// a full buffer doesn't block requests
+	for i := 0; i < eventsBufferSize+1; i++ {
+		require.Nil(t, rpcutil.JSONRPC2CallHandler(g, &res, "TestEndpoint.Foo", &FooArgs{A: 1}))
+	}
+	assert.Len(t, events, eventsBufferSize)
+}
+
+type HedgeEndpoint struct {
+	delay     time.Duration
+	name      string
+	cancelled chan struct{}
+}
+
+func (h HedgeEndpoint) Get(r *http.Request, _ *struct{}, res *struct{ Name string }) error {
+	select {
+	case <-time.After(h.delay):
+		res.Name = h.name
+		return nil
+	case <-r.Context().Done():
+		close(h.cancelled)
+		return r.Context().Err()
+	}
+}
+
+func TestClientCancel(t *T) {
+	cancelled := make(chan struct{})
+	g, backend := newBackendGateway(t, HedgeEndpoint{delay: 5 * time.Second, cancelled: cancelled})
+	defer backend.Close()
+	g.BreakerThreshold = 1
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := newRawRequest(t, "HedgeEndpoint.Get", &struct{}{}).WithContext(ctx)
+	done := make(chan struct{})
+	go func() {
+		g.ServeHTTP(httptest.NewRecorder(), r)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("backend call wasn't cancelled")
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("gateway didn't return after the client went away")
+	}
+
+	// the client going away isn't the backend's fault
+	assert.False(t, g.PoolStats()["HedgeEndpoint"].BreakerOpen)
+}
+
+func TestHedge(t *T) {
+	newReplica := func(delay time.Duration, name string) (*httptest.Server, chan struct{}) {
+		cancelled := make(chan struct{})
+		h := newBackendHandler(t, HedgeEndpoint{delay: delay, name: name, cancelled: cancelled})
+		return httptest.NewServer(h), cancelled
+	}
+	slow, slowCancelled := newReplica(5*time.Second, "slow")
+	defer slow.Close()
+	fast, _ := newReplica(0, "fast")
+	defer fast.Close()
+	slowHost := strings.TrimPrefix(slow.URL, "http://")
+	fastHost := strings.TrimPrefix(fast.URL, "http://")
+
+	g := NewGateway()
+	g.RegisterCodec(json2.NewCodec(), "application/json")
+	g.Resolver = func(string) (string, error) { return slowHost, nil }
+	require.Nil(t, g.AddURL("http://hedge"))
+
+	// the first resolve for a request gets the slow replica, any after it get
+	// the fast one
+	resolves := 0
+	g.Resolver = func(string) (string, error) {
+		resolves++
+		if resolves == 1 {
+			return slowHost, nil
+		}
+		return fastHost, nil
+	}
+	g.HedgeAfter = 20 * time.Millisecond
+
+	// methods which aren't marked aren't hedged
+	g.ForwardTimeout = 100 * time.Millisecond
+	var res struct{ Name string }
+	require.NotNil(t, rpcutil.JSONRPC2CallHandler(g, &res, "HedgeEndpoint.Get", &struct{}{}))
+	assert.Equal(t, 1, resolves)
+	<-slowCancelled
+
+	slow.Close()
+	slow, slowCancelled = newReplica(5*time.Second, "slow")
+	defer slow.Close()
+	slowHost = strings.TrimPrefix(slow.URL, "http://")
+	g.ForwardTimeout = 0
+	resolves = 0
+	g.MarkIdempotent("HedgeEndpoint.Get")
+
+	require.Nil(t, rpcutil.JSONRPC2CallHandler(g, &res, "HedgeEndpoint.Get", &struct{}{}))
+	assert.Equal(t, "fast", res.Name)
+	assert.Equal(t, 2, resolves)
+	select {
+	case <-slowCancelled:
+	case <-time.After(time.Second):
+		t.Fatal("slow replica's request wasn't cancelled")
+	}
+
+	// hedges go to the same backend the request was routed to
+	slow.Close()
+	slow, slowCancelled = newReplica(5*time.Second, "slow")
+	defer slow.Close()
+	slowHost = strings.TrimPrefix(slow.URL, "http://")
+	require.Nil(t, g.RouteBySize("HedgeEndpoint.Get", 0, "http://large"))
+	var hosts []string
+	g.Resolver = func(host string) (string, error) {
+		hosts = append(hosts, host)
+		if len(hosts) <= 2 {
+			return slowHost, nil
+		}
+		return fastHost, nil
+	}
+	require.Nil(t, rpcutil.JSONRPC2CallHandler(g, &res, "HedgeEndpoint.Get", &struct{}{}))
+	assert.Equal(t, "fast", res.Name)
+	// the usual backend is resolved before the request is routed by its size
+	assert.Equal(t, []string{"hedge", "large", "large"}, hosts)
+	<-slowCancelled
+}
+
+func TestInvalidMethod(t *T) {
+	for _, m := range []string{
+		"TestEndpoint." + strings.Repeat("a", maxMethodLength),
+		"TestEndpoint.Foo\nlevel=ERROR msg=injected",
+	} {
+		var res FooRes
+		err := rpcutil.JSONRPC2CallHandler(testGateway, &res, m, &FooArgs{})
+		require.NotNil(t, err)
+		assert.Equal(t, errInvalidMethod.Message, err.Error())
+
+		logged := sanitizeMethod(m)
+		assert.NotContains(t, logged, "\n")
+		assert.True(t, len(logged) <= maxMethodLength+2)
+	}
+
+	assert.True(t, validMethod("TestEndpoint.Foo"))
+}
+
+func TestProxyPath(t *T) {
+	h := newBackendHandler(t, TestEndpoint2{})
+	mux := http.NewServeMux()
+	mux.Handle("/", h)
+	mux.HandleFunc("/files/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Method", r.Method)
+		w.Write([]byte("file " + r.URL.Path))
+	})
+	s := httptest.NewServer(mux)
+	defer s.Close()
+
+	g := newTestGateway(t)
+	require.Nil(t, g.AddURL(s.URL))
+	g.ProxyPath("/files/", "TestEndpoint2")
+
+	r, err := http.NewRequest("GET", "/files/x", nil)
+	require.Nil(t, err)
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, r)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "GET", w.Header().Get("X-Method"))
+	assert.Equal(t, "file /files/x", w.Body.String())
+
+	// maintenance and drained backends apply to proxied paths too
+	proxyCode := func() int {
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, httptest.NewRequest("GET", "/files/x", nil))
+		return w.Code
+	}
+	g.SetServiceMaintenance("TestEndpoint2", true, "")
+	assert.Equal(t, 503, proxyCode())
+	g.SetServiceMaintenance("TestEndpoint2", false, "")
+	g.DrainBackend(s.URL)
+	assert.Equal(t, 503, proxyCode())
+	g.UndrainBackend(s.URL)
+	assert.Equal(t, 200, proxyCode())
+
+	// other paths are still handled as rpc
+	var res FooRes
+	require.Nil(t, rpcutil.JSONRPC2CallHandler(g, &res, "TestEndpoint.Foo", &FooArgs{A: 1}))
+	assert.Equal(t, int64(1), res.A)
+
+	// proxied paths need a signature too
+	key := []byte("secret")
+	g.RequireSignature(func(string) ([]byte, error) { return key, nil })
+	r, err = http.NewRequest("GET", "/files/x", http.NoBody)
+	require.Nil(t, err)
+	w = httptest.NewRecorder()
+	g.ServeHTTP(w, r)
+	assert.Equal(t, 401, w.Code)
+
+	SignRequest(r, nil, "partner", key)
+	w = httptest.NewRecorder()
+	g.ServeHTTP(w, r)
+	assert.Equal(t, 200, w.Code)
+}
+
+type canonicalCodec struct {
+	*json2.Codec
+	contentType string
+}
+
+func (c canonicalCodec) ResponseContentType() string {
+	return c.contentType
+}
+
+func TestResponseContentType(t *T) {
+	for _, ct := range []string{"application/json; charset=utf-8", "application/vnd.test+json"} {
+		g := NewGateway()
+		g.RegisterCodec(canonicalCodec{json2.NewCodec(), ct}, "application/json")
+		require.Nil(t, g.AddURL(testURL))
+
+		w := callRaw(t, g, "TestEndpoint.Foo", &FooArgs{A: 1})
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, ct, w.Header().Get("Content-Type"))
+	}
+}
+
+func TestJSONTransportErrors(t *T) {
+	g := newTestGateway(t)
+	g.JSONTransportErrors = true
+
+	assertErr := func(w *httptest.ResponseRecorder, status int) {
+		assert.Equal(t, status, w.Code)
+		assert.Equal(t, "application/json; charset=utf-8", w.Header().Get("Content-Type"))
+		var res struct {
+			Version string           `json:"jsonrpc"`
+			Error   *json2.Error     `json:"error"`
+			ID      *json.RawMessage `json:"id"`
+		}
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), &res))
+		assert.Equal(t, "2.0", res.Version)
+		require.NotNil(t, res.Error)
+		assert.Equal(t, json2.E_INVALID_REQ, res.Error.Code)
+		assert.NotEmpty(t, res.Error.Message)
+		assert.Nil(t, res.ID)
+	}
+
+	r := newRawRequest(t, "TestEndpoint.Foo", &FooArgs{})
+	r.Method = "GET"
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, r)
+	assertErr(w, 405)
+
+	r = newRawRequest(t, "TestEndpoint.Foo", &FooArgs{})
+	r.Header.Set("Content-Type", "text/xml")
+	w = httptest.NewRecorder()
+	g.ServeHTTP(w, r)
+	assertErr(w, 415)
+}
+
+type CountEndpoint struct {
+	calls *int64
+}
+
+func (c CountEndpoint) Get(r *http.Request, args *SleepArgs, res *struct{ Calls int64 }) error {
+	res.Calls = atomic.AddInt64(c.calls, 1)
+	time.Sleep(time.Duration(args.Ms) * time.Millisecond)
+	return nil
+}
+
+func TestCoalesceReads(t *T) {
+	var calls int64
+	g, s := newBackendGateway(t, CountEndpoint{calls: &calls})
+	defer s.Close()
+	g.CoalesceReads = true
+	g.MarkIdempotent("CountEndpoint.Get")
+
+	const n = 10
+	var wg sync.WaitGroup
+	ress := make([]struct{ Calls int64 }, n)
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = rpcutil.JSONRPC2CallHandler(g, &ress[i], "CountEndpoint.Get", &SleepArgs{Ms: 200})
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, int64(1), atomic.LoadInt64(&calls))
+	for i := range ress {
+		require.Nil(t, errs[i])
+		assert.Equal(t, int64(1), ress[i].Calls)
+	}
+
+	// different params aren't coalesced
+	var res struct{ Calls int64 }
+	require.Nil(t, rpcutil.JSONRPC2CallHandler(g, &res, "CountEndpoint.Get", &SleepArgs{Ms: 1}))
+	assert.Equal(t, int64(2), res.Calls)
+
+	// the caller which started the forward going away doesn't affect the
+	// others sharing it, or count against the breaker
+	g.BreakerThreshold = 1
+	ctx, cancel := context.WithCancel(context.Background())
+	r := newRawRequest(t, "CountEndpoint.Get", &SleepArgs{Ms: 200}).WithContext(ctx)
+	done := make(chan struct{})
+	go func() {
+		g.ServeHTTP(httptest.NewRecorder(), r)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	require.Nil(t, rpcutil.JSONRPC2CallHandler(g, &res, "CountEndpoint.Get", &SleepArgs{Ms: 200}))
+	assert.Equal(t, int64(3), res.Calls)
+	<-done
+	assert.False(t, g.PoolStats()["CountEndpoint"].BreakerOpen)
+}
+
+func TestPassResponseHeaders(t *T) {
+	h := newBackendHandler(t, TestEndpoint2{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Rate-Limit-Remaining", "41")
+		w.Header().Set("X-Internal", "secret")
+		h.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+
+	g := newURLGateway(t, s.URL)
+	g.PassResponseHeaders = []string{"x-rate-limit-remaining"}
+
+	w := callRaw(t, g, "TestEndpoint2.Wat", &struct{}{})
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "41", w.Header().Get("X-Rate-Limit-Remaining"))
+	assert.Equal(t, "", w.Header().Get("X-Internal"))
+}
+
+func TestMaxCatalogStaleness(t *T) {
+	g := newTestGateway(t)
+	g.MaxCatalogStaleness = time.Hour
+	setLastRefresh := func(ago time.Duration) {
+		g.mutex.Lock()
+		defer g.mutex.Unlock()
+		rsrv := g.services["TestEndpoint"]
+		rsrv.lastRefresh = time.Now().Add(-ago)
+		g.services["TestEndpoint"] = rsrv
+	}
+
+	last, ok := g.LastRefresh("TestEndpoint")
+	assert.True(t, ok)
+	assert.WithinDuration(t, time.Now(), last, time.Minute)
+	_, ok = g.LastRefresh("Nope")
+	assert.False(t, ok)
+
+	// stale, but still usable
+	setLastRefresh(10 * time.Minute)
+	var res FooRes
+	require.Nil(t, rpcutil.JSONRPC2CallHandler(g, &res, "TestEndpoint.Foo", &FooArgs{A: 1}))
+	assert.Equal(t, int64(1), res.A)
+
+	// too stale
+	setLastRefresh(2 * time.Hour)
+	require.NotNil(t, rpcutil.JSONRPC2CallHandler(g, &res, "TestEndpoint.Foo", &FooArgs{A: 1}))
+
+	// a successful refresh makes it usable again
+	g.refreshURLs()
+	require.Nil(t, rpcutil.JSONRPC2CallHandler(g, &res, "TestEndpoint.Foo", &FooArgs{A: 1}))
+}
+
+func TestDefaultCharset(t *T) {
+	g := newTestGateway(t)
+	g.JSONTransportErrors = true
+	wrongMethod := func() *httptest.ResponseRecorder {
+		r := newRawRequest(t, "TestEndpoint.Foo", &FooArgs{})
+		r.Method = "GET"
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, r)
+		return w
+	}
+
+	w := callRaw(t, g, "TestEndpoint.Foo", &FooArgs{})
+	assert.Equal(t, "application/json; charset=utf-8", w.Header().Get("Content-Type"))
+
+	g.DefaultCharset = "iso-8859-1"
+	w = callRaw(t, g, "TestEndpoint.Foo", &FooArgs{})
+	assert.Equal(t, "application/json; charset=iso-8859-1", w.Header().Get("Content-Type"))
+	assert.Equal(t, "application/json; charset=iso-8859-1", wrongMethod().Header().Get("Content-Type"))
+
+	g.DefaultCharset = ""
+	w = callRaw(t, g, "TestEndpoint.Foo", &FooArgs{})
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.Equal(t, "application/json", wrongMethod().Header().Get("Content-Type"))
+
+	g.JSONTransportErrors = false
+	assert.Equal(t, "text/plain", wrongMethod().Header().Get("Content-Type"))
+}
+
+func TestCallGraphHook(t *T) {
+	g := newTestGateway(t)
+	g.RequestCallback = func(r *Request) {
+		if m, _ := r.Method(); m == "TestEndpoint.Empty" {
+			require.Nil(t, r.UpdateRequest("SlowEndpoint.Sleep", &SleepArgs{Ms: 1}))
+		}
+	}
+	var edges [][2]string
+	g.CallGraphHook = func(from, to string) {
+		edges = append(edges, [2]string{from, to})
+	}
+
+	var res struct{}
+	require.Nil(t, rpcutil.JSONRPC2CallHandler(g, &res, "TestEndpoint.Empty", &struct{}{}))
+	require.Nil(t, rpcutil.JSONRPC2CallHandler(g, &res, "TestEndpoint.Foo", &FooArgs{}))
+	assert.Equal(t, [][2]string{{"TestEndpoint.Empty", "SlowEndpoint.Sleep"}}, edges)
+}
+
+func TestRegisterDefaultCodecs(t *T) {
+	// the content-type is passed through, so the backend needs to support all
+	// of them as well
+	h := gatewayrpc.NewServer()
+	h.RegisterService(TestEndpoint{}, "")
+	gatewayrpc.RegisterDefaultCodecs(h)
+	s := httptest.NewServer(h)
+	defer s.Close()
+
+	g := NewGateway()
+	gatewayrpc.RegisterDefaultCodecs(g)
+	require.Nil(t, g.AddURL(s.URL))
+
+	for _, ct := range gatewayrpc.DefaultContentTypes {
+		r := newRawRequest(t, "TestEndpoint.Foo", &FooArgs{A: 1})
+		r.Header.Set("Content-Type", ct)
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, r)
+		assert.Equal(t, 200, w.Code, "content-type: %s", ct)
+
+		var res FooRes
+		require.Nil(t, json2.DecodeClientResponse(w.Body, &res), "content-type: %s", ct)
+		assert.Equal(t, int64(1), res.A)
+	}
+}
+
+type ShardEndpoint struct {
+	items []string
+}
+
+func (s ShardEndpoint) List(r *http.Request, _ *struct{}, res *[]string) error {
+	*res = s.items
+	return nil
+}
+
+func (s ShardEndpoint) Fail(r *http.Request, _ *struct{}, res *[]string) error {
+	if len(s.items) > 1 {
+		return errors.New("shard is broken")
+	}
+	*res = s.items
+	return nil
+}
+
+func TestFanOut(t *T) {
+	newShard := func(items ...string) *httptest.Server {
+		return httptest.NewServer(newBackendHandler(t, ShardEndpoint{items: items}))
+	}
+	shard1 := newShard("a", "b")
+	defer shard1.Close()
+	shard2 := newShard("c")
+	defer shard2.Close()
+
+	g := newURLGateway(t, shard1.URL)
+	require.Nil(t, g.FanOut("ShardEndpoint.List", MergeArrays, shard1.URL, shard2.URL))
+	require.Nil(t, g.FanOut("ShardEndpoint.Fail", MergeArrays, shard1.URL, shard2.URL))
+
+	var res []string
+	require.Nil(t, rpcutil.JSONRPC2CallHandler(g, &res, "ShardEndpoint.List", &struct{}{}))
+	assert.Equal(t, []string{"a", "b", "c"}, res)
+
+	err := rpcutil.JSONRPC2CallHandler(g, &res, "ShardEndpoint.Fail", &struct{}{})
+	require.NotNil(t, err)
+	assert.Equal(t, "1 of 2 backends failed", err.Error())
+	// only the shard's index is sent back, not its url or error
+	w := callRaw(t, g, "ShardEndpoint.Fail", &struct{}{})
+	assert.Contains(t, w.Body.String(), `"data":{"failedShards":[0]}`)
+	assert.NotContains(t, w.Body.String(), shard1.URL)
+	assert.NotContains(t, w.Body.String(), "shard is broken")
+
+	merged, err := mergeResults([]json.RawMessage{
+		json.RawMessage(`{"a":1,"b":1}`),
+		json.RawMessage(`{"b":2,"c":2}`),
+	}, MergeObjects)
+	require.Nil(t, err)
+	assert.JSONEq(t, `{"a":1,"b":2,"c":2}`, string(merged))
+
+	_, err = mergeResults([]json.RawMessage{json.RawMessage(`{}`)}, MergeArrays)
+	assert.NotNil(t, err)
+}
+
+func TestRequestID(t *T) {
+	h := newBackendHandler(t, TestEndpoint2{})
+	var backendID string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendID = r.Header.Get("X-Request-Id")
+		h.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+
+	g := newURLGateway(t, s.URL)
+
+	// generated when absent
+	w := callRaw(t, g, "TestEndpoint2.Wat", &struct{}{})
+	assert.Equal(t, 200, w.Code)
+	id := w.Header().Get("X-Request-Id")
+	assert.Regexp(t, `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`, id)
+	assert.Equal(t, id, backendID)
+
+	// propagated when present
+	r := newRawRequest(t, "TestEndpoint2.Wat", &struct{}{})
+	r.Header.Set("X-Request-Id", "abc")
+	w = httptest.NewRecorder()
+	g.ServeHTTP(w, r)
+	assert.Equal(t, "abc", w.Header().Get("X-Request-Id"))
+	assert.Equal(t, "abc", backendID)
+}
+
+func TestDefaultKeyFunc(t *T) {
+	k1, err := DefaultKeyFunc("A.B", json.RawMessage(`{"a":1,"b":{"c":[1, 2],"d":"x"}}`))
+	require.Nil(t, err)
+	k2, err := DefaultKeyFunc("A.B", json.RawMessage(` { "b" : { "d":"x", "c":[1,2] }, "a" : 1 } `))
+	require.Nil(t, err)
+	assert.Equal(t, k1, k2)
+
+	k3, err := DefaultKeyFunc("A.C", json.RawMessage(`{"a":1,"b":{"c":[1,2],"d":"x"}}`))
+	require.Nil(t, err)
+	assert.NotEqual(t, k1, k3)
+	k4, err := DefaultKeyFunc("A.B", json.RawMessage(`{"a":1,"b":{"c":[2,1],"d":"x"}}`))
+	require.Nil(t, err)
+	assert.NotEqual(t, k1, k4)
+
+	_, err = DefaultKeyFunc("A.B", json.RawMessage(`{`))
+	assert.NotNil(t, err)
+}
+
+func TestRoutingHint(t *T) {
+	newRegion := func(region string) *httptest.Server {
+		return httptest.NewServer(newBackendHandler(t, ShardEndpoint{items: []string{region}}))
+	}
+	us := newRegion("us")
+	defer us.Close()
+	eu := newRegion("eu")
+	defer eu.Close()
+
+	g := NewGateway()
+	g.RegisterCodec(json2.NewCodec(), "application/json")
+	g.RejectCollisions = true
+	g.RoutingHintHeader = "X-Region"
+	g.RoutingHintTag = "region"
+	require.Nil(t, g.AddURLTagged(us.URL, map[string]string{"region": "us"}))
+	require.Nil(t, g.AddURLTagged(eu.URL, map[string]string{"region": "eu"}))
+
+	call := func(hint string) []string {
+		r := newRawRequest(t, "ShardEndpoint.List", &struct{}{})
+		if hint != "" {
+			r.Header.Set("X-Region", hint)
+		}
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, r)
+		var res []string
+		require.Nil(t, json2.DecodeClientResponse(w.Body, &res))
+		return res
+	}
+
+	assert.Equal(t, []string{"us"}, call("us"))
+	assert.Equal(t, []string{"eu"}, call("eu"))
+	// falls back to the most recently added when absent or unmatched
+	assert.Equal(t, []string{"eu"}, call(""))
+	assert.Equal(t, []string{"eu"}, call("asia"))
+
+	// refreshing keeps all the tagged backends
+	g.refreshURLs()
+	assert.Equal(t, []string{"us"}, call("us"))
+	assert.Equal(t, []string{"eu"}, call(""))
+}
+
+func TestSchemaVersion(t *T) {
+	newVersion := func(version string) *httptest.Server {
+		return httptest.NewServer(newBackendHandler(t, ShardEndpoint{items: []string{version}}))
+	}
+	v1 := newVersion("v1")
+	defer v1.Close()
+	v2 := newVersion("v2")
+	defer v2.Close()
+
+	g := NewGateway()
+	g.RegisterCodec(json2.NewCodec(), "application/json")
+	require.Nil(t, g.AddURLTagged(v1.URL, map[string]string{SchemaVersionTag: "1"}))
+	require.Nil(t, g.AddURLTagged(v2.URL, map[string]string{SchemaVersionTag: "2"}))
+
+	call := func(version string) ([]string, error) {
+		r := newRawRequest(t, "ShardEndpoint.List", &struct{}{})
+		if version != "" {
+			r.Header.Set(DefaultSchemaVersionHeader, version)
+		}
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, r)
+		var res []string
+		err := json2.DecodeClientResponse(w.Body, &res)
+		return res, err
+	}
+
+	res, err := call("1")
+	require.Nil(t, err)
+	assert.Equal(t, []string{"v1"}, res)
+	res, err = call("2")
+	require.Nil(t, err)
+	assert.Equal(t, []string{"v2"}, res)
+	res, err = call("")
+	require.Nil(t, err)
+	assert.Equal(t, []string{"v2"}, res)
+
+	_, err = call("3")
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), `schema version "3" is not available`)
+}
+
+func TestRetryBudget(t *T) {
+	ln, ch := newRefusingListener(t)
+	defer ln.Close()
+
+	g := newTestGateway(t)
+	g.Resolver = func(string) (string, error) {
+		return ln.Addr().String(), nil
+	}
+	g.Retries = 1
+	g.Backoff = func(int) time.Duration { return 0 }
+	g.RetryBudget = NewRetryBudget(0.1, 0, time.Minute)
+
+	// returns the number of attempts made for a single request
+	call := func() int {
+		var res FooRes
+		assert.NotNil(t, rpcutil.JSONRPC2CallHandler(g, &res, "TestEndpoint.Foo", &FooArgs{}))
+		// give the listener a moment to see all the connections
+		time.Sleep(10 * time.Millisecond)
+		n := len(ch)
+		for i := 0; i < n; i++ {
+			<-ch
+		}
+		return n
+	}
+
+	// the first nine requests don't have enough budget for a retry, the tenth
+	// does, and then the budget is exhausted again
+	for i := 0; i < 9; i++ {
+		assert.Equal(t, 1, call(), "request %d", i)
+	}
+	assert.Equal(t, 2, call())
+	assert.Equal(t, 1, call())
+
+	// minRetries are always allowed
+	g.RetryBudget = NewRetryBudget(0.1, 2, time.Minute)
+	assert.Equal(t, 2, call())
+	assert.Equal(t, 2, call())
+	assert.Equal(t, 1, call())
+}
+
+func TestEnvelopeExtraFields(t *T) {
+	h := newBackendHandler(t, TestEndpoint{})
+	var backendBody []byte
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendBody, _ = ioutil.ReadAll(r.Body)
+		r.Body = ioutil.NopCloser(bytes.NewBuffer(backendBody))
+		h.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+
+	g := newURLGateway(t, s.URL)
+
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, newBodyRequest(t, `{"jsonrpc":"2.0","method":"TestEndpoint.Foo","params":{"a":1},"id":1,"meta":{"trace":"abc","n":[1,2]}}`))
+	assert.Equal(t, 200, w.Code)
+	var res FooRes
+	require.Nil(t, json2.DecodeClientResponse(w.Body, &res))
+	assert.Equal(t, int64(1), res.A)
+
+	var env map[string]json.RawMessage
+	require.Nil(t, json.Unmarshal(backendBody, &env))
+	assert.JSONEq(t, `{"trace":"abc","n":[1,2]}`, string(env["meta"]))
+	assert.Equal(t, `"TestEndpoint.Foo"`, string(env["method"]))
+
+	// the fields of custom envelopes aren't forwarded
+	g.EnvelopeDecoder = func(b []byte) (string, json.RawMessage, error) {
+		var env struct {
+			Action string          `json:"action"`
+			Data   json.RawMessage `json:"data"`
+		}
+		if err := json.Unmarshal(b, &env); err != nil {
+			return "", nil, err
+		} else if env.Action == "" {
+			return "", nil, errors.New("not an envelope")
+		}
+		return env.Action, env.Data, nil
+	}
+	w = httptest.NewRecorder()
+	g.ServeHTTP(w, newBodyRequest(t, `{"action":"TestEndpoint.Foo","data":{"a":1},"meta":"x"}`))
+	assert.Equal(t, 200, w.Code)
+	env = nil
+	require.Nil(t, json.Unmarshal(backendBody, &env))
+	assert.NotContains(t, env, "action")
+	assert.NotContains(t, env, "data")
+	assert.NotContains(t, env, "meta")
+	assert.Equal(t, `"TestEndpoint.Foo"`, string(env["method"]))
+}
+
+func TestDeprecatedWarning(t *T) {
+	w := callRaw(t, testGateway, "TestEndpoint.Empty", &struct{}{})
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, `299 - "Deprecated: use Foo instead"`, w.Header().Get("Warning"))
+
+	w = callRaw(t, testGateway, "TestEndpoint.Foo", &FooArgs{})
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "", w.Header().Get("Warning"))
+}
+
+func TestTrailingData(t *T) {
+	for _, body := range []string{
+		`{"jsonrpc":"2.0","method":"TestEndpoint.Foo","params":{"a":1},"id":1}{"extra":true}`,
+		`{"jsonrpc":"2.0","method":"TestEndpoint.Foo","params":{"a":1},"id":1} garbage`,
+	} {
+		w := httptest.NewRecorder()
+		testGateway.ServeHTTP(w, newBodyRequest(t, body))
+		var res FooRes
+		err := json2.DecodeClientResponse(w.Body, &res)
+		require.NotNil(t, err, "body: %s", body)
+		assert.Equal(t, errTrailingData.Message, err.Error())
+	}
+
+	// trailing whitespace is fine
+	w := httptest.NewRecorder()
+	testGateway.ServeHTTP(w, newBodyRequest(t, `{"jsonrpc":"2.0","method":"TestEndpoint.Foo","params":{"a":1},"id":1}`+" \n\t"))
+	var res FooRes
+	require.Nil(t, json2.DecodeClientResponse(w.Body, &res))
+	assert.Equal(t, int64(1), res.A)
+}
+
+func TestMetricsLabeler(t *T) {
+	g := newTestGateway(t)
+	g.MetricsLabeler = func(r *Request) map[string]string {
+		return map[string]string{"tenant": r.Header.Get("X-Tenant")}
+	}
+
+	r := newRawRequest(t, "TestEndpoint.Foo", &FooArgs{A: 1})
+	r.Header.Set("X-Tenant", "acme")
+	g.ServeHTTP(httptest.NewRecorder(), r)
+
+	ev := <-g.Events()
+	assert.Equal(t, "TestEndpoint.Foo", ev.Method)
+	assert.Equal(t, map[string]string{"tenant": "acme"}, ev.Labels)
+}
+
+func TestGzipRequest(t *T) {
+	body, err := json2.EncodeClientRequest("TestEndpoint.Foo", &FooArgs{A: 1, B: "one"})
+	require.Nil(t, err)
+	buf := new(bytes.Buffer)
+	gw := gzip.NewWriter(buf)
+	_, err = gw.Write(body)
+	require.Nil(t, err)
+	require.Nil(t, gw.Close())
+
+	r := newBodyRequest(t, buf.String())
+	r.Header.Set("Content-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	testGateway.ServeHTTP(w, r)
+	assert.Equal(t, 200, w.Code)
+	var res FooRes
+	require.Nil(t, json2.DecodeClientResponse(w.Body, &res))
+	assert.Equal(t, FooArgs{A: 1, B: "one"}, res.FooArgs)
+
+	// a body which isn't actually gzip'd is rejected
+	r = newBodyRequest(t, string(body))
+	r.Header.Set("Content-Encoding", "gzip")
+	w = httptest.NewRecorder()
+	testGateway.ServeHTTP(w, r)
+	assert.Equal(t, 400, w.Code)
+
+	// bodies which are too large once decompressed are rejected
+	g := newTestGateway(t)
+	g.MaxDecompressedBytes = int64(len(body)) - 1
+	r = newBodyRequest(t, buf.String())
+	r.Header.Set("Content-Encoding", "gzip")
+	w = httptest.NewRecorder()
+	g.ServeHTTP(w, r)
+	assert.Equal(t, 413, w.Code)
+
+	// signatures are of the gzip'd body, as it was sent
+	g.MaxDecompressedBytes = 0
+	key := []byte("secret")
+	g.RequireSignature(func(string) ([]byte, error) { return key, nil })
+	r = newBodyRequest(t, buf.String())
+	r.Header.Set("Content-Encoding", "gzip")
+	SignRequest(r, buf.Bytes(), "partner", key)
+	w = httptest.NewRecorder()
+	g.ServeHTTP(w, r)
+	assert.Equal(t, 200, w.Code)
+}
+
+func TestAddURLsDetailed(t *T) {
+	ln, _ := newRefusingListener(t)
+	defer ln.Close()
+	bad := "http://" + ln.Addr().String()
+
+	g := NewGateway()
+	g.RegisterCodec(json2.NewCodec(), "application/json")
+	results := g.AddURLsDetailed([]string{testURL, bad})
+	require.Len(t, results, 2)
+	assert.Equal(t, testURL, results[0].URL)
+	assert.Nil(t, results[0].Err)
+	assert.Equal(t, bad, results[1].URL)
+	assert.NotNil(t, results[1].Err)
+
+	// the reachable backend was still added
+	var res FooRes
+	require.Nil(t, rpcutil.JSONRPC2CallHandler(g, &res, "TestEndpoint.Foo", &FooArgs{A: 1}))
+
+	err := g.AddURLs([]string{testURL, bad})
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "1 of 2 urls failed: "+bad)
+	assert.Nil(t, g.AddURLs([]string{testURL}))
+}
+
+func TestDryRun(t *T) {
+	ln, ch := newRefusingListener(t)
+	defer ln.Close()
+
+	g := newTestGateway(t)
+	g.Resolver = func(string) (string, error) {
+		return ln.Addr().String(), nil
+	}
+	g.DryRun = true
+	var method, backend string
+	var paramsSize int
+	g.DryRunHook = func(m, b string, size int) {
+		method, backend, paramsSize = m, b, size
+	}
+
+	var res struct{}
+	require.Nil(t, rpcutil.JSONRPC2CallHandler(g, &res, "TestEndpoint.Foo", &FooArgs{A: 1}))
+	assert.Equal(t, "TestEndpoint.Foo", method)
+	assert.Equal(t, "http://"+ln.Addr().String(), backend)
+	assert.Equal(t, len(`{"a":1,"b":""}`), paramsSize)
+
+	time.Sleep(10 * time.Millisecond)
+	assert.Len(t, ch, 0)
+}
+
+type ConflictEndpoint struct{}
+
+func (ConflictEndpoint) Do(r *http.Request, _ *struct{}, _ *struct{}) error {
+	return &json2.Error{Code: 409, Message: "conflict", Data: "x"}
+}
+
+func TestPassthroughLarge(t *T) {
+	g, s := newBackendGateway(t, ConflictEndpoint{}, TestEndpoint{})
+	defer s.Close()
+
+	call := func(method string, args interface{}) (int, map[string]interface{}) {
+		rec := callRaw(t, g, method, args)
+		var res map[string]interface{}
+		require.Nil(t, json.Unmarshal(rec.Body.Bytes(), &res), "body: %q", rec.Body.String())
+		return rec.Code, res
+	}
+
+	for _, c := range []struct {
+		method string
+		args   interface{}
+	}{
+		{"TestEndpoint.Foo", &FooArgs{A: 3, B: "three"}},
+		{"ConflictEndpoint.Do", &struct{}{}},
+	} {
+		g.PassthroughLarge = false
+		bufCode, buffered := call(c.method, c.args)
+		g.PassthroughLarge = true
+		code, streamed := call(c.method, c.args)
+		assert.Equal(t, bufCode, code, "method: %s", c.method)
+		assert.NotNil(t, streamed["id"], "method: %s", c.method)
+		// every request is encoded with a new random id
+		delete(buffered, "id")
+		delete(streamed, "id")
+		assert.Equal(t, buffered, streamed, "method: %s", c.method)
+	}
+
+	// responses for other codecs are always written by the codec
+	g = NewGateway()
+	g.RegisterCodec(base64ResponseCodec{json2.NewCodec()}, "application/json")
+	require.Nil(t, g.AddURL(s.URL))
+	g.PassthroughLarge = true
+	args := FooArgs{A: 3, B: "three"}
+	rec := callRaw(t, g, "TestEndpoint.Foo", &args)
+	var res FooRes
+	require.Nil(t, base64Codec{}.DecodeClientResponse(rec.Body, &res))
+	assert.Equal(t, args, res.FooArgs)
+}
+
+// base64ResponseCodec is json2, except that responses are base64 encoded like
+// base64Codec's
+type base64ResponseCodec struct {
+	*json2.Codec
+}
+
+func (c base64ResponseCodec) NewRequest(r *http.Request) rpc.CodecRequest {
+	return base64CodecRequest{c.Codec.NewRequest(r)}
+}
+
+func benchmarkForward(b *B, passthrough bool) {
+	g := NewGateway()
+	g.RegisterCodec(json2.NewCodec(), "application/json")
+	g.PassthroughLarge = passthrough
+	if err := g.AddURL(testURL); err != nil {
+		b.Fatal(err)
+	}
+	args := FooArgs{B: strings.Repeat("x", 1<<20)}
+	body, err := json2.EncodeClientRequest("TestEndpoint.Foo", &args)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r, _ := http.NewRequest("POST", "/", bytes.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		g.ServeHTTP(httptest.NewRecorder(), r)
+	}
+}
+
+func BenchmarkForwardBuffered(b *B) {
+	benchmarkForward(b, false)
+}
+
+func BenchmarkForwardPassthrough(b *B) {
+	benchmarkForward(b, true)
+}
+
+func TestErrorCodeMapper(t *T) {
+	g, s := newBackendGateway(t, ConflictEndpoint{})
+	defer s.Close()
+
+	call := func() *json2.Error {
+		var res struct{}
+		err := rpcutil.JSONRPC2CallHandler(g, &res, "ConflictEndpoint.Do", &struct{}{})
+		require.NotNil(t, err)
+		jsonErr, ok := err.(*json2.Error)
+		require.True(t, ok, "%T", err)
+		return jsonErr
+	}
+
+	// codes are preserved without a mapper
+	assert.Equal(t, json2.ErrorCode(409), call().Code)
+
+	var gotService string
+	g.ErrorCodeMapper = func(service string, code int) int {
+		gotService = service
+		if code == 409 {
+			return -32001
+		}
+		return code
+	}
+	jsonErr := call()
+	assert.Equal(t, json2.ErrorCode(-32001), jsonErr.Code)
+	assert.Equal(t, "conflict", jsonErr.Message)
+	assert.Equal(t, "ConflictEndpoint", gotService)
+}
+
+// codeTranscoder is a ResponseTranscoder which replaces the codes of all
+// backend errors with its own
+type codeTranscoder json2.ErrorCode
+
+func (ct codeTranscoder) TranscodeResponse(w http.ResponseWriter, codecReq rpc.CodecRequest, status int, body io.Reader) error {
+	var res json.RawMessage
+	err := json2.DecodeClientResponse(body, &res)
+	if jsonErr, ok := err.(*json2.Error); ok {
+		mapped := *jsonErr
+		mapped.Code = json2.ErrorCode(ct)
+		err = &mapped
+	}
+	if err != nil {
+		codecReq.WriteError(w, status, err)
+		return err
+	}
+	codecReq.WriteResponse(w, &res)
+	return nil
+}
+
+func TestResponseTranscoder(t *T) {
+	g, s := newBackendGateway(t, ConflictEndpoint{}, TestEndpoint{})
+	defer s.Close()
+	g.ResponseTranscoder = codeTranscoder(-32099)
+
+	err := rpcutil.JSONRPC2CallHandler(g, &struct{}{}, "ConflictEndpoint.Do", &struct{}{})
+	require.NotNil(t, err)
+	jsonErr, ok := err.(*json2.Error)
+	require.True(t, ok, "%T", err)
+	assert.Equal(t, json2.ErrorCode(-32099), jsonErr.Code)
+	assert.Equal(t, "conflict", jsonErr.Message)
+
+	// successful responses are passed through
+	args := FooArgs{A: 2, B: "two"}
+	var res FooRes
+	require.Nil(t, rpcutil.JSONRPC2CallHandler(g, &res, "TestEndpoint.Foo", &args))
+	assert.Equal(t, args, res.FooArgs)
+
+	// JSON2Transcoder leaves the codes as they are
+	g.ResponseTranscoder = JSON2Transcoder{}
+	err = rpcutil.JSONRPC2CallHandler(g, &struct{}{}, "ConflictEndpoint.Do", &struct{}{})
+	require.NotNil(t, err)
+	assert.Equal(t, json2.ErrorCode(409), err.(*json2.Error).Code)
+}
+
+func TestWarmConnections(t *T) {
+	h := newBackendHandler(t, TestEndpoint2{})
+	s := httptest.NewUnstartedServer(h)
+	var conns int32
+	s.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	s.Start()
+	defer s.Close()
+
+	g := newURLGateway(t, s.URL)
+
+	// start over with an empty connection pool
+	g.SetRoundTripper(&http.Transport{})
+	atomic.StoreInt32(&conns, 0)
+
+	require.Nil(t, g.WarmConnections(context.Background()))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&conns))
+
+	var res struct{ A int }
+	require.Nil(t, rpcutil.JSONRPC2CallHandler(g, &res, "TestEndpoint2.Wat", &struct{}{}))
+	assert.Equal(t, 5, res.A)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&conns))
+}
+
+func TestWarmUp(t *T) {
+	h := newBackendHandler(t, TestEndpoint2{})
+	var up int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&up) == 0 {
+			w.WriteHeader(503)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+
+	g := NewGateway()
+	g.RegisterCodec(json2.NewCodec(), "application/json")
+	ready := func() int {
+		w := httptest.NewRecorder()
+		g.ReadinessHandler().ServeHTTP(w, httptest.NewRequest("GET", "/ready", nil))
+		return w.Code
+	}
+
+	// the backend isn't up yet
+	assert.NotNil(t, g.AddURL(s.URL))
+	assert.Equal(t, 503, ready())
+	assert.NotNil(t, g.WarmUp(context.Background()))
+	assert.Equal(t, 503, ready())
+
+	atomic.StoreInt32(&up, 1)
+	require.Nil(t, g.WarmUp(context.Background()))
+	assert.Equal(t, 200, ready())
+	_, _, err := g.getMethod("TestEndpoint2.Wat")
+	assert.Nil(t, err)
+
+	// the context cuts warming up short
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, g.WarmUp(ctx))
+}
+
+func TestAllowGET(t *T) {
+	g := newTestGateway(t)
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, httptest.NewRequest("GET", "/?"+query, nil))
+		return w
+	}
+	fooQuery := `method=TestEndpoint.Foo&params={"a":1}&id=5`
+
+	// not allowed at all by default
+	assert.Equal(t, 405, get(fooQuery).Code)
+
+	g.AllowGET = true
+	w := get(fooQuery)
+	assert.Equal(t, 200, w.Code)
+	var res FooRes
+	require.Nil(t, json2.DecodeClientResponse(w.Body, &res))
+	assert.Equal(t, int64(1), res.A)
+
+	// Bar isn't idempotent
+	assert.Equal(t, 405, get(`method=TestEndpoint.Bar&params={"a":1}`).Code)
+	assert.Equal(t, 405, get(`method=Nope.Nope`).Code)
+	assert.Equal(t, 400, get(`method=TestEndpoint.Foo&params={`).Code)
+
+	// unless the gateway marks it as such
+	g.MarkIdempotent("TestEndpoint.Bar")
+	assert.Equal(t, 200, get(`method=TestEndpoint.Bar&params={"a":1}`).Code)
+}
+
+func TestDeadLetter(t *T) {
+	ln, ch := newRefusingListener(t)
+	defer ln.Close()
+
+	g := newTestGateway(t)
+	g.Resolver = func(string) (string, error) {
+		return ln.Addr().String(), nil
+	}
+	g.Retries = 2
+	g.Backoff = func(int) time.Duration { return 0 }
+
+	var methods []string
+	var bodies [][]byte
+	g.DeadLetter = func(method string, body []byte) {
+		// all retries should have been made by the time this is called
+		assert.Len(t, ch, 3)
+		methods = append(methods, method)
+		bodies = append(bodies, body)
+	}
+
+	var res FooRes
+	// not eligible
+	assert.NotNil(t, rpcutil.JSONRPC2CallHandler(g, &res, "TestEndpoint.Foo", &FooArgs{A: 1}))
+	assert.Empty(t, methods)
+	for len(ch) > 0 {
+		<-ch
+	}
+
+	g.MarkDeadLetter("TestEndpoint.Foo")
+	assert.NotNil(t, rpcutil.JSONRPC2CallHandler(g, &res, "TestEndpoint.Foo", &FooArgs{A: 1}))
+	require.Len(t, methods, 1)
+	assert.Equal(t, "TestEndpoint.Foo", methods[0])
+	var req struct {
+		Method string  `json:"method"`
+		Params FooArgs `json:"params"`
+	}
+	require.Nil(t, json.Unmarshal(bodies[0], &req))
+	assert.Equal(t, "TestEndpoint.Foo", req.Method)
+	assert.Equal(t, int64(1), req.Params.A)
+}
+
+func TestBackendTLS(t *T) {
+	h := newBackendHandler(t, TestEndpoint{})
+
+	newServer := func(maxVersion uint16) *httptest.Server {
+		s := httptest.NewUnstartedServer(h)
+		s.TLS = &tls.Config{MinVersion: tls.VersionTLS10, MaxVersion: maxVersion}
+		s.StartTLS()
+		return s
+	}
+	oldServer := newServer(tls.VersionTLS11)
+	defer oldServer.Close()
+	newerServer := newServer(tls.VersionTLS12)
+	defer newerServer.Close()
+
+	g := NewGateway()
+	g.RegisterCodec(json2.NewCodec(), "application/json")
+
+	// insecure settings are rejected
+	assert.NotNil(t, g.SetBackendTLS(BackendTLSConfig{MinVersion: tls.VersionTLS11}))
+	assert.NotNil(t, g.SetBackendTLS(BackendTLSConfig{
+		CipherSuites: []uint16{tls.TLS_RSA_WITH_RC4_128_SHA},
+	}))
+
+	roots := x509.NewCertPool()
+	roots.AddCert(oldServer.Certificate())
+	roots.AddCert(newerServer.Certificate())
+	require.Nil(t, g.SetBackendTLS(BackendTLSConfig{RootCAs: roots}))
+
+	assert.NotNil(t, g.AddURL(oldServer.URL))
+	require.Nil(t, g.AddURL(newerServer.URL))
+
+	var res FooRes
+	require.Nil(t, rpcutil.JSONRPC2CallHandler(g, &res, "TestEndpoint.Foo", &FooArgs{A: 1}))
+	assert.Equal(t, int64(1), res.A)
+
+	// proxied paths use the same tls settings. The backend only accepts POSTs,
+	// so getting its 405 back means the request made it there
+	g.ProxyPath("/files/", "TestEndpoint")
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, httptest.NewRequest("GET", "/files/x", nil))
+	assert.Equal(t, 405, w.Code)
+}
+
+func TestInstanceCount(t *T) {
+	g := newTestGateway(t)
+	n, err := g.InstanceCount("TestEndpoint")
+	require.Nil(t, err)
+	assert.Equal(t, 1, n)
+
+	host := testURL[strings.Index(testURL, "://")+3:]
+	g.InstanceResolver = func(h string) ([]string, error) {
+		return []string{host, host, host}, nil
+	}
+	var res FooRes
+	require.Nil(t, rpcutil.JSONRPC2CallHandler(g, &res, "TestEndpoint.Foo", &FooArgs{A: 1}))
+	n, err = g.InstanceCount("TestEndpoint")
+	require.Nil(t, err)
+	assert.Equal(t, 3, n)
+
+	_, err = g.InstanceCount("Nope")
+	assert.NotNil(t, err)
+}
+
+func TestLogTarget(t *T) {
+	var logged []llog.KV
+	defer func(orig func(llog.KV)) { logForwarded = orig }(logForwarded)
+	logForwarded = func(kv llog.KV) {
+		logged = append(logged, copyKV(kv))
+	}
+
+	g := newTestGateway(t)
+	host := testURL[strings.Index(testURL, "://")+3:]
+	g.InstanceResolver = func(h string) ([]string, error) {
+		return []string{host}, nil
+	}
+	var res FooRes
+	require.Nil(t, rpcutil.JSONRPC2CallHandler(g, &res, "TestEndpoint.Foo", &FooArgs{A: 1}))
+	require.Len(t, logged, 1)
+	assert.Equal(t, host, logged[0]["target"])
+	assert.Equal(t, "TestEndpoint.Foo", logged[0]["method"])
+}
+
+func TestLBStrategy(t *T) {
+	g := newTestGateway(t)
+	addrs := []string{"c:1", "a:1", "b:1"}
+	g.InstanceResolver = func(h string) ([]string, error) {
+		return addrs, nil
+	}
+	uu, err := url.Parse("http://backend/")
+	require.Nil(t, err)
+	pick := func() string {
+		u, err := g.resolveURL(uu)
+		require.Nil(t, err)
+		return u.Host
+	}
+
+	// random should hit every instance eventually
+	seen := map[string]int{}
+	for i := 0; i < 300; i++ {
+		seen[pick()]++
+	}
+	assert.Len(t, seen, 3)
+	for _, addr := range addrs {
+		assert.True(t, seen[addr] > 50, "addr: %q picked %d times", addr, seen[addr])
+	}
+
+	g.LBStrategy = LBRoundRobin
+	var picked []string
+	for i := 0; i < 6; i++ {
+		picked = append(picked, pick())
+	}
+	assert.Equal(t, []string{"a:1", "b:1", "c:1", "a:1", "b:1", "c:1"}, picked)
+}
+
+func TestResolveMode(t *T) {
+	g := newTestGateway(t)
+	var lookups []string
+	dnsFails := false
+	g.dnsLookup = func(h string) ([]string, error) {
+		lookups = append(lookups, "dns")
+		if dnsFails {
+			return nil, errors.New("no such host")
+		}
+		return []string{h}, nil
+	}
+	srvFails, srvMissing := false, false
+	g.srvLookup = func(h string) ([]string, error) {
+		lookups = append(lookups, "srv")
+		if srvFails {
+			return nil, errors.New("srv lookup failed")
+		} else if srvMissing {
+			return nil, nil
+		}
+		return []string{h}, nil
+	}
+	uu, err := url.Parse(testURL)
+	require.Nil(t, err)
+
+	assertLookups := func(mode ResolveMode, expErr bool, exp ...string) {
+		// if the host can't be resolved then adding it fails, but the mode is
+		// still set
+		err := g.AddURLResolveMode(testURL, mode)
+		assert.Equal(t, expErr, err != nil, "mode: %d", mode)
+		lookups = nil
+		u, err := g.resolveURL(uu)
+		if expErr {
+			assert.NotNil(t, err, "mode: %d", mode)
+		} else {
+			require.Nil(t, err, "mode: %d", mode)
+			assert.Equal(t, uu.Host, u.Host, "mode: %d", mode)
+		}
+		assert.Equal(t, exp, lookups, "mode: %d", mode)
+	}
+
+	assertLookups(ResolveSRVFirst, false, "srv")
+	assertLookups(ResolveDNSFirst, false, "dns")
+	assertLookups(ResolveDNSOnly, false, "dns")
+
+	dnsFails = true
+	assertLookups(ResolveSRVFirst, false, "srv")
+	assertLookups(ResolveDNSFirst, false, "dns", "srv")
+	assertLookups(ResolveDNSOnly, true, "dns")
+
+	// hosts without srv records are used as-is, unless they also failed a dns
+	// lookup
+	srvMissing = true
+	assertLookups(ResolveSRVFirst, false, "srv")
+	assertLookups(ResolveDNSFirst, true, "dns", "srv")
+
+	srvFails = true
+	assertLookups(ResolveSRVFirst, true, "srv")
+	dnsFails = false
+	assertLookups(ResolveDNSFirst, false, "dns")
+}
+
+func TestRootHealthCheck(t *T) {
+	g := newTestGateway(t)
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		return w
+	}
+
+	assert.Equal(t, 405, get("/").Code)
+
+	g.RootHealthCheck = true
+	assert.Equal(t, 200, get("/").Code)
+	assert.Equal(t, 405, get("/foo").Code)
+
+	// rpc calls are unaffected
+	g.AllowGET = true
+	w := get("/?method=TestEndpoint.Foo&params={\"a\":1}")
+	assert.Equal(t, 200, w.Code)
+	var res FooRes
+	require.Nil(t, json2.DecodeClientResponse(w.Body, &res))
+	assert.Equal(t, int64(1), res.A)
+
+	res = FooRes{}
+	require.Nil(t, rpcutil.JSONRPC2CallHandler(g, &res, "TestEndpoint.Foo", &FooArgs{A: 2}))
+	assert.Equal(t, int64(2), res.A)
+}
+
+func TestSlowestRequests(t *T) {
+	g := newTestGateway(t)
+	g.SlowRequestsSize = 2
+	for _, ms := range []int{30, 1, 60, 10} {
+		callRaw(t, g, "SlowEndpoint.Sleep", &SleepArgs{Ms: ms})
+	}
+
+	slowest := g.SlowestRequests()
+	require.Len(t, slowest, 2)
+	assert.Equal(t, "SlowEndpoint.Sleep", slowest[0].Method)
+	assert.Equal(t, 200, slowest[0].Status)
+	assert.NotEmpty(t, slowest[0].Backend)
+	assert.True(t, slowest[0].Duration >= 60*time.Millisecond)
+	assert.True(t, slowest[1].Duration >= 30*time.Millisecond)
+	assert.True(t, slowest[1].Duration < 60*time.Millisecond)
+
+	// old requests are dropped
+	g.SlowRequestsWindow = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	assert.Empty(t, g.SlowestRequests())
+}
+
+func TestPoolStats(t *T) {
+	g := newTestGateway(t)
+	const n = 5
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			callRaw(t, g, "SlowEndpoint.Sleep", &SleepArgs{Ms: 200})
+		}()
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for g.PoolStats()["SlowEndpoint"].InFlight < n && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, int64(n), g.PoolStats()["SlowEndpoint"].InFlight)
+
+	wg.Wait()
+	ps := g.PoolStats()["SlowEndpoint"]
+	assert.Equal(t, int64(0), ps.InFlight)
+	assert.Equal(t, int64(n), ps.Requests)
+	assert.Equal(t, int64(0), ps.Retries)
+}
+
+func TestCircuitBreaker(t *T) {
+	ln, ch := newRefusingListener(t)
+	defer ln.Close()
+
+	g := newTestGateway(t)
+	g.BreakerThreshold = 2
+	g.BreakerCooldown = 100 * time.Millisecond
+	var failing int32 = 1
+	g.Resolver = func(host string) (string, error) {
+		if atomic.LoadInt32(&failing) == 1 {
+			return ln.Addr().String(), nil
+		}
+		return host, nil
+	}
+	args := FooArgs{A: 1, B: "one"}
+
+	var res FooRes
+	for i := 0; i < 2; i++ {
+		assert.NotNil(t, rpcutil.JSONRPC2CallHandler(g, &res, "TestEndpoint.Foo", &args))
+	}
+	assert.Len(t, ch, 2)
+	assert.True(t, g.PoolStats()["TestEndpoint"].BreakerOpen)
+
+	// while open the backend isn't contacted
+	rec := callRaw(t, g, "TestEndpoint.Foo", &args)
+	assert.Equal(t, 503, rec.Code)
+	assert.Len(t, ch, 2)
+
+	// or the request goes to the BackupHandler, if there is one
+	var backupCalls int32
+	g.BackupHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&backupCalls, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","result":{},"id":1}`))
+	})
+	rec = callRaw(t, g, "TestEndpoint.Foo", &args)
+	assert.Equal(t, 200, rec.Code)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&backupCalls))
+	g.BackupHandler = nil
+
+	// once the cooldown passes a probe is let through, which closes the
+	// breaker if it succeeds
+	atomic.StoreInt32(&failing, 0)
+	time.Sleep(150 * time.Millisecond)
+	require.Nil(t, rpcutil.JSONRPC2CallHandler(g, &res, "TestEndpoint.Foo", &args))
+	assert.Equal(t, args, res.FooArgs)
+	assert.False(t, g.PoolStats()["TestEndpoint"].BreakerOpen)
+	require.Nil(t, rpcutil.JSONRPC2CallHandler(g, &res, "TestEndpoint.Foo", &args))
+
+	// a probe whose client goes away doesn't keep others from being let through
+	atomic.StoreInt32(&failing, 1)
+	for i := 0; i < 2; i++ {
+		assert.NotNil(t, rpcutil.JSONRPC2CallHandler(g, &res, "TestEndpoint.Foo", &args))
+	}
+	require.True(t, g.PoolStats()["TestEndpoint"].BreakerOpen)
+	atomic.StoreInt32(&failing, 0)
+	time.Sleep(150 * time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	g.ServeHTTP(httptest.NewRecorder(), newRawRequest(t, "TestEndpoint.Foo", &args).WithContext(ctx))
+	require.Nil(t, rpcutil.JSONRPC2CallHandler(g, &res, "TestEndpoint.Foo", &args))
+	assert.False(t, g.PoolStats()["TestEndpoint"].BreakerOpen)
+}
+
+func TestCircuitBreakerBackendErrors(t *T) {
+	var calls int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(500)
+		w.Write([]byte(`{"jsonrpc":"2.0","error":{"code":-32000,"message":"down"},"id":1}`))
+	}))
+	defer s.Close()
+
+	g := newTestGateway(t)
+	g.BreakerThreshold = 2
+	g.Resolver = func(string) (string, error) {
+		return s.Listener.Addr().String(), nil
+	}
+
+	var res FooRes
+	for i := 0; i < 2; i++ {
+		assert.NotNil(t, rpcutil.JSONRPC2CallHandler(g, &res, "TestEndpoint.Foo", &FooArgs{A: 1}))
+	}
+	assert.True(t, g.PoolStats()["TestEndpoint"].BreakerOpen)
+
+	rec := callRaw(t, g, "TestEndpoint.Foo", &FooArgs{A: 1})
+	assert.Equal(t, 503, rec.Code)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
+
+func TestRejectLegacyProtocol(t *T) {
+	g := newTestGateway(t)
+	body := `{"method":"TestEndpoint.Foo","params":[{"A":1,"B":"one"}],"id":7}`
+	call := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, newBodyRequest(t, body))
+		return rec
+	}
+
+	g.RejectLegacyProtocol = true
+	rec := call()
+	assert.Equal(t, 426, rec.Code)
+	var res struct {
+		Error *json2.Error    `json:"error"`
+		ID    json.RawMessage `json:"id"`
+	}
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&res))
+	require.NotNil(t, res.Error)
+	assert.Equal(t, errLegacyProtocol.Message, res.Error.Message)
+	assert.Equal(t, "7", string(res.ID))
+
+	// 2.0 requests are unaffected
+	var fooRes FooRes
+	args := FooArgs{A: 1, B: "one"}
+	require.Nil(t, rpcutil.JSONRPC2CallHandler(g, &fooRes, "TestEndpoint.Foo", &args))
+	assert.Equal(t, args, fooRes.FooArgs)
+
+	g.RejectLegacyProtocol = false
+	assert.NotEqual(t, 426, call().Code)
+}
+
+type Color string
+
+type ColorEndpoint struct{}
+
+func (ColorEndpoint) Paint(r *http.Request, args *struct{ Colors []Color }, _ *struct{}) error {
+	return nil
+}
+
+func TestEnumPassthrough(t *T) {
+	h := gatewayrpc.NewServer()
+	require.Nil(t, h.RegisterEnum(reflect.TypeOf(Color("")), []string{"red", "blue"}))
+	require.Nil(t, h.RegisterService(ColorEndpoint{}, ""))
+	h.RegisterCodec(json2.NewCodec(), "application/json")
+	s := httptest.NewServer(h)
+	defer s.Close()
+
+	g := NewGateway()
+	require.Nil(t, g.AddURL(s.URL))
+	_, m, err := g.getMethod("ColorEndpoint.Paint")
+	require.Nil(t, err)
+	assert.Equal(t, []string{"red", "blue"}, m.Args.ObjectOf["Colors"].ArrayOf.Enum)
+}
+
+func TestCatalog(t *T) {
+	g := newTestGateway(t)
+	catalog := g.Catalog()
+	require.NotEmpty(t, catalog)
+	var cs CatalogService
+	for _, cs = range catalog {
+		if cs.Name == "TestEndpoint" {
+			break
+		}
+	}
+	require.Equal(t, "TestEndpoint", cs.Name)
+	assert.Equal(t, testURL, cs.Backend)
+
+	// changing the snapshot doesn't affect the gateway
+	foo := cs.Methods["Foo"]
+	kind := foo.Args.ObjectOf["a"].TypeOf
+	foo.Args.ObjectOf["a"].TypeOf = reflect.Map
+	delete(cs.Methods, "Bar")
+	_, m, err := g.getMethod("TestEndpoint.Foo")
+	require.Nil(t, err)
+	assert.Equal(t, kind, m.Args.ObjectOf["a"].TypeOf)
+	_, _, err = g.getMethod("TestEndpoint.Bar")
+	assert.Nil(t, err)
+
+	// and changing the gateway doesn't affect the snapshot
+	h := newBackendHandler(t)
+	require.Nil(t, h.RegisterService(ShardEndpoint{}, "CatalogEndpoint"))
+	s := httptest.NewServer(h)
+	defer s.Close()
+	require.Nil(t, g.AddURL(s.URL))
+	assert.Len(t, g.Catalog(), len(catalog)+1)
+	for _, cs := range catalog {
+		assert.NotEqual(t, "CatalogEndpoint", cs.Name)
+	}
+
+	b, err := g.MarshalCatalog(func(services []CatalogService) ([]byte, error) {
+		return json.Marshal(services)
+	})
+	require.Nil(t, err)
+	assert.Contains(t, string(b), `"name":"CatalogEndpoint"`)
+}
+
+func TestRouteBySize(t *T) {
+	newPool := func(name string) *httptest.Server {
+		return httptest.NewServer(newBackendHandler(t, ShardEndpoint{items: []string{name}}))
+	}
+	shared := newPool("shared")
+	defer shared.Close()
+	large := newPool("large")
+	defer large.Close()
+
+	g := newURLGateway(t, shared.URL)
+	require.Nil(t, g.RouteBySize("ShardEndpoint.List", 100, large.URL))
+
+	call := func(padding int) []string {
+		args := map[string]string{"padding": strings.Repeat("a", padding)}
+		w := callRaw(t, g, "ShardEndpoint.List", args)
+		var res []string
+		require.Nil(t, json2.DecodeClientResponse(w.Body, &res))
+		return res
+	}
+	assert.Equal(t, []string{"shared"}, call(1))
+	assert.Equal(t, []string{"large"}, call(200))
+
+	// failing to resolve the large backend is reported like any other
+	// resolve error
+	largeHost := large.Listener.Addr().String()
+	g.Resolver = func(host string) (string, error) {
+		if host == largeHost {
+			return "", errors.New("no such host")
+		}
+		return host, nil
+	}
+	var resolveErrs []string
+	g.OnResolveError = func(service string, err error) {
+		resolveErrs = append(resolveErrs, service)
+	}
+	args := map[string]string{"padding": strings.Repeat("a", 200)}
+	w := callRaw(t, g, "ShardEndpoint.List", args)
+	var res []string
+	err := json2.DecodeClientResponse(w.Body, &res)
+	require.NotNil(t, err)
+	assert.Equal(t, errResolve.Message, err.Error())
+	assert.Equal(t, []string{"ShardEndpoint"}, resolveErrs)
+}
+
+func TestCodecMismatch(t *T) {
+	h := gatewayrpc.NewServer()
+	require.Nil(t, h.RegisterService(TestEndpoint{}, ""))
+	h.RegisterCodec(json2.NewCodec(), "application/x-msgpack")
+	var calls int
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the backend only has one codec, so it'll use it for requests
+		// without a Content-Type, which lets the gateway discover it
+		calls++
+		r.Header.Del("Content-Type")
+		h.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+
+	g := newURLGateway(t, s.URL)
+
+	var res FooRes
+	err := rpcutil.JSONRPC2CallHandler(g, &res, "TestEndpoint.Foo", &FooArgs{A: 1})
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), `codec mismatch: backend for TestEndpoint doesn't accept "application/json"`)
+	// the request was never forwarded
+	assert.Equal(t, 1, calls)
+
+	// backends which accept the codec are unaffected
+	res = FooRes{}
+	require.Nil(t, rpcutil.JSONRPC2CallHandler(testGateway, &res, "TestEndpoint.Foo", &FooArgs{A: 1}))
+	assert.Equal(t, int64(1), res.A)
+}
+
+// base64Codec is a codec which isn't json, for testing ClientCodec. It's json2
+// with the entire body base64 encoded
+type base64Codec struct{}
+
+func (base64Codec) NewRequest(r *http.Request) rpc.CodecRequest {
+	r.Body = ioutil.NopCloser(base64.NewDecoder(base64.StdEncoding, r.Body))
+	return base64CodecRequest{json2.NewCodec().NewRequest(r)}
+}
+
+func (base64Codec) EncodeClientRequest(method string, args interface{}) ([]byte, error) {
+	b, err := json2.EncodeClientRequest(method, args)
+	return []byte(base64.StdEncoding.EncodeToString(b)), err
+}
+
+func (base64Codec) DecodeClientResponse(r io.Reader, reply interface{}) error {
+	return json2.DecodeClientResponse(base64.NewDecoder(base64.StdEncoding, r), reply)
+}
+
+type base64CodecRequest struct {
+	rpc.CodecRequest
+}
+
+func (cr base64CodecRequest) WriteResponse(w http.ResponseWriter, reply interface{}) {
+	rec := httptest.NewRecorder()
+	cr.CodecRequest.WriteResponse(rec, reply)
+	io.WriteString(w, base64.StdEncoding.EncodeToString(rec.Body.Bytes()))
+}
+
+func (cr base64CodecRequest) WriteError(w http.ResponseWriter, status int, err error) {
+	rec := httptest.NewRecorder()
+	cr.CodecRequest.WriteError(rec, status, err)
+	io.WriteString(w, base64.StdEncoding.EncodeToString(rec.Body.Bytes()))
+}
+
+func TestClientCodec(t *T) {
+	const ct = "application/x-base64"
+	h := newBackendHandler(t, TestEndpoint{})
+	h.RegisterCodec(base64Codec{}, ct)
+	s := httptest.NewServer(h)
+	defer s.Close()
+
+	g := NewGateway()
+	g.RegisterCodec(json2.NewCodec(), "application/json")
+	g.RegisterCodec(base64Codec{}, ct)
+	require.Nil(t, g.AddURL(s.URL))
+
+	args := FooArgs{A: 4, B: "four"}
+	b, err := base64Codec{}.EncodeClientRequest("TestEndpoint.Foo", &args)
+	require.Nil(t, err)
+	r := newBodyRequest(t, string(b))
+	r.Header.Set("Content-Type", ct)
+	rec := httptest.NewRecorder()
+	g.ServeHTTP(rec, r)
+
+	var res FooRes
+	require.Nil(t, base64Codec{}.DecodeClientResponse(rec.Body, &res))
+	assert.Equal(t, args, res.FooArgs)
+
+	// json requests still work alongside it
+	res = FooRes{}
+	require.Nil(t, rpcutil.JSONRPC2CallHandler(g, &res, "TestEndpoint.Foo", &args))
+	assert.Equal(t, args, res.FooArgs)
+}
+
+func TestAuditSink(t *T) {
+	g := newTestGateway(t)
+	g.RequestCallback = func(r *Request) {
+		r.SetPrincipal(r.Header.Get("X-User"))
+	}
+	var records []AuditRecord
+	g.AuditSink = func(rec AuditRecord) {
+		records = append(records, rec)
+	}
+
+	call := func(method string, args interface{}) {
+		r := newRawRequest(t, method, args)
+		r.Header.Set("X-User", "alice")
+		g.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	start := time.Now()
+	call("TestEndpoint.Bar", &BarArgs{A: 1})
+	call("TestEndpoint.Foo", &FooArgs{A: 1})
+	require.Len(t, records, 1)
+	rec := records[0]
+	assert.Equal(t, "TestEndpoint.Bar", rec.Method)
+	assert.Equal(t, "alice", rec.Principal)
+	assert.Nil(t, rec.Err)
+	assert.False(t, rec.Time.Before(start))
+	assert.NotEmpty(t, rec.ParamsHash)
+
+	// the same params hash the same
+	call("TestEndpoint.Bar", &BarArgs{A: 1})
+	call("TestEndpoint.Bar", &BarArgs{A: 2})
+	require.Len(t, records, 3)
+	assert.Equal(t, rec.ParamsHash, records[1].ParamsHash)
+	assert.NotEqual(t, rec.ParamsHash, records[2].ParamsHash)
+}
+
+func TestBackendPath(t *T) {
+	h := newBackendHandler(t, TestEndpoint{})
+	var paths []string
+	mux := http.NewServeMux()
+	mux.Handle("/api/rpc", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.RequestURI())
+		h.ServeHTTP(w, r)
+	}))
+	s := httptest.NewServer(mux)
+	defer s.Close()
+
+	g := NewGateway()
+	g.RegisterCodec(json2.NewCodec(), "application/json")
+	require.Nil(t, g.AddURL(s.URL+"/api/rpc?v=1"))
+
+	r, err := http.NewRequest("POST", "/other/path?x=y", nil)
+	require.Nil(t, err)
+	body, err := json2.EncodeClientRequest("TestEndpoint.Foo", &FooArgs{A: 1})
+	require.Nil(t, err)
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, r)
+
+	var res FooRes
+	require.Nil(t, json2.DecodeClientResponse(w.Body, &res))
+	assert.Equal(t, int64(1), res.A)
+	assert.Equal(t, []string{"/api/rpc?v=1", "/api/rpc?v=1"}, paths)
+
+	u, err := g.GetMethodURL("TestEndpoint.Foo")
+	require.Nil(t, err)
+	assert.Equal(t, "/api/rpc", u.Path)
+	assert.Equal(t, "v=1", u.RawQuery)
+}
+
+func TestRemoveURL(t *T) {
+	g := newTestGateway(t)
+	_, _, err := g.getMethod("TestEndpoint.Foo")
+	require.Nil(t, err)
+
+	require.Nil(t, g.RemoveURL(testURL))
+	_, _, err = g.getMethod("TestEndpoint.Foo")
+	assert.NotNil(t, err)
+	_, _, err = g.getMethod("SlowEndpoint.Sleep")
+	assert.NotNil(t, err)
+	assert.NotNil(t, g.RemoveURL(testURL))
+
+	// removing one of several tagged urls leaves the others
+	newRegion := func(region string) *httptest.Server {
+		return httptest.NewServer(newBackendHandler(t, ShardEndpoint{items: []string{region}}))
+	}
+	us := newRegion("us")
+	defer us.Close()
+	eu := newRegion("eu")
+	defer eu.Close()
+	require.Nil(t, g.AddURLTagged(us.URL, map[string]string{"region": "us"}))
+	require.Nil(t, g.AddURLTagged(eu.URL, map[string]string{"region": "eu"}))
+
+	require.Nil(t, g.RemoveURL(eu.URL))
+	var res []string
+	require.Nil(t, json2.DecodeClientResponse(callRaw(t, g, "ShardEndpoint.List", &struct{}{}).Body, &res))
+	assert.Equal(t, []string{"us"}, res)
+}
+
+// roundTripperFunc implements http.RoundTripper
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestSetRoundTripper(t *T) {
+	h := newBackendHandler(t, TestEndpoint{})
+
+	type outbound struct {
+		url    string
+		header http.Header
+		body   []byte
+	}
+	var reqs []outbound
+	g := NewGateway()
+	g.RegisterCodec(json2.NewCodec(), "application/json")
+	g.SetRoundTripper(roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		reqs = append(reqs, outbound{r.URL.String(), r.Header, body})
+
+		// pass the request to the backend in-process, rather than over the
+		// network
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		return rec.Result(), nil
+	}))
+	require.Nil(t, g.AddURL("backend.invalid/rpc"))
+	require.Len(t, reqs, 1)
+	assert.Equal(t, "http://backend.invalid/rpc", reqs[0].url)
+
+	r := newRawRequest(t, "TestEndpoint.Foo", &FooArgs{A: 1, B: "one"})
+	r.Header.Set("X-Custom", "yes")
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, r)
+	var res FooRes
+	require.Nil(t, json2.DecodeClientResponse(w.Body, &res))
+	assert.Equal(t, FooArgs{A: 1, B: "one"}, res.FooArgs)
+
+	require.Len(t, reqs, 2)
+	assert.Equal(t, "http://backend.invalid/rpc", reqs[1].url)
+	assert.Equal(t, "yes", reqs[1].header.Get("X-Custom"))
+	var sent struct {
+		Method string  `json:"method"`
+		Params FooArgs `json:"params"`
+	}
+	require.Nil(t, json.Unmarshal(reqs[1].body, &sent))
+	assert.Equal(t, "TestEndpoint.Foo", sent.Method)
+	assert.Equal(t, FooArgs{A: 1, B: "one"}, sent.Params)
+}
+
+func TestRefreshConcurrency(t *T) {
+	var blocking, inFlight, calls int32
+	release := make(chan struct{})
+	started := make(chan struct{}, 10)
+	newBackend := func(name string) *httptest.Server {
+		h := newBackendHandler(t)
+		require.Nil(t, h.RegisterService(ShardEndpoint{}, name))
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.LoadInt32(&blocking) == 1 {
+				atomic.AddInt32(&calls, 1)
+				atomic.AddInt32(&inFlight, 1)
+				started <- struct{}{}
+				<-release
+				atomic.AddInt32(&inFlight, -1)
+			}
+			h.ServeHTTP(w, r)
+		}))
+	}
+
+	g := NewGateway()
+	g.RegisterCodec(json2.NewCodec(), "application/json")
+	g.RefreshConcurrency = 2
+	for _, name := range []string{"RefreshA", "RefreshB", "RefreshC"} {
+		s := newBackend(name)
+		defer s.Close()
+		require.Nil(t, g.AddURL(s.URL))
+	}
+
+	atomic.StoreInt32(&blocking, 1)
+	done := make(chan struct{})
+	go func() {
+		g.refreshURLs()
+		close(done)
+	}()
+	<-started
+	<-started
+	// the third url waits for one of the first two
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&inFlight))
+
+	// a second cycle doesn't start while the first is running
+	g.refreshURLs()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+
+	close(release)
+	<-done
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+}
+
+func TestForwardHeaders(t *T) {
+	h := newBackendHandler(t, TestEndpoint{})
+	var l sync.Mutex
+	var got http.Header
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l.Lock()
+		got = r.Header
+		l.Unlock()
+		h.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+
+	g := newURLGateway(t, s.URL)
+
+	call := func() http.Header {
+		r := newRawRequest(t, "TestEndpoint.Foo", &FooArgs{A: 1})
+		r.Header.Set("Authorization", "Bearer abc")
+		r.Header.Set("Connection", "keep-alive, X-Hop")
+		r.Header.Set("X-Hop", "1")
+		r.Header.Set("X-Other", "1")
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, r)
+		require.Equal(t, 200, rec.Code)
+		l.Lock()
+		defer l.Unlock()
+		return got
+	}
+
+	hdr := call()
+	assert.Equal(t, "Bearer abc", hdr.Get("Authorization"))
+	assert.Equal(t, "1", hdr.Get("X-Other"))
+	assert.Empty(t, hdr.Get("Connection"))
+	assert.Empty(t, hdr.Get("X-Hop"))
+
+	g.ForwardHeaders = []string{"authorization"}
+	hdr = call()
+	assert.Equal(t, "Bearer abc", hdr.Get("Authorization"))
+	assert.NotEmpty(t, hdr.Get(DefaultRequestIDHeader))
+	assert.Empty(t, hdr.Get("X-Other"))
+	assert.Empty(t, hdr.Get("X-Hop"))
+
+	// the headers the gateway sets can't be stripped by listing them in
+	// Connection
+	g.ForwardHeaders = nil
+	g.RealIPHeader = "X-Real-IP"
+	r := newRawRequest(t, "TestEndpoint.Foo", &FooArgs{A: 1})
+	r.RemoteAddr = "1.2.3.4:1234"
+	r.Header.Set("Connection", "X-Forwarded-For, X-Real-IP, "+DefaultRequestIDHeader)
+	rec := httptest.NewRecorder()
+	g.ServeHTTP(rec, r)
+	require.Equal(t, 200, rec.Code)
+	l.Lock()
+	defer l.Unlock()
+	assert.Equal(t, "1.2.3.4", got.Get("X-Forwarded-For"))
+	assert.Equal(t, "1.2.3.4", got.Get("X-Real-IP"))
+	assert.NotEmpty(t, got.Get(DefaultRequestIDHeader))
+}
+
+func TestMaxRefreshFailures(t *T) {
+	h := newBackendHandler(t)
+	require.Nil(t, h.RegisterService(ShardEndpoint{}, "RefreshEndpoint"))
+	s := httptest.NewServer(h)
+
+	g := newTestGateway(t)
+	require.Nil(t, g.AddURL(s.URL))
+	_, _, err := g.getMethod("RefreshEndpoint.List")
+	require.Nil(t, err)
+
+	s.Close()
+	g.refreshURLs()
+	g.refreshURLs()
+	_, _, err = g.getMethod("RefreshEndpoint.List")
+	require.Nil(t, err)
+
+	// a successful refresh resets the count
+	g.refreshed(s.URL, nil, nil)
+	g.refreshURLs()
+	g.refreshURLs()
+	_, _, err = g.getMethod("RefreshEndpoint.List")
+	require.Nil(t, err)
+
+	g.refreshURLs()
+	_, _, err = g.getMethod("RefreshEndpoint.List")
+	assert.NotNil(t, err)
+
+	// other backends are unaffected
+	_, _, err = g.getMethod("TestEndpoint.Foo")
+	assert.Nil(t, err)
+
+	// the services are added back once the url recovers
+	ln, err := net.Listen("tcp", s.Listener.Addr().String())
+	require.Nil(t, err)
+	s = httptest.NewUnstartedServer(h)
+	s.Listener.Close()
+	s.Listener = ln
+	s.Start()
+	defer s.Close()
+	g.refreshURLs()
+	_, _, err = g.getMethod("RefreshEndpoint.List")
+	assert.Nil(t, err)
+}
+
+func TestBatchIDs(t *T) {
+	// the earlier requests take longer, so finish last
+	body := `[
+		{"jsonrpc":"2.0","method":"SlowEndpoint.Sleep","params":{"ms":50},"id":1},
+		{"jsonrpc":"2.0","method":"SlowEndpoint.Sleep","params":{"ms":30},"id":"two"},
+		{"jsonrpc":"2.0","method":"SlowEndpoint.Sleep","params":{"ms":10},"id":null},
+		{"jsonrpc":"2.0","method":"Nope.Nope","params":{},"id":4},
+		{"jsonrpc":"2.0","method":"SlowEndpoint.Sleep","params":{"ms":1}}
+	]`
+	g := newTestGateway(t)
+	r := httptest.NewRequest("POST", "/", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, r)
+
+	var ress []struct {
+		ID     json.RawMessage `json:"id"`
+		Result json.RawMessage `json:"result"`
+		Error  *json2.Error    `json:"error"`
+	}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &ress))
+	// the notification has no response
+	require.Len(t, ress, 4)
+	for i, id := range []string{`1`, `"two"`, `null`, `4`} {
+		assert.Equal(t, id, string(ress[i].ID), "response %d", i)
+		if i < 3 {
+			assert.Nil(t, ress[i].Error, "response %d", i)
+			assert.Equal(t, `{}`, string(ress[i].Result), "response %d", i)
+		}
+	}
+	require.NotNil(t, ress[3].Error)
+	assert.Equal(t, json2.E_SERVER, ress[3].Error.Code)
+}
+
+func TestDrainBackend(t *T) {
+	newRegion := func(region string) *httptest.Server {
+		return httptest.NewServer(newBackendHandler(t, ShardEndpoint{items: []string{region}}))
+	}
+	us := newRegion("us")
+	defer us.Close()
+	eu := newRegion("eu")
+	defer eu.Close()
+
+	g := NewGateway()
+	g.RegisterCodec(json2.NewCodec(), "application/json")
+	require.Nil(t, g.AddURLTagged(us.URL, map[string]string{"region": "us"}))
+	require.Nil(t, g.AddURLTagged(eu.URL, map[string]string{"region": "eu"}))
+
+	call := func() ([]string, int, error) {
+		w := callRaw(t, g, "ShardEndpoint.List", &struct{}{})
+		var res []string
+		err := json2.DecodeClientResponse(w.Body, &res)
+		return res, w.Code, err
+	}
+
+	res, _, err := call()
+	require.Nil(t, err)
+	assert.Equal(t, []string{"eu"}, res)
+
+	g.DrainBackend(eu.URL)
+	res, _, err = call()
+	require.Nil(t, err)
+	assert.Equal(t, []string{"us"}, res)
+
+	g.DrainBackend(us.URL)
+	_, code, err := call()
+	assert.Equal(t, 503, code)
+	require.NotNil(t, err)
+	assert.Equal(t, errBackendDrained.Message, err.Error())
+
+	g.UndrainBackend(eu.URL)
+	res, _, err = call()
+	require.Nil(t, err)
+	assert.Equal(t, []string{"eu"}, res)
+}
+
+func TestSetRefreshInterval(t *T) {
+	h := newBackendHandler(t, TestEndpoint{})
+	var refreshes int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&refreshes, 1)
+		h.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+
+	g := NewGateway()
+	g.RegisterCodec(json2.NewCodec(), "application/json")
+	g.SetRefreshInterval(time.Millisecond)
+	require.Nil(t, g.AddURL(s.URL))
+	require.Equal(t, int32(1), atomic.LoadInt32(&refreshes))
+
+	time.Sleep(5 * time.Millisecond)
+	// the request itself doesn't go to the backend, so any calls are from the
+	// refresh
+	g.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("OPTIONS", "/", nil))
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&refreshes) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	assert.True(t, atomic.LoadInt32(&refreshes) >= 2)
+
+	// refreshes can be disabled
+	g.SetRefreshInterval(0)
+	n := atomic.LoadInt32(&refreshes)
+	time.Sleep(5 * time.Millisecond)
+	g.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("OPTIONS", "/", nil))
+	time.Sleep(5 * time.Millisecond)
+	assert.Equal(t, n, atomic.LoadInt32(&refreshes))
+}
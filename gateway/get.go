@@ -0,0 +1,60 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+// getToPost converts a GET rpc request into the equivalent POST one, returning
+// the http status to respond with if it can't be
+func (g *Gateway) getToPost(r *http.Request) (int, error) {
+	q := r.URL.Query()
+	method := q.Get("method")
+	if method == "" {
+		return 400, errors.New("missing method")
+	}
+
+	lookup := method
+	if to, ok := g.getAlias(method); ok {
+		lookup = to
+	}
+	_, m, err := g.getMethod(lookup)
+	if err != nil || !(m.Idempotent || g.isIdempotent(lookup)) {
+		return 405, fmt.Errorf("method %q may not be called using GET", method)
+	}
+
+	id := q.Get("id")
+	if id == "" {
+		id = "1"
+	} else if !json.Valid([]byte(id)) {
+		id = strconv.Quote(id)
+	}
+	req := map[string]json.RawMessage{
+		"jsonrpc": json.RawMessage(`"2.0"`),
+		"method":  json.RawMessage(strconv.Quote(method)),
+		"id":      json.RawMessage(id),
+	}
+	if params := q.Get("params"); params != "" {
+		if !json.Valid([]byte(params)) {
+			return 400, errors.New("params must be valid json")
+		}
+		req["params"] = json.RawMessage(params)
+	}
+
+	b, err := json.Marshal(req)
+	if err != nil {
+		return 500, err
+	}
+	r.Method = "POST"
+	r.Body = ioutil.NopCloser(bytes.NewBuffer(b))
+	r.ContentLength = int64(len(b))
+	if r.Header.Get("Content-Type") == "" {
+		r.Header.Set("Content-Type", defaultContentType)
+	}
+	return 0, nil
+}
@@ -0,0 +1,200 @@
+// Package grpcweb implements an http.Handler which accepts unary gRPC-Web
+// requests, transcodes them into JSON RPC2 requests, and passes them on to
+// another handler (usually a gateway.Gateway). The response is transcoded back
+// into gRPC-Web.
+//
+// Since the gatewaytypes descriptors don't contain protobuf field numbers, the
+// protobuf messages for each method must be described by hand using Message.
+// Only flat messages made up of scalar fields are currently supported.
+package grpcweb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/rpc/v2/json2"
+	"github.com/levenlabs/go-llog"
+)
+
+// Field describes a single scalar field of a protobuf message. Supported Kinds
+// are Bool, Int32, Int64, Uint32, Uint64, Float32, Float64 and String. Signed
+// integers are expected to use the normal (not zig-zag) varint encoding
+type Field struct {
+	Number int
+	Name   string // the field's key in the json object
+	Kind   reflect.Kind
+}
+
+// Message describes a protobuf message
+type Message []Field
+
+// Method describes a single gRPC method and the JSON RPC2 method it maps to
+type Method struct {
+	// RPCMethod is the JSON RPC2 method ("Service.MethodName") to call
+	RPCMethod string
+	Request   Message
+	Response  Message
+}
+
+// gRPC status codes used by Handler
+const (
+	codeOK              = 0
+	codeUnknown         = 2
+	codeInvalidArgument = 3
+	codeUnimplemented   = 12
+)
+
+// Handler is an http.Handler which transcodes gRPC-Web requests into JSON RPC2
+// requests, which are passed onto its underlying handler
+type Handler struct {
+	handler http.Handler
+	methods map[string]Method
+	mutex   sync.RWMutex
+}
+
+// NewHandler returns a Handler which will pass transcoded requests to the
+// given handler
+func NewHandler(h http.Handler) *Handler {
+	return &Handler{
+		handler: h,
+		methods: map[string]Method{},
+	}
+}
+
+// RegisterMethod registers the gRPC method with the given path (e.g.
+// "/pkg.Service/Method") so that requests to it are transcoded using the given
+// Method
+func (h *Handler) RegisterMethod(path string, m Method) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.methods[path] = m
+}
+
+func (h *Handler) getMethod(path string) (Method, bool) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	m, ok := h.methods[path]
+	return m, ok
+}
+
+// ServeHTTP satisfies Handler being an http.Handler
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	kv := llog.KV{"path": r.URL.Path}
+	if r.Method != "POST" {
+		http.Error(w, "POST method required", 405)
+		return
+	}
+	ct := r.Header.Get("Content-Type")
+	if ct != "application/grpc-web" && ct != "application/grpc-web+proto" {
+		http.Error(w, "unsupported Content-Type", 415)
+		return
+	}
+
+	m, ok := h.getMethod(r.URL.Path)
+	if !ok {
+		writeTrailers(w, codeUnimplemented, "unknown method")
+		return
+	}
+	kv["method"] = m.RPCMethod
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		kv["err"] = err
+		llog.Warn("error reading grpc-web body", kv)
+		writeTrailers(w, codeUnknown, err.Error())
+		return
+	}
+	msg, err := readFrame(body)
+	if err != nil {
+		writeTrailers(w, codeInvalidArgument, err.Error())
+		return
+	}
+	params, err := m.Request.decode(msg)
+	if err != nil {
+		writeTrailers(w, codeInvalidArgument, err.Error())
+		return
+	}
+
+	res, err := h.call(r, m.RPCMethod, params)
+	if err != nil {
+		writeTrailers(w, codeUnknown, err.Error())
+		return
+	}
+	resMsg, err := m.Response.encode(res)
+	if err != nil {
+		kv["err"] = err
+		llog.Warn("error encoding grpc-web response", kv)
+		writeTrailers(w, codeUnknown, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/grpc-web+proto")
+	w.Write(frame(0, resMsg))
+	w.Write(trailerFrame(codeOK, ""))
+}
+
+// call performs the JSON RPC2 request against the underlying handler, and
+// returns the raw result
+func (h *Handler) call(r *http.Request, method string, params interface{}) (json.RawMessage, error) {
+	b, err := json2.EncodeClientRequest(method, params)
+	if err != nil {
+		return nil, err
+	}
+	r2 := r.Clone(r.Context())
+	r2.URL = &url.URL{Path: "/"}
+	r2.RequestURI = ""
+	r2.Body = ioutil.NopCloser(bytes.NewBuffer(b))
+	r2.ContentLength = int64(len(b))
+	r2.Header.Set("Content-Type", "application/json")
+
+	rec := httptest.NewRecorder()
+	h.handler.ServeHTTP(rec, r2)
+
+	var res json.RawMessage
+	if err := json2.DecodeClientResponse(rec.Body, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// readFrame returns the message in the single uncompressed data frame in b
+func readFrame(b []byte) ([]byte, error) {
+	if len(b) < 5 {
+		return nil, errors.New("frame too short")
+	} else if b[0] != 0 {
+		return nil, errors.New("compressed or non-data frames are not supported")
+	}
+	l := binary.BigEndian.Uint32(b[1:5])
+	if uint64(len(b)-5) != uint64(l) {
+		return nil, errors.New("frame length doesn't match body")
+	}
+	return b[5:], nil
+}
+
+func frame(flag byte, b []byte) []byte {
+	out := make([]byte, 5, 5+len(b))
+	out[0] = flag
+	binary.BigEndian.PutUint32(out[1:], uint32(len(b)))
+	return append(out, b...)
+}
+
+func trailerFrame(code int, msg string) []byte {
+	msg = strings.NewReplacer("\r", " ", "\n", " ").Replace(msg)
+	return frame(0x80, []byte(fmt.Sprintf("grpc-status: %d\r\ngrpc-message: %s\r\n", code, msg)))
+}
+
+// writeTrailers writes a response with no message, only the given status
+func writeTrailers(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/grpc-web+proto")
+	w.Write(trailerFrame(code, msg))
+}
@@ -0,0 +1,123 @@
+package grpcweb
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	. "testing"
+
+	"github.com/gorilla/rpc/v2/json2"
+	"github.com/levenlabs/gatewayrpc"
+	"github.com/levenlabs/gatewayrpc/gateway"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type Math struct{}
+
+type AddArgs struct {
+	A int64  `json:"a"`
+	B int64  `json:"b"`
+	N string `json:"n"`
+}
+
+type AddRes struct {
+	Sum int64  `json:"sum"`
+	N   string `json:"n"`
+}
+
+func (Math) Add(r *http.Request, args *AddArgs, res *AddRes) error {
+	res.Sum = args.A + args.B
+	res.N = args.N
+	return nil
+}
+
+var addMethod = Method{
+	RPCMethod: "Math.Add",
+	Request: Message{
+		{Number: 1, Name: "a", Kind: reflect.Int64},
+		{Number: 2, Name: "b", Kind: reflect.Int64},
+		{Number: 3, Name: "n", Kind: reflect.String},
+	},
+	Response: Message{
+		{Number: 1, Name: "sum", Kind: reflect.Int64},
+		{Number: 2, Name: "n", Kind: reflect.String},
+	},
+}
+
+func newTestHandler(t *T) *Handler {
+	s := gatewayrpc.NewServer()
+	require.Nil(t, s.RegisterService(Math{}, ""))
+	s.RegisterCodec(json2.NewCodec(), "application/json")
+
+	g := gateway.NewGateway()
+	g.RegisterCodec(json2.NewCodec(), "application/json")
+	require.Nil(t, g.AddHandler(s, ""))
+
+	h := NewHandler(g)
+	h.RegisterMethod("/math.Math/Add", addMethod)
+	return h
+}
+
+func TestUnary(t *T) {
+	h := newTestHandler(t)
+
+	// a=2, b=-1, n="hi"
+	msg := []byte{
+		0x08, 0x02,
+		0x10, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01,
+		0x1a, 0x02, 'h', 'i',
+	}
+	r, err := http.NewRequest("POST", "/math.Math/Add", bytes.NewBuffer(frame(0, msg)))
+	require.Nil(t, err)
+	r.Header.Set("Content-Type", "application/grpc-web+proto")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+
+	assert.Equal(t, "application/grpc-web+proto", rec.Header().Get("Content-Type"))
+	// sum=1, n="hi"
+	expected := frame(0, []byte{0x08, 0x01, 0x12, 0x02, 'h', 'i'})
+	expected = append(expected, trailerFrame(codeOK, "")...)
+	assert.Equal(t, expected, rec.Body.Bytes())
+}
+
+func TestUnaryErrors(t *T) {
+	h := newTestHandler(t)
+
+	r, err := http.NewRequest("POST", "/math.Math/Sub", bytes.NewBuffer(frame(0, nil)))
+	require.Nil(t, err)
+	r.Header.Set("Content-Type", "application/grpc-web")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	assert.Equal(t, trailerFrame(codeUnimplemented, "unknown method"), rec.Body.Bytes())
+
+	r, err = http.NewRequest("POST", "/math.Math/Add", bytes.NewBuffer([]byte{0, 0, 0}))
+	require.Nil(t, err)
+	r.Header.Set("Content-Type", "application/grpc-web")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	assert.Equal(t, trailerFrame(codeInvalidArgument, "frame too short"), rec.Body.Bytes())
+}
+
+func TestMessageRoundTrip(t *T) {
+	m := Message{
+		{Number: 1, Name: "b", Kind: reflect.Bool},
+		{Number: 2, Name: "u", Kind: reflect.Uint64},
+		{Number: 3, Name: "f", Kind: reflect.Float64},
+		{Number: 4, Name: "f32", Kind: reflect.Float32},
+		{Number: 5, Name: "s", Kind: reflect.String},
+	}
+	b, err := m.encode([]byte(`{"b":true,"u":5,"f":1.5,"f32":2.5,"s":"foo","x":1}`))
+	require.Nil(t, err)
+
+	v, err := m.decode(b)
+	require.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"b":   true,
+		"u":   uint64(5),
+		"f":   1.5,
+		"f32": float32(2.5),
+		"s":   "foo",
+	}, v)
+}
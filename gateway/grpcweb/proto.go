@@ -0,0 +1,172 @@
+package grpcweb
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+)
+
+// protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+func (m Message) field(num int) (Field, bool) {
+	for _, f := range m {
+		if f.Number == num {
+			return f, true
+		}
+	}
+	return Field{}, false
+}
+
+// decode decodes the protobuf encoded b into a map of json keys to values,
+// using the Message to know what each field is. Unknown fields are skipped
+func (m Message) decode(b []byte) (map[string]interface{}, error) {
+	out := map[string]interface{}{}
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, errors.New("invalid field key")
+		}
+		b = b[n:]
+		num, wt := int(key>>3), int(key&7)
+
+		var v uint64
+		var raw []byte
+		switch wt {
+		case wireVarint:
+			if v, n = binary.Uvarint(b); n <= 0 {
+				return nil, errors.New("invalid varint")
+			}
+			b = b[n:]
+		case wireFixed64:
+			if len(b) < 8 {
+				return nil, errors.New("invalid fixed64")
+			}
+			v, b = binary.LittleEndian.Uint64(b), b[8:]
+		case wireFixed32:
+			if len(b) < 4 {
+				return nil, errors.New("invalid fixed32")
+			}
+			v, b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		case wireBytes:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return nil, errors.New("invalid length delimited field")
+			}
+			raw, b = b[n:n+int(l)], b[n+int(l):]
+		default:
+			return nil, fmt.Errorf("unsupported wire type %d", wt)
+		}
+
+		f, ok := m.field(num)
+		if !ok {
+			continue
+		}
+		if wt != f.wireType() {
+			return nil, fmt.Errorf("field %d: unexpected wire type %d", num, wt)
+		}
+
+		switch f.Kind {
+		case reflect.Bool:
+			out[f.Name] = v != 0
+		case reflect.Int32:
+			out[f.Name] = int32(v)
+		case reflect.Int64:
+			out[f.Name] = int64(v)
+		case reflect.Uint32, reflect.Uint64:
+			out[f.Name] = v
+		case reflect.Float32:
+			out[f.Name] = math.Float32frombits(uint32(v))
+		case reflect.Float64:
+			out[f.Name] = math.Float64frombits(v)
+		case reflect.String:
+			out[f.Name] = string(raw)
+		}
+	}
+	return out, nil
+}
+
+// encode encodes the json object in b as protobuf, using the Message to know
+// what each field is. Keys which aren't part of the Message are ignored
+func (m Message) encode(b []byte) ([]byte, error) {
+	var vals map[string]json.RawMessage
+	if err := json.Unmarshal(b, &vals); err != nil {
+		return nil, err
+	}
+
+	var out []byte
+	for _, f := range m {
+		raw, ok := vals[f.Name]
+		if !ok || string(raw) == "null" {
+			continue
+		}
+		out = appendUvarint(out, uint64(f.Number)<<3|uint64(f.wireType()))
+
+		var err error
+		switch f.Kind {
+		case reflect.Bool:
+			var v bool
+			err = json.Unmarshal(raw, &v)
+			if v {
+				out = appendUvarint(out, 1)
+			} else {
+				out = appendUvarint(out, 0)
+			}
+		case reflect.Int32, reflect.Int64:
+			var v int64
+			if v, err = strconv.ParseInt(string(raw), 10, 64); err == nil {
+				out = appendUvarint(out, uint64(v))
+			}
+		case reflect.Uint32, reflect.Uint64:
+			var v uint64
+			if v, err = strconv.ParseUint(string(raw), 10, 64); err == nil {
+				out = appendUvarint(out, v)
+			}
+		case reflect.Float32:
+			var v float32
+			err = json.Unmarshal(raw, &v)
+			out = binary.LittleEndian.AppendUint32(out, math.Float32bits(v))
+		case reflect.Float64:
+			var v float64
+			err = json.Unmarshal(raw, &v)
+			out = binary.LittleEndian.AppendUint64(out, math.Float64bits(v))
+		case reflect.String:
+			var v string
+			err = json.Unmarshal(raw, &v)
+			out = appendUvarint(out, uint64(len(v)))
+			out = append(out, v...)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("field %q: %s", f.Name, err)
+		}
+	}
+	return out, nil
+}
+
+func (f Field) wireType() int {
+	switch f.Kind {
+	case reflect.Float32:
+		return wireFixed32
+	case reflect.Float64:
+		return wireFixed64
+	case reflect.String:
+		return wireBytes
+	default:
+		return wireVarint
+	}
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
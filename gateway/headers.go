@@ -0,0 +1,62 @@
+package gateway
+
+import (
+	"net/http"
+	"strings"
+)
+
+// hopByHopHeaders are the headers which only apply to a single connection, and
+// so are never forwarded to backends, as described by RFC 7230 section 6.1
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// filterForwardHeaders removes the headers of the request which shouldn't be
+// forwarded to its backend, i.e. hop-by-hop headers, and any not in
+// ForwardHeaders if it's set
+func (g *Gateway) filterForwardHeaders(r *http.Request) {
+	// the headers which the gateway itself sets or relies on are always kept,
+	// even if the client lists them in its Connection header
+	keep := map[string]bool{
+		"Content-Type":    true,
+		"Content-Length":  true,
+		"Accept-Encoding": true,
+		"X-Forwarded-For": true,
+	}
+	for _, h := range []string{g.RequestIDHeader, g.RealIPHeader} {
+		if h != "" {
+			keep[http.CanonicalHeaderKey(h)] = true
+		}
+	}
+
+	// the Connection header can list more headers which are hop-by-hop
+	for _, v := range r.Header["Connection"] {
+		for _, h := range strings.Split(v, ",") {
+			if h = strings.TrimSpace(h); h != "" && !keep[http.CanonicalHeaderKey(h)] {
+				r.Header.Del(h)
+			}
+		}
+	}
+	for _, h := range hopByHopHeaders {
+		r.Header.Del(h)
+	}
+
+	if len(g.ForwardHeaders) == 0 {
+		return
+	}
+	for _, h := range g.ForwardHeaders {
+		keep[http.CanonicalHeaderKey(h)] = true
+	}
+	for h := range r.Header {
+		if !keep[http.CanonicalHeaderKey(h)] {
+			delete(r.Header, h)
+		}
+	}
+}
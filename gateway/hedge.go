@@ -0,0 +1,68 @@
+package gateway
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/levenlabs/go-llog"
+)
+
+type hedgeResult struct {
+	rec *limitedRecorder
+	u   *url.URL
+}
+
+// forwardHedged forwards the request like forward does, but if no response has
+// come back after HedgeAfter it sends a second request to a freshly resolved
+// instance of uu. Whichever attempt succeeds first is returned, along with the
+// url it was sent to, and the other is cancelled.
+func (g *Gateway) forwardHedged(handler http.Handler, r *http.Request, b []byte, kv llog.KV, uu *url.URL) (*limitedRecorder, *url.URL) {
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	// buffered so that the loser doesn't block once we've stopped listening
+	resCh := make(chan hedgeResult, 2)
+	send := func(u *url.URL, kv llog.KV) {
+		r2 := r.Clone(ctx)
+		r2.URL = u
+		resCh <- hedgeResult{rec: g.forward(handler, r2, b, kv, uu, true), u: u}
+	}
+	go send(r.URL, copyKV(kv))
+	pending := 1
+
+	timer := time.NewTimer(g.HedgeAfter)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			u, err := g.resolveURL(uu)
+			if err != nil {
+				kv["err"] = err
+				llog.Warn("error resolving url for hedged request", kv)
+				delete(kv, "err")
+				continue
+			}
+			hkv := copyKV(kv)
+			hkv["hedgeURL"] = u.String()
+			llog.Debug("sending hedged request", hkv)
+			go send(u, hkv)
+			pending++
+		case res := <-resCh:
+			pending--
+			// a failed attempt is only used if there's nothing else to wait on
+			if res.rec.forwardErr == nil || pending == 0 {
+				return res.rec, res.u
+			}
+		}
+	}
+}
+
+func copyKV(kv llog.KV) llog.KV {
+	kv2 := make(llog.KV, len(kv))
+	for k, v := range kv {
+		kv2[k] = v
+	}
+	return kv2
+}
@@ -0,0 +1,42 @@
+package gateway
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+)
+
+// DefaultKeyFunc is the KeyFunc used by Gateway if none is set. The params are
+// canonicalized, so that differences in whitespace and the order of object keys
+// don't result in different keys, and then hashed along with the method
+func DefaultKeyFunc(method string, params json.RawMessage) (string, error) {
+	var canon []byte
+	if len(bytes.TrimSpace(params)) > 0 {
+		d := json.NewDecoder(bytes.NewReader(params))
+		d.UseNumber()
+		var v interface{}
+		if err := d.Decode(&v); err != nil {
+			return "", err
+		}
+		// maps are always marshaled with their keys sorted
+		var err error
+		if canon, err = json.Marshal(v); err != nil {
+			return "", err
+		}
+	}
+
+	h := sha256.New()
+	h.Write([]byte(method))
+	h.Write([]byte{0})
+	h.Write(canon)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// key returns the key for the given method and params, using KeyFunc
+func (g *Gateway) key(method string, params json.RawMessage) (string, error) {
+	if g.KeyFunc != nil {
+		return g.KeyFunc(method, params)
+	}
+	return DefaultKeyFunc(method, params)
+}
@@ -0,0 +1,38 @@
+package gateway
+
+import (
+	"math/rand"
+	"sort"
+)
+
+// LBStrategy determines which instance of a backend a request is sent to, when
+// its host resolves to more than one. See Gateway.LBStrategy
+type LBStrategy int
+
+// LBStrategies which may be used
+const (
+	// LBRandom picks an instance at random for every request
+	LBRandom LBStrategy = iota
+
+	// LBRoundRobin cycles through the instances in order, sorted by address so
+	// that the order doesn't depend on how the resolver ordered them
+	LBRoundRobin
+)
+
+// pickInstance returns one of the given addresses, which host resolved to,
+// according to the LBStrategy
+func (g *Gateway) pickInstance(host string, addrs []string) string {
+	if g.LBStrategy != LBRoundRobin {
+		return addrs[rand.Intn(len(addrs))]
+	}
+
+	sorted := make([]string, len(addrs))
+	copy(sorted, addrs)
+	sort.Strings(sorted)
+
+	g.instancesL.Lock()
+	defer g.instancesL.Unlock()
+	i := g.roundRobin[host]
+	g.roundRobin[host] = i + 1
+	return sorted[i%len(sorted)]
+}
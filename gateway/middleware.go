@@ -0,0 +1,46 @@
+package gateway
+
+import "path"
+
+type methodMiddleware struct {
+	pattern string
+	mw      func(*Request) error
+}
+
+// AddMethodMiddleware registers a function which will be called for every
+// request whose method ("Service.MethodName") matches the given pattern, just
+// before RequestCallback. The pattern uses the same syntax as path.Match, e.g.
+// "Billing.*" matches every method of the Billing service.
+//
+// Middlewares are called in the order they were added. If one returns an error
+// then no further middlewares are called and the request isn't forwarded; the
+// error is sent back to the client unless the middleware already responded
+// using one of the Request's Write* methods.
+func (g *Gateway) AddMethodMiddleware(pattern string, mw func(*Request) error) error {
+	// check the pattern is valid up front, so it doesn't fail on every request
+	if _, err := path.Match(pattern, ""); err != nil {
+		return err
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.middlewares = append(g.middlewares, methodMiddleware{pattern, mw})
+	return nil
+}
+
+// runMiddlewares calls all middlewares matching the given method in order,
+// stopping at the first error
+func (g *Gateway) runMiddlewares(m string, req *Request) error {
+	g.mutex.RLock()
+	mws := g.middlewares
+	g.mutex.RUnlock()
+
+	for _, mmw := range mws {
+		if ok, _ := path.Match(mmw.pattern, m); !ok {
+			continue
+		}
+		if err := mmw.mw(req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
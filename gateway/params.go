@@ -0,0 +1,274 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+
+	"github.com/gorilla/rpc/v2/json2"
+	"github.com/levenlabs/gatewayrpc/gatewaytypes"
+)
+
+// MissingParamsBehavior describes what the Gateway will do with a request which
+// doesn't have any params at all, for a method which expects some. Requests for
+// methods which don't take any args are always allowed to omit the params.
+type MissingParamsBehavior int
+
+const (
+	// MissingParamsForward forwards the request on as-is, leaving it up to the
+	// backend to decide what to do. This is the default
+	MissingParamsForward MissingParamsBehavior = iota
+
+	// MissingParamsInject injects an empty object as the params before
+	// forwarding the request on
+	MissingParamsInject
+
+	// MissingParamsError responds to the client with an invalid params error
+	MissingParamsError
+)
+
+var errMissingParams = &json2.Error{
+	Code:    json2.E_BAD_PARAMS,
+	Message: "missing params",
+}
+
+// isEmptyType returns whether or not the given Type describes a value with
+// nothing in it, e.g. struct{}
+func isEmptyType(t *gatewaytypes.Type) bool {
+	return t == nil || (t.TypeOf == 0 &&
+		t.ArrayOf == nil &&
+		len(t.ObjectOf) == 0 &&
+		t.MapOf == nil &&
+		t.CycleOf == nil)
+}
+
+// handleMissingParams applies the given MissingParamsBehavior to the Request,
+// if its params are missing. An error is returned if the request should not be
+// forwarded
+func (r *Request) handleMissingParams(b MissingParamsBehavior) error {
+	if b == MissingParamsForward || isEmptyType(r.RemoteMethod.Args) {
+		return nil
+	}
+	if err := r.loadArgs(); err != nil {
+		return err
+	}
+	if raw := bytes.TrimSpace(r.args); len(raw) > 0 && !bytes.Equal(raw, []byte("null")) {
+		return nil
+	}
+
+	if b == MissingParamsError {
+		return errMissingParams
+	}
+	r.args = json.RawMessage("{}")
+	return nil
+}
+
+// validateArgs checks the Request's params against the Args Type of its
+// RemoteMethod, returning an invalid params error if they don't match. If
+// allowExtra is false then fields in an object which aren't part of the Type
+// will also cause an error
+func (r *Request) validateArgs(allowExtra bool) error {
+	if isEmptyType(r.RemoteMethod.Args) {
+		return nil
+	}
+	if err := r.loadArgs(); err != nil {
+		return err
+	}
+	if len(bytes.TrimSpace(r.args)) == 0 {
+		return nil
+	}
+
+	d := json.NewDecoder(bytes.NewReader(r.args))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return &json2.Error{Code: json2.E_BAD_PARAMS, Message: err.Error()}
+	}
+
+	// params sent by-position containing a single object are treated the same
+	// as that object, the same as the codec does
+	if a, ok := v.([]interface{}); ok && len(a) == 1 && r.RemoteMethod.Args.ObjectOf != nil {
+		v = a[0]
+	}
+
+	if err := validateValue(v, r.RemoteMethod.Args, allowExtra, "params"); err != nil {
+		return &json2.Error{Code: json2.E_BAD_PARAMS, Message: "invalid params: " + err.Error()}
+	}
+	return nil
+}
+
+// validateValue checks that v, which was decoded from json using UseNumber,
+// matches the given Type. path is used to describe where in the params any
+// error was found
+func validateValue(v interface{}, t *gatewaytypes.Type, allowExtra bool, path string) error {
+	// anything can be null, it'll simply be decoded as the zero value. Cycles we
+	// can't say anything more about
+	if v == nil || t == nil || t.CycleOf != nil {
+		return nil
+	}
+
+	switch {
+	case t.ArrayOf != nil:
+		a, ok := v.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected array", path)
+		}
+		for i := range a {
+			if err := validateValue(a[i], t.ArrayOf, allowExtra, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+
+	case t.MapOf != nil:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected object", path)
+		}
+		for k := range m {
+			if err := validateValue(m[k], t.MapOf, allowExtra, path+"."+k); err != nil {
+				return err
+			}
+		}
+
+	case t.ObjectOf != nil:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected object", path)
+		}
+		for k := range m {
+			innerT, ok := t.ObjectOf[k]
+			if !ok {
+				if !allowExtra {
+					return fmt.Errorf("%s: unknown field %q", path, k)
+				}
+				continue
+			}
+			if err := validateValue(m[k], innerT, allowExtra, path+"."+k); err != nil {
+				return err
+			}
+		}
+
+	default:
+		return validateKind(v, t.TypeOf, path)
+	}
+	return nil
+}
+
+func validateKind(v interface{}, k reflect.Kind, path string) error {
+	var ok bool
+	switch {
+	case k == reflect.Bool:
+		_, ok = v.(bool)
+	case k == reflect.String:
+		_, ok = v.(string)
+	case k >= reflect.Int && k <= reflect.Int64:
+		n, isNum := v.(json.Number)
+		_, err := strconv.ParseInt(string(n), 10, 64)
+		ok = isNum && err == nil
+	case k >= reflect.Uint && k <= reflect.Uintptr:
+		n, isNum := v.(json.Number)
+		_, err := strconv.ParseUint(string(n), 10, 64)
+		ok = isNum && err == nil
+	case k == reflect.Float32 || k == reflect.Float64:
+		_, ok = v.(json.Number)
+	default:
+		// interfaces, and anything else we don't know how to check
+		ok = true
+	}
+	if !ok {
+		return fmt.Errorf("%s: expected %s", path, k)
+	}
+	return nil
+}
+
+// coerceScalars converts strings in the Request's params into the scalar types
+// the Args Type of its RemoteMethod expects, where possible
+func (r *Request) coerceScalars() error {
+	if isEmptyType(r.RemoteMethod.Args) {
+		return nil
+	}
+	if err := r.loadArgs(); err != nil {
+		return err
+	}
+	if len(bytes.TrimSpace(r.args)) == 0 {
+		return nil
+	}
+
+	d := json.NewDecoder(bytes.NewReader(r.args))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return &json2.Error{Code: json2.E_BAD_PARAMS, Message: err.Error()}
+	}
+
+	// see validateArgs
+	if a, ok := v.([]interface{}); ok && len(a) == 1 && r.RemoteMethod.Args.ObjectOf != nil {
+		a[0] = coerceValue(a[0], r.RemoteMethod.Args)
+	} else {
+		v = coerceValue(v, r.RemoteMethod.Args)
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	r.args = b
+	return nil
+}
+
+// coerceValue returns v, which was decoded from json using UseNumber, with any
+// strings in it converted to the scalar types given by t
+func coerceValue(v interface{}, t *gatewaytypes.Type) interface{} {
+	if v == nil || t == nil || t.CycleOf != nil {
+		return v
+	}
+
+	switch vv := v.(type) {
+	case []interface{}:
+		if t.ArrayOf != nil {
+			for i := range vv {
+				vv[i] = coerceValue(vv[i], t.ArrayOf)
+			}
+		}
+	case map[string]interface{}:
+		for k := range vv {
+			if t.MapOf != nil {
+				vv[k] = coerceValue(vv[k], t.MapOf)
+			} else if innerT, ok := t.ObjectOf[k]; ok {
+				vv[k] = coerceValue(vv[k], innerT)
+			}
+		}
+	case string:
+		return coerceString(vv, t)
+	}
+	return v
+}
+
+func coerceString(s string, t *gatewaytypes.Type) interface{} {
+	switch t.JSONType() {
+	case "integer":
+		var err error
+		if t.TypeOf >= reflect.Uint && t.TypeOf <= reflect.Uintptr {
+			_, err = strconv.ParseUint(s, 10, 64)
+		} else {
+			_, err = strconv.ParseInt(s, 10, 64)
+		}
+		if err == nil {
+			return json.Number(s)
+		}
+	case "number":
+		// unmarshaling ensures the string is a number json can represent,
+		// which rules out things like NaN
+		var n json.Number
+		if err := json.Unmarshal([]byte(s), &n); err == nil {
+			return n
+		}
+	case "boolean":
+		if b, err := strconv.ParseBool(s); err == nil {
+			return b
+		}
+	}
+	return s
+}
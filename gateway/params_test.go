@@ -0,0 +1,114 @@
+package gateway
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	. "testing"
+
+	"github.com/gorilla/rpc/v2/json2"
+	"github.com/levenlabs/gatewayrpc/gatewaytypes"
+	"github.com/levenlabs/golib/rpcutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testArgsType = &gatewaytypes.Type{ObjectOf: map[string]*gatewaytypes.Type{
+	"a": {TypeOf: reflect.Int64},
+	"b": {TypeOf: reflect.String},
+	"c": {ArrayOf: &gatewaytypes.Type{TypeOf: reflect.Uint}},
+	"d": {MapOf: &gatewaytypes.Type{TypeOf: reflect.Interface}},
+	"e": {TypeOf: reflect.Float64},
+	"f": {TypeOf: reflect.Bool},
+}}
+
+func getParamsRequest(params string) (*Request, error) {
+	body := `{"jsonrpc":"2.0","method":"Test.Test","params":` + params + `,"id":1}`
+	req := &Request{
+		RemoteMethod: gatewaytypes.Method{Args: testArgsType},
+		respWriter:   httptest.NewRecorder(),
+	}
+	var err error
+	if req.Request, err = http.NewRequest("POST", "http://127.0.0.1", bytes.NewBufferString(body)); err != nil {
+		return req, err
+	}
+	req.codecReq = json2.NewCodec().NewRequest(req.Request)
+	return req, nil
+}
+
+func TestValidateArgs(t *T) {
+	valid := []string{
+		`{}`,
+		`null`,
+		`{"a":1,"b":"one"}`,
+		`{"a":null,"c":[1,2],"d":{"foo":"bar","baz":[1]}}`,
+		`[{"a":1}]`,
+	}
+	for _, params := range valid {
+		r, err := getParamsRequest(params)
+		require.Nil(t, err)
+		assert.Nil(t, r.validateArgs(false), "params: %s", params)
+	}
+
+	invalid := []string{
+		`"a"`,
+		`{"a":"one"}`,
+		`{"a":1.5}`,
+		`{"b":1}`,
+		`{"c":[-1]}`,
+		`{"c":{}}`,
+		`{"d":[]}`,
+	}
+	for _, params := range invalid {
+		r, err := getParamsRequest(params)
+		require.Nil(t, err)
+		assert.NotNil(t, r.validateArgs(true), "params: %s", params)
+	}
+}
+
+func TestValidateArgsExtraFields(t *T) {
+	r, err := getParamsRequest(`{"a":1,"z":true}`)
+	require.Nil(t, err)
+	assert.Nil(t, r.validateArgs(true))
+	assert.NotNil(t, r.validateArgs(false))
+
+	// end-to-end through a gateway
+	g := newTestGateway(t)
+	g.ValidateArgs = true
+	args := map[string]interface{}{"a": 1, "b": "one", "z": true}
+
+	var res FooRes
+	require.Nil(t, rpcutil.JSONRPC2CallHandler(g, &res, "TestEndpoint.Foo", args))
+	assert.Equal(t, FooArgs{A: 1, B: "one"}, res.FooArgs)
+
+	g.AllowExtraFields = false
+	assert.NotNil(t, rpcutil.JSONRPC2CallHandler(g, &res, "TestEndpoint.Foo", args))
+}
+
+func TestCoerceScalars(t *T) {
+	tests := []struct {
+		params, exp string
+	}{
+		{`{"a":"5","b":"6","e":"1.5","f":"true"}`, `{"a":5,"b":"6","e":1.5,"f":true}`},
+		{`{"a":"five","e":"NaN","f":"yes"}`, `{"a":"five","e":"NaN","f":"yes"}`},
+		{`{"c":["1","-1"],"d":{"x":"1"}}`, `{"c":[1,"-1"],"d":{"x":"1"}}`},
+		{`[{"a":"5"}]`, `[{"a":5}]`},
+		{`{"a":5,"z":"5"}`, `{"a":5,"z":"5"}`},
+	}
+	for _, test := range tests {
+		r, err := getParamsRequest(test.params)
+		require.Nil(t, err)
+		require.Nil(t, r.coerceScalars())
+		assert.JSONEq(t, test.exp, string(r.args), "params: %s", test.params)
+	}
+
+	// end-to-end through a gateway
+	g := newTestGateway(t)
+	g.CoerceScalars = true
+	g.ValidateArgs = true
+	var res FooRes
+	args := map[string]interface{}{"a": "5", "b": "one"}
+	require.Nil(t, rpcutil.JSONRPC2CallHandler(g, &res, "TestEndpoint.Foo", args))
+	assert.Equal(t, FooArgs{A: 5, B: "one"}, res.FooArgs)
+}
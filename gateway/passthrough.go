@@ -0,0 +1,90 @@
+package gateway
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/rpc/v2"
+	"github.com/gorilla/rpc/v2/json2"
+	"github.com/levenlabs/go-llog"
+)
+
+// canPassthrough returns whether the request's response may be streamed
+// straight to the client, see PassthroughLarge. Only plain json rpc 2.0
+// responses can be, since any other codec may write responses differently
+func (g *Gateway) canPassthrough(req *Request, codec rpc.Codec, remote, fanOut, idempotent bool) bool {
+	_, isJSON2 := codec.(*json2.Codec)
+	return g.PassthroughLarge &&
+		isJSON2 &&
+		remote &&
+		!fanOut &&
+		!(idempotent && (g.HedgeAfter > 0 || g.CoalesceReads)) &&
+		req.clientCodec == nil &&
+		req.RemoteMethod.Cacheable == 0 &&
+		g.ResponseTranscoder == nil &&
+		g.ErrorCodeMapper == nil &&
+		g.MaxResponseBytes == 0
+}
+
+// newPassthroughHandler returns a handler which forwards requests to backends
+// like externalHandler, but streams their responses to w rather than writing
+// them to the recorder it's given. The recorder is only written to if the
+// request couldn't be sent, so that it can be retried
+func (g *Gateway) newPassthroughHandler(w http.ResponseWriter, start time.Time) http.Handler {
+	client := g.httpClient()
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		res := doExternal(client, rw, r)
+		if res == nil {
+			return
+		}
+		defer res.Body.Close()
+		if lr, ok := rw.(*limitedRecorder); ok {
+			lr.streamed = true
+			lr.Code = res.StatusCode
+			lr.status = res.StatusCode
+			lr.compressed = res.Uncompressed || res.Header.Get("Content-Encoding") != ""
+		}
+
+		w.Header().Set("Content-Type", responseContentType(res, r))
+		for _, h := range g.PassResponseHeaders {
+			if vv := res.Header[http.CanonicalHeaderKey(h)]; len(vv) > 0 {
+				w.Header()[http.CanonicalHeaderKey(h)] = vv
+			}
+		}
+		if g.TimingHeaders {
+			ms := time.Since(start).Nanoseconds() / int64(time.Millisecond)
+			w.Header().Set("X-Gateway-Upstream-Duration-Ms", strconv.FormatInt(ms, 10))
+		}
+		w.WriteHeader(res.StatusCode)
+		if err := copyResponse(r.Context(), w, res.Body); err != nil {
+			llog.Error("error streaming backend response", llog.KV{
+				"url": r.URL.String(),
+				"err": err,
+			})
+		}
+	})
+}
+
+// rpcID returns the id of the rpc request in the body, or nil if it doesn't
+// have one
+func rpcID(body []byte) json.RawMessage {
+	var req struct {
+		ID json.RawMessage `json:"id"`
+	}
+	if json.Unmarshal(body, &req) != nil || string(req.ID) == "null" {
+		return nil
+	}
+	return req.ID
+}
+
+// withRPCID returns the encoded rpc request with its id replaced
+func withRPCID(b []byte, id json.RawMessage) ([]byte, error) {
+	var env map[string]json.RawMessage
+	if err := json.Unmarshal(b, &env); err != nil {
+		return nil, err
+	}
+	env["id"] = id
+	return json.Marshal(env)
+}
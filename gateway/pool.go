@@ -0,0 +1,65 @@
+package gateway
+
+import "sync"
+
+// PoolStat describes the load on a single service, see PoolStats. The gateway
+// doesn't queue requests, so InFlight is the saturation signal to watch: it's
+// the number of requests currently waiting on the service's backend
+type PoolStat struct {
+	InFlight int64
+
+	// BreakerOpen is whether the service's circuit breaker is currently open,
+	// see Gateway.BreakerThreshold
+	BreakerOpen bool
+
+	// Requests is the total number of requests which have been forwarded to
+	// the service, and Retries is how many of their attempts were retries (see
+	// Gateway.Retries), so that a retry rate can be derived from the two
+	Requests int64
+	Retries  int64
+}
+
+// poolStats tracks a PoolStat for each service. The zero value is ready to use
+type poolStats struct {
+	l     sync.Mutex
+	stats map[string]*PoolStat
+}
+
+func (p *poolStats) start(service string) {
+	p.l.Lock()
+	defer p.l.Unlock()
+	if p.stats == nil {
+		p.stats = map[string]*PoolStat{}
+	}
+	ps, ok := p.stats[service]
+	if !ok {
+		ps = &PoolStat{}
+		p.stats[service] = ps
+	}
+	ps.InFlight++
+	ps.Requests++
+}
+
+func (p *poolStats) finish(service string, retries int) {
+	p.l.Lock()
+	defer p.l.Unlock()
+	ps := p.stats[service]
+	ps.InFlight--
+	ps.Retries += int64(retries)
+}
+
+// PoolStats returns the current PoolStat of every service which has had a
+// request forwarded to it
+func (g *Gateway) PoolStats() map[string]PoolStat {
+	g.poolStats.l.Lock()
+	defer g.poolStats.l.Unlock()
+	m := make(map[string]PoolStat, len(g.poolStats.stats))
+	for service, ps := range g.poolStats.stats {
+		m[service] = *ps
+	}
+	for service, ps := range m {
+		ps.BreakerOpen = g.breakers.isOpen(service, g.BreakerThreshold)
+		m[service] = ps
+	}
+	return m
+}
@@ -0,0 +1,84 @@
+package gateway
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"strings"
+
+	"github.com/levenlabs/go-llog"
+)
+
+// ProxyPath causes all requests whose path starts with prefix to be proxied,
+// as plain http requests rather than rpc ones, to the backend which owns the
+// given service. The method, path, and body of the request are preserved. If
+// multiple prefixes match a request the longest is used. Maintenance and
+// drained backends apply to proxied requests the same as to rpc ones.
+func (g *Gateway) ProxyPath(prefix, serviceName string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.proxies[prefix] = serviceName
+}
+
+// getProxy returns the service the request should be proxied to, if any
+func (g *Gateway) getProxy(r *http.Request) (string, bool) {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	var longest, service string
+	for prefix, s := range g.proxies {
+		if strings.HasPrefix(r.URL.Path, prefix) && len(prefix) >= len(longest) {
+			longest, service = prefix, s
+		}
+	}
+	return service, service != ""
+}
+
+func (g *Gateway) serveProxy(w http.ResponseWriter, r *http.Request, service string, kv llog.KV) {
+	kv["proxyService"] = service
+	g.mutex.RLock()
+	rsrv, ok := g.services[service]
+	g.mutex.RUnlock()
+	if !ok {
+		llog.Warn("unknown service for proxied path", kv)
+		writeErrorf(w, 502, "unknown service %q", service)
+		return
+	}
+
+	if msg, ok := g.getServiceMaintenance(service); ok {
+		llog.Debug("rejecting proxied request due to maintenance", kv)
+		writeErrorf(w, 503, "%s", msg)
+		return
+	}
+
+	// in-process services can be handed the request directly
+	if rsrv.handler != nil {
+		rsrv.handler.ServeHTTP(w, r)
+		return
+	}
+
+	backend, err := g.backendURL(rsrv, r)
+	if err != nil {
+		kv["err"] = err
+		llog.Warn("no backend available for proxied request", kv)
+		status := 400
+		if err == errBackendDrained {
+			status = 503
+		}
+		writeErrorf(w, status, "%s", err.Error())
+		return
+	}
+	u, err := g.resolveURL(backend)
+	if err != nil {
+		if g.OnResolveError != nil {
+			g.OnResolveError(service, err)
+		}
+		kv["err"] = err
+		llog.Error("error resolving backend url", kv)
+		writeErrorf(w, 502, "could not resolve backend")
+		return
+	}
+	llog.Debug("proxying request", kv)
+	proxy := httputil.NewSingleHostReverseProxy(u)
+	// use the same transport, and so tls settings, as forwarded rpc requests
+	proxy.Transport = g.httpClient().Transport
+	proxy.ServeHTTP(w, r)
+}
@@ -0,0 +1,85 @@
+package gateway
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ParseCIDRs is a helper for filling in Gateway's TrustedProxies
+func ParseCIDRs(cidrs ...string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func (g *Gateway) isTrustedProxy(ipStr string) bool {
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range g.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func remoteIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// clientIP returns the ip of the client which made the request. If the request
+// came from a trusted proxy, the RealIPHeader is looked at from right to left
+// (in case it's a chain, like X-Forwarded-For) and the first ip which isn't
+// also a trusted proxy is used
+func (g *Gateway) clientIP(r *http.Request) string {
+	remote := remoteIP(r)
+	if g.RealIPHeader == "" || !g.isTrustedProxy(remote) {
+		return remote
+	}
+
+	var ips []string
+	for _, v := range r.Header[http.CanonicalHeaderKey(g.RealIPHeader)] {
+		for _, ip := range strings.Split(v, ",") {
+			if ip = strings.TrimSpace(ip); net.ParseIP(ip) != nil {
+				ips = append(ips, ip)
+			}
+		}
+	}
+	if len(ips) == 0 {
+		return remote
+	}
+	for i := len(ips) - 1; i >= 0; i-- {
+		if !g.isTrustedProxy(ips[i]) {
+			return ips[i]
+		}
+	}
+	return ips[0]
+}
+
+// setForwardedHeaders sets the X-Forwarded-For chain and RealIPHeader on the
+// request before it's forwarded to a backend. Headers sent by clients which
+// aren't trusted proxies are discarded, since they may be spoofed
+func (g *Gateway) setForwardedHeaders(r *http.Request, ip string) {
+	remote := remoteIP(r)
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" && g.isTrustedProxy(remote) {
+		r.Header.Set("X-Forwarded-For", xff+", "+remote)
+	} else {
+		r.Header.Set("X-Forwarded-For", remote)
+	}
+	if http.CanonicalHeaderKey(g.RealIPHeader) != "X-Forwarded-For" {
+		r.Header.Set(g.RealIPHeader, ip)
+	}
+}
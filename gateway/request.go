@@ -1,9 +1,10 @@
 package gateway
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"github.com/gorilla/rpc/v2"
-	"github.com/gorilla/rpc/v2/json2"
 	"github.com/levenlabs/gatewayrpc/gatewaytypes"
 	"net/http"
 )
@@ -27,7 +28,17 @@ type Request struct {
 	codecReq   rpc.CodecRequest
 	newMethod  string
 	args       json.RawMessage
+	argsLoaded bool
 	responded  bool
+	clientIP   string
+	principal  string
+
+	// set if the request's codec is used for forwarding it, see ClientCodec
+	clientCodec ClientCodec
+
+	// top-level fields of the request's envelope which aren't part of the
+	// JSON RPC spec, and which are passed along as-is
+	extra map[string]json.RawMessage
 }
 
 // Method returns the RPC method that this request is going to call
@@ -38,6 +49,25 @@ func (r *Request) Method() (string, error) {
 	return r.codecReq.Method()
 }
 
+// ClientIP returns the ip of the client which made the request. This takes the
+// RealIPHeader of the Gateway into account, and so should be used for things
+// like rate-limiting rather than RemoteAddr
+func (r *Request) ClientIP() string {
+	return r.clientIP
+}
+
+// SetPrincipal sets who the request was made by, e.g. the user which was
+// authenticated in a RequestCallback or method middleware. It's included in
+// the request's AuditRecord
+func (r *Request) SetPrincipal(principal string) {
+	r.principal = principal
+}
+
+// Principal returns who the request was made by, as set by SetPrincipal
+func (r *Request) Principal() string {
+	return r.principal
+}
+
 // WriteError responds to the client with an error code and error it deals with
 // the CodecRequest so you don't have to After calling, you should return false
 // from the callback
@@ -57,10 +87,41 @@ func (r *Request) WriteResponse(i interface{}) {
 // If you change the struct you passed, you must call UpdateRequest and pass
 // the updated struct in order to actually affect the forwarded request
 func (r *Request) ReadRequest(v interface{}) error {
-	if len(r.args) > 0 {
-		return json.Unmarshal(r.args, v)
+	if err := r.loadArgs(); err != nil {
+		return err
+	}
+	if len(r.args) == 0 {
+		return nil
 	}
-	return r.codecReq.ReadRequest(v)
+	return unmarshalParams(r.args, v, json.Unmarshal)
+}
+
+// ReadRequestUseNumber is like ReadRequest, but numbers which are read into an
+// interface{} are decoded as a json.Number rather than a float64, so that large
+// integers and decimals don't lose precision
+func (r *Request) ReadRequestUseNumber(v interface{}) error {
+	if err := r.loadArgs(); err != nil {
+		return err
+	}
+	if len(r.args) == 0 {
+		return nil
+	}
+	return unmarshalParams(r.args, v, unmarshalUseNumber)
+}
+
+// ReadRequestSlice fills in the args into the passed interface, which should be
+// a pointer to a slice. It's meant for methods which take their params
+// by-position (e.g. "Math.Add" taking []int64), and will return an error if the
+// params were not sent as an array. As with ReadRequest, UpdateRequest must be
+// called with the changed slice in order to affect the forwarded request
+func (r *Request) ReadRequestSlice(v interface{}) error {
+	if err := r.loadArgs(); err != nil {
+		return err
+	}
+	if b := bytes.TrimSpace(r.args); len(b) == 0 || b[0] != '[' {
+		return errors.New("params are not an array")
+	}
+	return json.Unmarshal(r.args, v)
 }
 
 // UpdateRequest takes a new method string and an interface that it json
@@ -77,20 +138,88 @@ func (r *Request) UpdateRequest(method string, params interface{}) error {
 			return err
 		}
 		err = r.args.UnmarshalJSON(a)
+		r.argsLoaded = true
 	}
 	return err
 }
 
+// loadArgs decodes the raw params from the codec into args, if they haven't
+// been already. Everything which needs the params should go through this so
+// the codec is only ever read from once
+func (r *Request) loadArgs() error {
+	if r.argsLoaded {
+		return nil
+	}
+	if err := r.codecReq.ReadRequest(&r.args); err != nil {
+		return err
+	}
+	r.argsLoaded = true
+	return nil
+}
+
 func (r *Request) getClientRequest() ([]byte, error) {
-	var err error
-	if len(r.args) == 0 {
-		if err = r.codecReq.ReadRequest(&r.args); err != nil {
-			return nil, err
-		}
+	if err := r.loadArgs(); err != nil {
+		return nil, err
 	}
 	m, err := r.Method()
 	if err != nil {
 		return nil, err
 	}
-	return json2.EncodeClientRequest(m, &r.args)
+	b, err := r.encodeClientRequest(m, &r.args)
+	if err != nil || len(r.extra) == 0 || r.clientCodec != nil {
+		return b, err
+	}
+
+	var env map[string]json.RawMessage
+	if err := json.Unmarshal(b, &env); err != nil {
+		return nil, err
+	}
+	for k, v := range r.extra {
+		env[k] = v
+	}
+	return json.Marshal(env)
+}
+
+// envelopeExtras returns the top-level fields of the raw request body which
+// aren't part of the JSON RPC spec, or nil if there aren't any
+func envelopeExtras(body []byte) map[string]json.RawMessage {
+	var env map[string]json.RawMessage
+	if json.Unmarshal(body, &env) != nil {
+		return nil
+	}
+	for _, k := range []string{"jsonrpc", "method", "params", "id"} {
+		delete(env, k)
+	}
+	if len(env) == 0 {
+		return nil
+	}
+	return env
+}
+
+// unmarshalParams unmarshals the raw params into v using unmarshal, the same
+// way the json2 codec does, so that params sent by-position as a single element
+// array can still be read into a struct
+func unmarshalParams(raw json.RawMessage, v interface{}, unmarshal func([]byte, interface{}) error) error {
+	err := unmarshal(raw, v)
+	if err == nil {
+		return nil
+	}
+	params := [1]interface{}{v}
+	if unmarshal(raw, &params) == nil {
+		return nil
+	}
+	return err
+}
+
+// unmarshalUseNumber is like json.Unmarshal, but decodes numbers in
+// interface{}s as json.Number
+func unmarshalUseNumber(data []byte, v interface{}) error {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	if err := d.Decode(v); err != nil {
+		return err
+	} else if d.More() {
+		return errors.New("invalid character after top-level value")
+	}
+	return nil
 }
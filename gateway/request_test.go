@@ -2,6 +2,9 @@ package gateway
 
 import (
 	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/rpc/v2"
 	"github.com/gorilla/rpc/v2/json2"
 	"github.com/levenlabs/golib/testutil"
 	"github.com/stretchr/testify/assert"
@@ -30,6 +33,21 @@ func getFooRequest() (*Request, FooArgs, error) {
 	return req, args, err
 }
 
+func getArrayRequest(params interface{}) (*Request, error) {
+	req := &Request{
+		respWriter: httptest.NewRecorder(),
+	}
+	b, err := json2.EncodeClientRequest("Math.Add", params)
+	if err != nil {
+		return req, err
+	}
+	if req.Request, err = http.NewRequest("POST", "http://127.0.0.1", bytes.NewBuffer(b)); err != nil {
+		return req, err
+	}
+	req.codecReq = json2.NewCodec().NewRequest(req.Request)
+	return req, err
+}
+
 func TestReadRequest(t *T) {
 	r, args, err := getFooRequest()
 	require.Nil(t, err)
@@ -41,6 +59,21 @@ func TestReadRequest(t *T) {
 	assert.Equal(t, args, args2)
 }
 
+func TestReadRequestUseNumber(t *T) {
+	r, err := getArrayRequest(map[string]interface{}{"amount": json.RawMessage(`12345678901234567890`)})
+	require.Nil(t, err)
+
+	var args map[string]interface{}
+	require.Nil(t, r.ReadRequestUseNumber(&args))
+	assert.Equal(t, json.Number("12345678901234567890"), args["amount"])
+
+	// ReadRequest would have lost precision
+	var lossy map[string]interface{}
+	require.Nil(t, r.ReadRequest(&lossy))
+	assert.IsType(t, float64(0), lossy["amount"])
+	assert.NotEqual(t, "12345678901234567890", fmt.Sprint(lossy["amount"]))
+}
+
 func TestUpdateRequest(t *T) {
 	r, _, err := getFooRequest()
 	require.Nil(t, err)
@@ -113,3 +146,85 @@ func TestClientRequest(t *T) {
 
 	equalRequest(t, b, "Test.Test2", args)
 }
+
+func TestReadRequestSlice(t *T) {
+	nums := []int64{testutil.RandInt64(), testutil.RandInt64()}
+	r, err := getArrayRequest(nums)
+	require.Nil(t, err)
+
+	var nums2 []int64
+	require.Nil(t, r.ReadRequestSlice(&nums2))
+	assert.Equal(t, nums, nums2)
+
+	nums2 = append(nums2, testutil.RandInt64())
+	require.Nil(t, r.UpdateRequest("", nums2))
+
+	var nums3 []int64
+	require.Nil(t, r.ReadRequestSlice(&nums3))
+	assert.Equal(t, nums2, nums3)
+
+	b, err := r.getClientRequest()
+	require.Nil(t, err)
+	req, err := http.NewRequest("POST", "http://127.0.0.1", bytes.NewBuffer(b))
+	require.Nil(t, err)
+	var nums4 []int64
+	require.Nil(t, json2.NewCodec().NewRequest(req).ReadRequest(&nums4))
+	assert.Equal(t, nums2, nums4)
+
+	// an object can't be read as a slice
+	r, _, err = getFooRequest()
+	require.Nil(t, err)
+	assert.NotNil(t, r.ReadRequestSlice(&nums2))
+}
+
+func TestReadRequestByPosition(t *T) {
+	args := FooArgs{
+		A: testutil.RandInt64(),
+		B: testutil.RandStr(),
+	}
+	r, err := getArrayRequest([]FooArgs{args})
+	require.Nil(t, err)
+
+	// forces the raw params to be buffered
+	_, err = r.getClientRequest()
+	require.Nil(t, err)
+
+	args2 := FooArgs{}
+	require.Nil(t, r.ReadRequest(&args2))
+	assert.Equal(t, args, args2)
+}
+
+// countingCodecRequest wraps a CodecRequest and counts how many times its
+// params are read
+type countingCodecRequest struct {
+	rpc.CodecRequest
+	reads int
+}
+
+func (c *countingCodecRequest) ReadRequest(v interface{}) error {
+	c.reads++
+	return c.CodecRequest.ReadRequest(v)
+}
+
+func TestReadRequestOnce(t *T) {
+	r, args, err := getFooRequest()
+	require.Nil(t, err)
+	ccr := &countingCodecRequest{CodecRequest: r.codecReq}
+	r.codecReq = ccr
+
+	// two separate consumers of the params, neither of which should interfere
+	// with the other
+	args2 := FooArgs{}
+	require.Nil(t, r.ReadRequest(&args2))
+	assert.Equal(t, args, args2)
+
+	m := map[string]interface{}{}
+	require.Nil(t, r.ReadRequest(&m))
+	assert.Equal(t, args.B, m["b"])
+
+	b, err := r.getClientRequest()
+	require.Nil(t, err)
+	equalRequest(t, b, "Test.Test", args)
+
+	assert.Equal(t, 1, ccr.reads)
+}
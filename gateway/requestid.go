@@ -0,0 +1,32 @@
+package gateway
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/http"
+)
+
+// DefaultRequestIDHeader is the RequestIDHeader NewGateway sets
+const DefaultRequestIDHeader = "X-Request-Id"
+
+// requestID returns the id of the request from its RequestIDHeader, generating
+// one and setting it on the request if it doesn't have one
+func (g *Gateway) requestID(r *http.Request) string {
+	id := r.Header.Get(g.RequestIDHeader)
+	if id == "" {
+		id = newUUID()
+		r.Header.Set(g.RequestIDHeader, id)
+	}
+	return id
+}
+
+// newUUID returns a random (version 4) uuid
+func newUUID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
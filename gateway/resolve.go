@@ -0,0 +1,115 @@
+package gateway
+
+import (
+	"net"
+	"net/url"
+	"strings"
+)
+
+// ResolveMode determines how the host of a backend is resolved, when neither
+// InstanceResolver nor Resolver is set. See AddURLResolveMode
+type ResolveMode int
+
+// ResolveModes which may be used
+const (
+	// ResolveSRVFirst looks up SRV records for the host, and uses the host
+	// as-is if there aren't any. This is the default
+	ResolveSRVFirst ResolveMode = iota
+
+	// ResolveDNSFirst uses the host as-is if it can be resolved through
+	// normal DNS, and otherwise looks up SRV records for it. Requests are sent
+	// back an error if it has neither
+	ResolveDNSFirst
+
+	// ResolveDNSOnly uses the host as-is, never looking up SRV records for
+	// it. Requests are sent back an error if it can't be resolved through
+	// normal DNS
+	ResolveDNSOnly
+)
+
+// AddURLResolveMode is like AddURL, but the backend's host is resolved using
+// the given ResolveMode rather than ResolveSRVFirst
+func (g *Gateway) AddURLResolveMode(u string, mode ResolveMode) error {
+	if !strings.HasPrefix(u, "http") {
+		u = "http://" + u
+	}
+	uu, err := url.Parse(u)
+	if err != nil {
+		return err
+	}
+	g.instancesL.Lock()
+	g.resolveModes[uu.Host] = mode
+	g.instancesL.Unlock()
+	return g.AddURL(u)
+}
+
+// resolveByMode resolves the host according to its ResolveMode, returning the
+// address to connect to along with how many instances were found for it
+func (g *Gateway) resolveByMode(host string) (string, int, error) {
+	g.instancesL.Lock()
+	mode := g.resolveModes[host]
+	g.instancesL.Unlock()
+
+	var dnsErr error
+	switch mode {
+	case ResolveDNSOnly:
+		n, err := g.lookupDNS(host)
+		if err != nil {
+			return "", 0, err
+		}
+		return host, n, nil
+	case ResolveDNSFirst:
+		n, err := g.lookupDNS(host)
+		if err == nil {
+			return host, n, nil
+		}
+		dnsErr = err
+	}
+
+	// if there's no srv record for the host then it's used as-is, without
+	// looking it up again through MaybeSRV
+	addrs, err := g.lookupSRV(host)
+	if err != nil {
+		return "", 0, err
+	} else if len(addrs) > 0 {
+		return g.pickInstance(host, addrs), len(addrs), nil
+	} else if dnsErr != nil {
+		return "", 0, dnsErr
+	}
+	return host, 1, nil
+}
+
+// lookupDNS returns how many addresses the host, which may include a port,
+// resolves to through normal DNS
+func (g *Gateway) lookupDNS(host string) (int, error) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	lookup := net.LookupHost
+	if g.dnsLookup != nil {
+		lookup = g.dnsLookup
+	}
+	addrs, err := lookup(host)
+	return len(addrs), err
+}
+
+// lookupSRV returns the addresses of the SRV records for the host. Having no
+// records isn't an error, in that case nothing is returned
+func (g *Gateway) lookupSRV(host string) ([]string, error) {
+	if g.srvLookup != nil {
+		return g.srvLookup(host)
+	}
+	// ip addresses can't have srv records
+	h := host
+	if hh, _, err := net.SplitHostPort(host); err == nil {
+		h = hh
+	}
+	if net.ParseIP(h) != nil {
+		return nil, nil
+	}
+	addrs, err := g.SRVClient.AllSRV(host)
+	if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+		return nil, nil
+	}
+	return addrs, err
+}
@@ -0,0 +1,100 @@
+package gateway
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"time"
+
+	"github.com/levenlabs/go-llog"
+)
+
+// DefaultBackoff is the Backoff used by Gateway if none is set. It's
+// exponential starting at 50ms, capped at 5s, with up to half of the wait being
+// random jitter
+func DefaultBackoff(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+	// past 7 attempts we'd be over the cap anyway, and the shift could overflow
+	d := 5 * time.Second
+	if attempt <= 7 {
+		d = 50 * time.Millisecond << uint(attempt-1)
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// notSent returns whether the error from forwarding a request means it never
+// reached the backend, e.g. because the connection was refused, in which case
+// it's safe to retry whether or not its method is idempotent
+func notSent(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// forward passes the request, with b as its body, to the handler, retrying as
+// configured if forwarding it failed. Unless the method is idempotent it's only
+// retried if it never reached the backend, see notSent. If uu is given it's the
+// unresolved url of the backend, which is resolved again before each retry so
+// that it may land on a different instance. The recorder from the last attempt
+// is returned
+func (g *Gateway) forward(handler http.Handler, r *http.Request, b []byte, kv llog.KV, uu *url.URL, idempotent bool) *limitedRecorder {
+	backoff := g.Backoff
+	if backoff == nil {
+		backoff = DefaultBackoff
+	}
+
+	if g.RetryBudget != nil {
+		g.RetryBudget.recordRequest()
+	}
+
+	for attempt := 0; ; attempt++ {
+		r.Body = ioutil.NopCloser(bytes.NewBuffer(b))
+		rec := &limitedRecorder{
+			ResponseRecorder: httptest.NewRecorder(),
+			max:              g.MaxResponseBytes,
+		}
+		handler.ServeHTTP(rec, r)
+		rec.retries = attempt
+		if rec.forwardErr == nil || attempt >= g.Retries || r.Context().Err() != nil {
+			return rec
+		} else if !idempotent && !notSent(rec.forwardErr) {
+			return rec
+		}
+
+		wait := backoff(attempt + 1)
+		if deadline, ok := r.Context().Deadline(); ok && time.Now().Add(wait).After(deadline) {
+			return rec
+		}
+		if g.RetryBudget != nil && !g.RetryBudget.allowRetry() {
+			llog.Warn("retry budget exhausted, not retrying", kv)
+			return rec
+		}
+		kv["attempt"] = attempt + 1
+		kv["err"] = rec.forwardErr
+		llog.Warn("retrying forward", kv)
+		delete(kv, "err")
+
+		select {
+		case <-time.After(wait):
+		case <-r.Context().Done():
+			return rec
+		}
+
+		if uu != nil {
+			u, err := g.resolveURL(uu)
+			if err != nil {
+				kv["err"] = err
+				llog.Warn("error re-resolving url for retry", kv)
+				delete(kv, "err")
+			} else {
+				r.URL = u
+			}
+		}
+	}
+}
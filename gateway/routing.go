@@ -0,0 +1,184 @@
+package gateway
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/rpc/v2/json2"
+)
+
+// taggedBackend is a backend added using AddURLTagged
+type taggedBackend struct {
+	*url.URL
+	origURL string
+	tags    map[string]string
+}
+
+// withTaggedBackend returns the list of backends with tb added to it, replacing
+// any existing backend with the same url
+func withTaggedBackend(tagged []taggedBackend, tb taggedBackend) []taggedBackend {
+	out := make([]taggedBackend, 0, len(tagged)+1)
+	for _, existing := range tagged {
+		if existing.origURL != tb.origURL {
+			out = append(out, existing)
+		}
+	}
+	return append(out, tb)
+}
+
+// hasTagged returns whether the service has a tagged backend with the given
+// url
+func (rsrv remoteService) hasTagged(origURL string) bool {
+	for _, tb := range rsrv.tagged {
+		if tb.origURL == origURL {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultSchemaVersionHeader is the header clients use to pin the schema
+// version of the backend their request is sent to, see SchemaVersionHeader
+const DefaultSchemaVersionHeader = "X-Schema-Version"
+
+// SchemaVersionTag is the tag which backends added using AddURLTagged use to
+// advertise their schema version, e.g. {"schemaVersion": "2"}
+const SchemaVersionTag = "schemaVersion"
+
+// hasSchemaVersions returns whether any of the service's tagged backends
+// advertise a schema version
+func (rsrv remoteService) hasSchemaVersions() bool {
+	for _, tb := range rsrv.tagged {
+		if _, ok := tb.tags[SchemaVersionTag]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// backendURL returns the url the request for the service should be sent to,
+// taking the request's schema version and routing hint, and any drained
+// backends, into account. The url still needs to be resolved. An error is
+// returned if the request pinned a schema version which none of the service's
+// backends advertise, or if all of the backends it could go to are drained
+func (g *Gateway) backendURL(rsrv remoteService, r *http.Request) (*url.URL, error) {
+	candidates := rsrv.tagged
+	primary := taggedBackend{URL: rsrv.URL, origURL: rsrv.origURL}
+	var version string
+	if g.SchemaVersionHeader != "" {
+		version = r.Header.Get(g.SchemaVersionHeader)
+	}
+	// services which aren't versioned at all ignore the header
+	if version != "" && rsrv.hasSchemaVersions() {
+		candidates = nil
+		for _, tb := range rsrv.tagged {
+			if tb.tags[SchemaVersionTag] == version {
+				candidates = append(candidates, tb)
+			}
+		}
+		if len(candidates) == 0 {
+			return nil, &json2.Error{
+				Code:    json2.E_INVALID_REQ,
+				Message: fmt.Sprintf("schema version %q is not available for %s", version, rsrv.Name),
+			}
+		}
+		primary = candidates[len(candidates)-1]
+	}
+
+	var hint string
+	if g.RoutingHintHeader != "" && g.RoutingHintTag != "" {
+		hint = r.Header.Get(g.RoutingHintHeader)
+	}
+	if hint != "" {
+		for _, tb := range candidates {
+			if tb.tags[g.RoutingHintTag] == hint && !g.isDrained(tb.origURL) {
+				return tb.URL, nil
+			}
+		}
+	}
+	if !g.isDrained(primary.origURL) {
+		return primary.URL, nil
+	}
+
+	// the primary is drained, so fall back to the most recently added backend
+	// which isn't
+	for i := len(candidates) - 1; i >= 0; i-- {
+		if !g.isDrained(candidates[i].origURL) {
+			return candidates[i].URL, nil
+		}
+	}
+	return nil, errBackendDrained
+}
+
+var errBackendDrained = &json2.Error{
+	Code:    json2.E_SERVER,
+	Message: "backend is drained for maintenance",
+}
+
+// DrainBackend stops new requests from being forwarded to the backend added
+// using the given url, e.g. so it can be taken down for maintenance. Requests
+// for its services are sent to other backends which they were added from
+// using AddURLTagged, if any, otherwise they're sent back a 503.
+func (g *Gateway) DrainBackend(origURL string) {
+	if !strings.HasPrefix(origURL, "http") {
+		origURL = "http://" + origURL
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.drained[origURL] = true
+}
+
+// UndrainBackend undoes a previous call to DrainBackend
+func (g *Gateway) UndrainBackend(origURL string) {
+	if !strings.HasPrefix(origURL, "http") {
+		origURL = "http://" + origURL
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	delete(g.drained, origURL)
+}
+
+func (g *Gateway) isDrained(origURL string) bool {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	return g.drained[origURL]
+}
+
+// sizeRoute describes where large requests for a method go, see RouteBySize
+type sizeRoute struct {
+	threshold int64
+	url       *url.URL
+}
+
+// RouteBySize causes requests for the given method (e.g. "Service.Method")
+// whose body, as forwarded, is larger than thresholdBytes to be sent to
+// largeURL rather than to the method's usual backend. largeURL is resolved the
+// same as urls passed to AddURL, and must serve the same service.
+func (g *Gateway) RouteBySize(method string, thresholdBytes int64, largeURL string) error {
+	if !strings.HasPrefix(largeURL, "http") {
+		largeURL = "http://" + largeURL
+	}
+	uu, err := url.Parse(largeURL)
+	if err != nil {
+		return err
+	}
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.sizeRoutes[method] = sizeRoute{threshold: thresholdBytes, url: uu}
+	return nil
+}
+
+// sizeRouteURL returns the url a request for the method with a body of the
+// given size should be sent to instead of its usual backend, if any
+func (g *Gateway) sizeRouteURL(method string, size int) (*url.URL, bool) {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	sr, ok := g.sizeRoutes[method]
+	if !ok || int64(size) <= sr.threshold {
+		return nil, false
+	}
+	return sr.url, true
+}
@@ -0,0 +1,90 @@
+package gateway
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultSlowRequestsSize is the SlowRequestsSize NewGateway sets
+const DefaultSlowRequestsSize = 10
+
+// DefaultSlowRequestsWindow is the SlowRequestsWindow NewGateway sets
+const DefaultSlowRequestsWindow = 15 * time.Minute
+
+// SlowRequest describes a single forwarded request, see SlowestRequests
+type SlowRequest struct {
+	Method   string
+	Backend  string
+	Status   int
+	Duration time.Duration
+
+	// Time is when the request finished
+	Time time.Time
+}
+
+// slowRequests keeps the slowest requests seen, sorted slowest first. The zero
+// value is ready to use
+type slowRequests struct {
+	l    sync.Mutex
+	reqs []SlowRequest
+}
+
+// record adds the request, dropping any which are older than window (if it's
+// non-zero) or which are no longer among the max slowest
+func (s *slowRequests) record(sr SlowRequest, max int, window time.Duration) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.expire(sr.Time, window)
+	i := sort.Search(len(s.reqs), func(i int) bool {
+		return s.reqs[i].Duration < sr.Duration
+	})
+	if i >= max {
+		return
+	}
+	s.reqs = append(s.reqs, SlowRequest{})
+	copy(s.reqs[i+1:], s.reqs[i:])
+	s.reqs[i] = sr
+	if len(s.reqs) > max {
+		s.reqs = s.reqs[:max]
+	}
+}
+
+func (s *slowRequests) expire(now time.Time, window time.Duration) {
+	if window <= 0 {
+		return
+	}
+	kept := s.reqs[:0]
+	for _, sr := range s.reqs {
+		if now.Sub(sr.Time) <= window {
+			kept = append(kept, sr)
+		}
+	}
+	s.reqs = kept
+}
+
+func (s *slowRequests) get(window time.Duration) []SlowRequest {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.expire(time.Now(), window)
+	return append([]SlowRequest(nil), s.reqs...)
+}
+
+// SlowestRequests returns the SlowRequestsSize slowest requests which were
+// forwarded within the last SlowRequestsWindow, slowest first
+func (g *Gateway) SlowestRequests() []SlowRequest {
+	return g.slowRequests.get(g.SlowRequestsWindow)
+}
+
+func (g *Gateway) recordSlowRequest(ev RoutingEvent) {
+	if g.SlowRequestsSize <= 0 {
+		return
+	}
+	g.slowRequests.record(SlowRequest{
+		Method:   ev.Method,
+		Backend:  ev.Backend,
+		Status:   ev.Status,
+		Duration: ev.Duration,
+		Time:     time.Now(),
+	}, g.SlowRequestsSize, g.SlowRequestsWindow)
+}
@@ -0,0 +1,61 @@
+package gateway
+
+import (
+	"context"
+	"io"
+	"path"
+)
+
+type streamTransformer struct {
+	pattern string
+	fn      func(io.Reader, io.Writer) error
+}
+
+// AddStreamTransformer registers a function which rewrites the responses of
+// requests whose method matches the given pattern, using the same syntax as
+// AddMethodMiddleware. It's given the body of the backend's response as it's
+// read, and writes the rewritten body, so that simple rewrites can be done
+// without decoding the whole response. What it writes must still be a valid
+// response. If more than one transformer matches a method then only the first
+// which was added is used.
+func (g *Gateway) AddStreamTransformer(methodPattern string, fn func(io.Reader, io.Writer) error) error {
+	// check the pattern is valid up front, so it doesn't fail on every request
+	if _, err := path.Match(methodPattern, ""); err != nil {
+		return err
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.streamTransformers = append(g.streamTransformers, streamTransformer{methodPattern, fn})
+	return nil
+}
+
+// getStreamTransformer returns the first transformer matching the given
+// method, if any
+func (g *Gateway) getStreamTransformer(m string) func(io.Reader, io.Writer) error {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	for _, st := range g.streamTransformers {
+		if ok, _ := path.Match(st.pattern, m); ok {
+			return st.fn
+		}
+	}
+	return nil
+}
+
+// the transformer is passed to forwardExternal through the request's context,
+// since it only has the request being forwarded
+type streamTransformerKey struct{}
+
+func withStreamTransformer(ctx context.Context, fn func(io.Reader, io.Writer) error) context.Context {
+	return context.WithValue(ctx, streamTransformerKey{}, fn)
+}
+
+// copyResponse copies the backend's response body to w, through the request's
+// stream transformer if it has one
+func copyResponse(ctx context.Context, w io.Writer, body io.Reader) error {
+	if fn, ok := ctx.Value(streamTransformerKey{}).(func(io.Reader, io.Writer) error); ok {
+		return fn(body, w)
+	}
+	_, err := io.Copy(w, body)
+	return err
+}
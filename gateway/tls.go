@@ -0,0 +1,113 @@
+package gateway
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// DefaultCipherSuites are the cipher suites used for backend connections if
+// BackendTLSConfig doesn't specify any. They're all forward secret AEAD suites
+var DefaultCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+// BackendTLSConfig describes the TLS settings used when connecting to https
+// backends, see SetBackendTLS
+type BackendTLSConfig struct {
+	// MinVersion is the minimum TLS version which will be negotiated with
+	// backends. It defaults to, and can't be lower than, tls.VersionTLS12
+	MinVersion uint16
+
+	// CipherSuites are the cipher suites which may be negotiated with backends
+	// using TLS 1.2. It defaults to DefaultCipherSuites, and can't contain any
+	// suites which the crypto/tls package considers insecure. TLS 1.3 suites
+	// aren't configurable
+	CipherSuites []uint16
+
+	// RootCAs are used to verify backends' certificates. If nil the host's root
+	// CAs are used
+	RootCAs *x509.CertPool
+}
+
+// tlsConfig validates the BackendTLSConfig and returns the tls.Config for it
+func (c BackendTLSConfig) tlsConfig() (*tls.Config, error) {
+	minVersion := c.MinVersion
+	if minVersion == 0 {
+		minVersion = tls.VersionTLS12
+	} else if minVersion < tls.VersionTLS12 {
+		return nil, fmt.Errorf("tls version %#x is insecure, must be at least TLS 1.2", minVersion)
+	}
+
+	suites := c.CipherSuites
+	if len(suites) == 0 {
+		suites = DefaultCipherSuites
+	}
+	secure := map[uint16]bool{}
+	for _, s := range tls.CipherSuites() {
+		secure[s.ID] = true
+	}
+	for _, s := range suites {
+		if !secure[s] {
+			return nil, fmt.Errorf("cipher suite %s is insecure", tls.CipherSuiteName(s))
+		}
+	}
+
+	return &tls.Config{
+		MinVersion:   minVersion,
+		CipherSuites: suites,
+		RootCAs:      c.RootCAs,
+	}, nil
+}
+
+// SetBackendTLS sets the TLS settings used for all connections to https
+// backends, both when adding their services and when forwarding requests to
+// them. An error is returned, and nothing is changed, if the settings are
+// insecure
+func (g *Gateway) SetBackendTLS(c BackendTLSConfig) error {
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		return err
+	}
+	t, ok := http.DefaultTransport.(*http.Transport)
+	if !ok {
+		return errors.New("http.DefaultTransport isn't an *http.Transport")
+	}
+	t = t.Clone()
+	t.TLSClientConfig = tlsConfig
+
+	client := &http.Client{Transport: t}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.client = client
+	g.external = newExternalHandler(client)
+	return nil
+}
+
+// httpClient returns the client used for connecting to backends
+func (g *Gateway) httpClient() *http.Client {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	if g.client != nil {
+		return g.client
+	}
+	return http.DefaultClient
+}
+
+// externalHandler returns the handler used for forwarding requests to
+// backends
+func (g *Gateway) externalHandler() http.Handler {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	if g.external != nil {
+		return g.external
+	}
+	return externalHandler
+}
@@ -0,0 +1,38 @@
+package gateway
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/gorilla/rpc/v2"
+	"github.com/gorilla/rpc/v2/json2"
+)
+
+// ResponseTranscoder writes the response to a client's request, given the
+// response of the backend it was forwarded to. See Gateway.ResponseTranscoder
+type ResponseTranscoder interface {
+	// TranscodeResponse is given the status and body of the backend's
+	// response, and should write the response to w using codecReq, which is
+	// the client's request. The error it returns, if any, is the error of the
+	// request's RoutingEvent
+	TranscodeResponse(w http.ResponseWriter, codecReq rpc.CodecRequest, status int, body io.Reader) error
+}
+
+// JSON2Transcoder is a ResponseTranscoder which decodes the backend's response
+// as JSON RPC 2.0, and writes either its result or error back to the client
+// using the client's codec. This is what the Gateway does if no
+// ResponseTranscoder is set.
+type JSON2Transcoder struct{}
+
+// TranscodeResponse implements the ResponseTranscoder interface
+func (JSON2Transcoder) TranscodeResponse(w http.ResponseWriter, codecReq rpc.CodecRequest, status int, body io.Reader) error {
+	// we don't actually care what the response was so just use a RawMessage
+	res := &json.RawMessage{}
+	if err := json2.DecodeClientResponse(body, res); err != nil {
+		codecReq.WriteError(w, status, err)
+		return err
+	}
+	codecReq.WriteResponse(w, res)
+	return nil
+}
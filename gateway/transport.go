@@ -0,0 +1,16 @@
+package gateway
+
+import "net/http"
+
+// SetRoundTripper replaces the transport used for all connections to
+// backends, both when adding their services and when forwarding requests to
+// them. It's mainly useful in tests, to intercept the requests the Gateway
+// makes and respond to them without a running backend. It replaces any
+// settings from SetBackendTLS, and vice-versa.
+func (g *Gateway) SetRoundTripper(rt http.RoundTripper) {
+	client := &http.Client{Transport: rt}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.client = client
+	g.external = newExternalHandler(client)
+}
@@ -0,0 +1,142 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+func (g *Gateway) setPending(u string, tags map[string]string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.pending[u] = tags
+}
+
+// WarmUp fetches the services of every url the Gateway knows about
+// concurrently, including those which previously couldn't be reached, and
+// returns once they've all been fetched or the context is done. This is useful
+// on startup in conjunction with ReadinessHandler, so that the gateway is
+// only reported as ready once its services have been discovered. An error
+// describing every url which couldn't be fetched is returned.
+func (g *Gateway) WarmUp(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	urls := map[string]map[string]string{}
+	g.mutex.RLock()
+	for _, srv := range g.services {
+		if srv.origURL != "" {
+			urls[srv.origURL] = nil
+		}
+		for _, tb := range srv.tagged {
+			urls[tb.origURL] = tb.tags
+		}
+	}
+	for u, tags := range g.pending {
+		urls[u] = tags
+	}
+	g.mutex.RUnlock()
+
+	var mutex sync.Mutex
+	var failed []string
+	var wg sync.WaitGroup
+	for u, tags := range urls {
+		wg.Add(1)
+		go func(u string, tags map[string]string) {
+			defer wg.Done()
+			if err := g.addURL(u, tags); err != nil {
+				mutex.Lock()
+				failed = append(failed, fmt.Sprintf("%s: %s", u, err))
+				mutex.Unlock()
+			}
+		}(u, tags)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d urls failed: %s", len(failed), len(urls), strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// WarmConnections makes a request to every backend the Gateway forwards to
+// concurrently, so that a connection to each is pooled and ready for the first
+// requests after startup. Backends are resolved as they would be for a
+// request, and the responses to the requests are discarded. It returns once
+// every backend has responded or the context is done, with an error describing
+// every backend which couldn't be reached.
+func (g *Gateway) WarmConnections(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	urls := map[string]*url.URL{}
+	g.mutex.RLock()
+	for _, srv := range g.services {
+		if srv.URL != nil {
+			urls[srv.URL.String()] = srv.URL
+		}
+		for _, tb := range srv.tagged {
+			urls[tb.URL.String()] = tb.URL
+		}
+	}
+	g.mutex.RUnlock()
+
+	client := g.httpClient()
+	warm := func(uu *url.URL) error {
+		u, err := g.resolveURL(uu)
+		if err != nil {
+			return err
+		}
+		r, err := http.NewRequest("GET", u.String(), nil)
+		if err != nil {
+			return err
+		}
+		res, err := client.Do(r.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		// the body must be read fully for the connection to be reused
+		io.Copy(ioutil.Discard, res.Body)
+		return res.Body.Close()
+	}
+
+	var mutex sync.Mutex
+	var failed []string
+	var wg sync.WaitGroup
+	for u, uu := range urls {
+		wg.Add(1)
+		go func(u string, uu *url.URL) {
+			defer wg.Done()
+			if err := warm(uu); err != nil {
+				mutex.Lock()
+				failed = append(failed, fmt.Sprintf("%s: %s", u, err))
+				mutex.Unlock()
+			}
+		}(u, uu)
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	} else if len(failed) > 0 {
+		return fmt.Errorf("%d of %d backends failed: %s", len(failed), len(urls), strings.Join(failed, "; "))
+	}
+	return nil
+}
@@ -1,6 +1,9 @@
 package gatewaytypes
 
-import "reflect"
+import (
+	"reflect"
+	"time"
+)
 
 // Service describes an rpc service which has a set of methods it supports
 type Service struct {
@@ -14,6 +17,24 @@ type Method struct {
 	Name    string `json:"name"`
 	Args    *Type  `json:"args"`
 	Returns *Type  `json:"returns"`
+
+	// Cacheable, if non-zero, indicates that successful responses from this
+	// method may be cached by clients and intermediaries for the given
+	// duration
+	Cacheable time.Duration `json:"cacheable,omitempty"`
+
+	// Deprecated, if set, indicates that the method shouldn't be used anymore,
+	// and describes why or what should be used instead
+	Deprecated string `json:"deprecated,omitempty"`
+
+	// Idempotent indicates that calling the method multiple times has the same
+	// effect as calling it once, and so it's safe to retry, or to call using
+	// GET
+	Idempotent bool `json:"idempotent,omitempty"`
+
+	// Auditable indicates that every call to the method should be recorded
+	// for auditing, e.g. because it mutates something important
+	Auditable bool `json:"auditable,omitempty"`
 }
 
 // Type describes a type. Only one of its fields should be a non-zero value,
@@ -32,8 +53,105 @@ type Type struct {
 	// (as long as it's a string) and all values must be of the given type
 	MapOf *Type `json:"mapOf,omitempty"`
 
-	// Used when the Type is recursive. Right now it's enough to simply say that
-	// there is a cycle with no further information, in the future we may add
-	// info about the cycle
+	// Used when the Type is recursive, in place of the Type which is already
+	// being described further up the tree. Ref is the name of that Type's go
+	// type, if it has one
 	CycleOf *struct{} `json:"cycleOf,omitempty"`
+	Ref     string    `json:"ref,omitempty"`
+
+	// Enum, if set alongside TypeOf, is the set of values which the value is
+	// limited to
+	Enum []string `json:"enum,omitempty"`
+
+	// Optional indicates that the value is a field of an object which may be
+	// omitted, i.e. it has the omitempty json option
+	Optional bool `json:"optional,omitempty"`
+
+	// Nullable indicates that the value is a pointer, and so may be null
+	Nullable bool `json:"nullable,omitempty"`
+
+	// Format, if set alongside TypeOf, further describes how the value is
+	// encoded, e.g. FormatDateTime
+	Format string `json:"format,omitempty"`
+}
+
+// Formats which a Type may have
+const (
+	// FormatDateTime is used for RFC3339 timestamp strings, i.e. time.Time
+	FormatDateTime = "date-time"
+
+	// FormatDuration is used for integer durations in nanoseconds, i.e.
+	// time.Duration
+	FormatDuration = "duration"
+
+	// FormatFloat and FormatDouble are used for 32 and 64 bit floats
+	// respectively, i.e. float32 and float64
+	FormatFloat  = "float"
+	FormatDouble = "double"
+)
+
+// JSONType returns the type as it would be categorized in json: "integer",
+// "number", "string", "boolean", "array", "object", or "any" if it can't be
+// categorized more specifically
+func (t *Type) JSONType() string {
+	switch {
+	case t.ArrayOf != nil:
+		return "array"
+	case t.ObjectOf != nil, t.MapOf != nil:
+		return "object"
+	}
+
+	switch t.TypeOf {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Uintptr:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Array, reflect.Slice:
+		return "array"
+	case reflect.Map, reflect.Struct:
+		return "object"
+	}
+	return "any"
+}
+
+// Copy returns a deep copy of the Service, which shares no maps or Types with
+// the original
+func (s Service) Copy() Service {
+	methods := make(map[string]Method, len(s.Methods))
+	for name, m := range s.Methods {
+		m.Args = m.Args.Copy()
+		m.Returns = m.Returns.Copy()
+		methods[name] = m
+	}
+	s.Methods = methods
+	return s
+}
+
+// Copy returns a deep copy of the Type
+func (t *Type) Copy() *Type {
+	if t == nil {
+		return nil
+	}
+	t2 := *t
+	t2.ArrayOf = t.ArrayOf.Copy()
+	t2.MapOf = t.MapOf.Copy()
+	if t.ObjectOf != nil {
+		t2.ObjectOf = make(map[string]*Type, len(t.ObjectOf))
+		for k, v := range t.ObjectOf {
+			t2.ObjectOf[k] = v.Copy()
+		}
+	}
+	if t.CycleOf != nil {
+		t2.CycleOf = &struct{}{}
+	}
+	if t.Enum != nil {
+		t2.Enum = append([]string(nil), t.Enum...)
+	}
+	return &t2
 }
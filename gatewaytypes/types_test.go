@@ -0,0 +1,54 @@
+package gatewaytypes
+
+import (
+	"reflect"
+	. "testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSONType(t *T) {
+	tests := []struct {
+		t   *Type
+		exp string
+	}{
+		{&Type{TypeOf: reflect.Int}, "integer"},
+		{&Type{TypeOf: reflect.Uint8}, "integer"},
+		{&Type{TypeOf: reflect.Int64}, "integer"},
+		{&Type{TypeOf: reflect.Uint64}, "integer"},
+		{&Type{TypeOf: reflect.Float32}, "number"},
+		{&Type{TypeOf: reflect.Float64}, "number"},
+		{&Type{TypeOf: reflect.String}, "string"},
+		{&Type{TypeOf: reflect.Bool}, "boolean"},
+		{&Type{TypeOf: reflect.Interface}, "any"},
+		{&Type{ArrayOf: &Type{TypeOf: reflect.Int}}, "array"},
+		{&Type{ObjectOf: map[string]*Type{"a": {TypeOf: reflect.Int}}}, "object"},
+		{&Type{MapOf: &Type{TypeOf: reflect.String}}, "object"},
+		{&Type{CycleOf: &struct{}{}}, "any"},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.exp, test.t.JSONType(), "%#v", test.t)
+	}
+}
+
+func TestCopy(t *T) {
+	orig := Service{
+		Name: "Foo",
+		Methods: map[string]Method{
+			"Bar": {
+				Name: "Bar",
+				Args: &Type{ObjectOf: map[string]*Type{
+					"a": {ArrayOf: &Type{TypeOf: reflect.String, Enum: []string{"x"}}},
+				}},
+			},
+		},
+	}
+	cp := orig.Copy()
+	assert.Equal(t, orig, cp)
+
+	cp.Methods["Bar"].Args.ObjectOf["a"].ArrayOf.Enum[0] = "y"
+	cp.Methods["Baz"] = Method{}
+	assert.Equal(t, "x", orig.Methods["Bar"].Args.ObjectOf["a"].ArrayOf.Enum[0])
+	assert.Len(t, orig.Methods, 1)
+}
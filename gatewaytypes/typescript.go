@@ -0,0 +1,153 @@
+package gatewaytypes
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ServicesToTypeScript generates TypeScript type definitions (suitable for a
+// .d.ts file) describing the given services. Each method gets an interface for
+// its args and one for its return value, named <Service><Method>Args and
+// <Service><Method>Returns, and each service gets a <Service>Client interface
+// with all of its methods.
+func ServicesToTypeScript(services []Service) (string, error) {
+	services = append([]Service(nil), services...)
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].Name < services[j].Name
+	})
+
+	buf := new(strings.Builder)
+	for _, s := range services {
+		methods := make([]string, 0, len(s.Methods))
+		for name := range s.Methods {
+			methods = append(methods, name)
+		}
+		sort.Strings(methods)
+
+		for _, name := range methods {
+			m := s.Methods[name]
+			prefix := s.Name + name
+			if err := writeTSDecl(buf, prefix+"Args", m.Args); err != nil {
+				return "", fmt.Errorf("%s.%s args: %s", s.Name, name, err)
+			}
+			if err := writeTSDecl(buf, prefix+"Returns", m.Returns); err != nil {
+				return "", fmt.Errorf("%s.%s returns: %s", s.Name, name, err)
+			}
+		}
+
+		fmt.Fprintf(buf, "export interface %sClient {\n", s.Name)
+		for _, name := range methods {
+			prefix := s.Name + name
+			fmt.Fprintf(buf, "  %s(args: %sArgs): Promise<%sReturns>;\n", name, prefix, prefix)
+		}
+		buf.WriteString("}\n\n")
+	}
+	return buf.String(), nil
+}
+
+// writeTSDecl writes a top-level declaration for the given type. Objects are
+// declared as interfaces, everything else as a type alias
+func writeTSDecl(buf *strings.Builder, name string, t *Type) error {
+	if t == nil || t.ObjectOf != nil || isEmpty(t) {
+		fmt.Fprintf(buf, "export interface %s ", name)
+		if err := writeTSObject(buf, t, 0); err != nil {
+			return err
+		}
+		buf.WriteString("\n\n")
+		return nil
+	}
+
+	fmt.Fprintf(buf, "export type %s = ", name)
+	if err := writeTSType(buf, t, 0); err != nil {
+		return err
+	}
+	buf.WriteString(";\n\n")
+	return nil
+}
+
+func isEmpty(t *Type) bool {
+	return t.TypeOf == 0 && t.ArrayOf == nil && t.ObjectOf == nil && t.MapOf == nil && t.CycleOf == nil
+}
+
+var tsIdentRegex = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$]*$`)
+
+func writeTSObject(buf *strings.Builder, t *Type, indent int) error {
+	if t == nil || len(t.ObjectOf) == 0 {
+		buf.WriteString("{}")
+		return nil
+	}
+
+	keys := make([]string, 0, len(t.ObjectOf))
+	for k := range t.ObjectOf {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	buf.WriteString("{\n")
+	pad := strings.Repeat("  ", indent+1)
+	for _, k := range keys {
+		innerT := t.ObjectOf[k]
+		if !tsIdentRegex.MatchString(k) {
+			b, _ := json.Marshal(k)
+			k = string(b)
+		}
+		if innerT != nil && innerT.Optional {
+			k += "?"
+		}
+		fmt.Fprintf(buf, "%s%s: ", pad, k)
+		if err := writeTSType(buf, innerT, indent+1); err != nil {
+			return err
+		}
+		buf.WriteString(";\n")
+	}
+	buf.WriteString(strings.Repeat("  ", indent))
+	buf.WriteString("}")
+	return nil
+}
+
+func writeTSType(buf *strings.Builder, t *Type, indent int) error {
+	switch {
+	case t == nil || t.ObjectOf != nil || isEmpty(t):
+		return writeTSObject(buf, t, indent)
+	case t.ArrayOf != nil:
+		if err := writeTSType(buf, t.ArrayOf, indent); err != nil {
+			return err
+		}
+		buf.WriteString("[]")
+	case t.MapOf != nil:
+		buf.WriteString("{ [key: string]: ")
+		if err := writeTSType(buf, t.MapOf, indent); err != nil {
+			return err
+		}
+		buf.WriteString(" }")
+	case t.CycleOf != nil:
+		// we don't know what the cycle refers to, so there's not much else we
+		// can say about it
+		buf.WriteString("any")
+	default:
+		ts, err := tsKind(t.TypeOf)
+		if err != nil {
+			return err
+		}
+		buf.WriteString(ts)
+	}
+	return nil
+}
+
+func tsKind(k reflect.Kind) (string, error) {
+	switch {
+	case k == reflect.Bool:
+		return "boolean", nil
+	case k >= reflect.Int && k <= reflect.Float64:
+		return "number", nil
+	case k == reflect.String:
+		return "string", nil
+	case k == reflect.Interface:
+		return "any", nil
+	}
+	return "", fmt.Errorf("unsupported kind: %s", k)
+}
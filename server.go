@@ -10,6 +10,8 @@ import (
 	"net/http"
 	"reflect"
 	"strings"
+	"sync"
+	"time"
 	"unicode"
 	"unicode/utf8"
 
@@ -23,6 +25,25 @@ import (
 type Server struct {
 	*rpc.Server
 	services []gatewaytypes.Service
+
+	// everything registered on the underlying server is kept track of so that
+	// it can be rebuilt when a service is unregistered
+	mutex         sync.RWMutex
+	registrations []registration
+	codecs        []codecRegistration
+
+	// allowed values of types registered with RegisterEnum
+	enums map[reflect.Type][]string
+}
+
+type registration struct {
+	receiver interface{}
+	name     string
+}
+
+type codecRegistration struct {
+	codec       rpc.Codec
+	contentType string
 }
 
 // NewServer returns a new Server struct initialized with a gorilla/rpc/v2
@@ -36,12 +57,56 @@ func NewServer() *Server {
 // GetServicesRes describes the structure returned from the GetServices api call
 type GetServicesRes struct {
 	Services []gatewaytypes.Service `json:"services"`
+
+	// ContentTypes are the content types of all the codecs registered on the
+	// Server, i.e. those it accepts requests in
+	ContentTypes []string `json:"contentTypes,omitempty"`
 }
 
 // GetServices is the actual rpc method which returns the set of services and
 // their methods which are supported
 func (s *Server) GetServices(r *http.Request, _ *struct{}, res *GetServicesRes) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
 	res.Services = s.services
+	for _, c := range s.codecs {
+		res.ContentTypes = append(res.ContentTypes, c.contentType)
+	}
+	return nil
+}
+
+// ServeHTTP passes the request through to the underlying gorilla/rpc/v2 server
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.RLock()
+	srv := s.Server
+	s.mutex.RUnlock()
+	srv.ServeHTTP(w, r)
+}
+
+// RegisterCodec passes its arguments through to the underlying gorilla/rpc/v2
+// server
+func (s *Server) RegisterCodec(codec rpc.Codec, contentType string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.Server.RegisterCodec(codec, contentType)
+	s.codecs = append(s.codecs, codecRegistration{codec, contentType})
+}
+
+// RegisterEnum registers the given string type as only allowing the given
+// values, which are included in the descriptor of any field of that type. It
+// must be called before registering any services which use the type
+func (s *Server) RegisterEnum(t reflect.Type, values []string) error {
+	if t.Kind() != reflect.String {
+		return fmt.Errorf("enum type %v must be a string type", t)
+	} else if len(values) == 0 {
+		return fmt.Errorf("enum type %v must have at least one value", t)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.enums == nil {
+		s.enums = map[reflect.Type][]string{}
+	}
+	s.enums[t] = append([]string(nil), values...)
 	return nil
 }
 
@@ -49,6 +114,9 @@ func (s *Server) GetServices(r *http.Request, _ *struct{}, res *GetServicesRes)
 // server, as well as adds the given receiver's rpc methods to the Server's
 // cache of method data which will be returned by the "RPC.GetMethods" endpoint.
 func (s *Server) RegisterService(receiver interface{}, name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
 	if err := s.Server.RegisterService(receiver, name); err != nil {
 		return err
 	}
@@ -57,6 +125,7 @@ func (s *Server) RegisterService(receiver interface{}, name string) error {
 	if err != nil {
 		return err
 	}
+	s.registrations = append(s.registrations, registration{receiver, name})
 
 	service := gatewaytypes.Service{
 		Name:    name,
@@ -66,11 +135,13 @@ func (s *Server) RegisterService(receiver interface{}, name string) error {
 	for _, method := range getMethods(receiver) {
 		llog.Debug("got method", llog.KV{"method": method.Name})
 		methodT := method.Type
-		args, err := processType(methodT.In(2), nil)
+		// args and results are always pointers, but that doesn't mean they're
+		// nullable
+		args, err := processType(methodT.In(2).Elem(), nil, s.enums)
 		if err != nil {
 			return fmt.Errorf("processing %q: %s", method.Name, err)
 		}
-		res, err := processType(methodT.In(3), nil)
+		res, err := processType(methodT.In(3).Elem(), nil, s.enums)
 		if err != nil {
 			return fmt.Errorf("processing %q: %s", method.Name, err)
 		}
@@ -91,12 +162,152 @@ func (s *Server) RegisterService(receiver interface{}, name string) error {
 // method data to the Server's cache, so the receiver won't show up in calls to
 // GetMethods
 func (s *Server) RegisterHiddenService(receiver interface{}, name string) error {
-	return s.Server.RegisterService(receiver, name)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.Server.RegisterService(receiver, name); err != nil {
+		return err
+	}
+	// gorilla has already validated the name, so this won't error
+	name, _ = getName(receiver, name)
+	s.registrations = append(s.registrations, registration{receiver, name})
+	return nil
+}
+
+// UnregisterService removes the service with the given name, which was
+// previously registered with RegisterService or RegisterHiddenService, so that
+// it's no longer routed to or returned from "RPC.GetServices".
+//
+// Since the underlying gorilla/rpc/v2 server doesn't support removing services
+// it is rebuilt from scratch, with all remaining services and codecs
+// re-registered. Any other changes made directly to the underlying server will
+// be lost.
+func (s *Server) UnregisterService(name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var remaining []registration
+	for _, reg := range s.registrations {
+		if reg.name != name {
+			remaining = append(remaining, reg)
+		}
+	}
+	if len(remaining) == len(s.registrations) {
+		return fmt.Errorf("unknown service %q", name)
+	}
+
+	srv := rpc.NewServer()
+	srv.RegisterService(s, "RPC")
+	for _, c := range s.codecs {
+		srv.RegisterCodec(c.codec, c.contentType)
+	}
+	for _, reg := range remaining {
+		if err := srv.RegisterService(reg.receiver, reg.name); err != nil {
+			return err
+		}
+	}
+
+	var services []gatewaytypes.Service
+	for _, service := range s.services {
+		if service.Name != name {
+			services = append(services, service)
+		}
+	}
+
+	s.Server = srv
+	s.registrations = remaining
+	s.services = services
+	return nil
+}
+
+// SetCacheable marks the given method on the given service as being cacheable
+// for the given duration. The service must have already been registered using
+// RegisterService. A duration of zero marks the method as not cacheable.
+func (s *Server) SetCacheable(service, method string, d time.Duration) error {
+	return s.updateMethod(service, method, func(m *gatewaytypes.Method) {
+		m.Cacheable = d
+	})
+}
+
+// SetDeprecated marks the given method of the given service as deprecated,
+// with msg describing why or what should be used instead. Gateways will warn
+// clients which call it. The service must have already been registered with
+// RegisterService
+func (s *Server) SetDeprecated(service, method, msg string) error {
+	return s.updateMethod(service, method, func(m *gatewaytypes.Method) {
+		m.Deprecated = msg
+	})
+}
+
+// SetIdempotent marks the given method of the given service as idempotent,
+// meaning calling it multiple times has the same effect as calling it once.
+// Gateways may then retry it, or allow it to be called using GET. The service
+// must have already been registered with RegisterService
+func (s *Server) SetIdempotent(service, method string) error {
+	return s.updateMethod(service, method, func(m *gatewaytypes.Method) {
+		m.Idempotent = true
+	})
+}
+
+// MarkAuditable marks the given method of the given service as auditable, so
+// that gateways record every call to it. The service must have already been
+// registered with RegisterService
+func (s *Server) MarkAuditable(service, method string) error {
+	return s.updateMethod(service, method, func(m *gatewaytypes.Method) {
+		m.Auditable = true
+	})
+}
+
+func (s *Server) updateMethod(service, method string, fn func(*gatewaytypes.Method)) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, srv := range s.services {
+		if srv.Name != service {
+			continue
+		}
+		m, ok := srv.Methods[method]
+		if !ok {
+			return fmt.Errorf("unknown method %q on service %q", method, service)
+		}
+		fn(&m)
+		srv.Methods[method] = m
+		return nil
+	}
+	return fmt.Errorf("unknown service %q", service)
+}
+
+// Services returns the names of all services which have been registered, in the
+// order they were registered. Hidden services are not included
+func (s *Server) Services() []string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	names := make([]string, len(s.services))
+	for i, srv := range s.services {
+		names[i] = srv.Name
+	}
+	return names
+}
+
+// Method returns the description of the given method of the given service, or
+// false if there is no such method
+func (s *Server) Method(service, method string) (gatewaytypes.Method, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for _, srv := range s.services {
+		if srv.Name == service {
+			m, ok := srv.Methods[method]
+			return m, ok
+		}
+	}
+	return gatewaytypes.Method{}, false
 }
 
 var (
-	typeOfError   = reflect.TypeOf((*error)(nil)).Elem()
-	typeOfRequest = reflect.TypeOf((*http.Request)(nil)).Elem()
+	typeOfError    = reflect.TypeOf((*error)(nil)).Elem()
+	typeOfRequest  = reflect.TypeOf((*http.Request)(nil)).Elem()
+	typeOfTime     = reflect.TypeOf(time.Time{})
+	typeOfDuration = reflect.TypeOf(time.Duration(0))
 )
 
 // Since name can optionally be specified to overwrite the name of rcv
@@ -156,27 +367,63 @@ func getMethods(rcv interface{}) []reflect.Method {
 	return ret
 }
 
-func processType(t reflect.Type, prevTypes []reflect.Type) (*gatewaytypes.Type, error) {
+// processType returns the Type describing t. enums are the allowed values of
+// any enum types, see RegisterEnum
+func processType(t reflect.Type, prevTypes []reflect.Type, enums map[reflect.Type][]string) (*gatewaytypes.Type, error) {
 	if t.Kind() == reflect.Ptr {
-		t = t.Elem()
+		typ, err := processType(t.Elem(), prevTypes, enums)
+		if err != nil {
+			return nil, err
+		}
+		typ.Nullable = true
+		return typ, nil
 	}
 	kind := t.Kind()
 
 	// If we've already had this type then this is a cycle
 	for _, prevType := range prevTypes {
 		if t == prevType {
-			return &gatewaytypes.Type{CycleOf: &struct{}{}}, nil
+			return &gatewaytypes.Type{CycleOf: &struct{}{}, Ref: t.Name()}, nil
 		}
 	}
 	prevTypes = append(prevTypes, t)
 
-	// Bool through floats encompasses all integer and float types. Plus string
+	if values, ok := enums[t]; ok {
+		return &gatewaytypes.Type{
+			TypeOf: kind,
+			Enum:   append([]string(nil), values...),
+		}, nil
+	}
+
+	// time.Time is a struct, but is encoded as a string, and time.Duration
+	// would otherwise look like any other int64
+	switch t {
+	case typeOfTime:
+		return &gatewaytypes.Type{TypeOf: reflect.String, Format: gatewaytypes.FormatDateTime}, nil
+	case typeOfDuration:
+		return &gatewaytypes.Type{TypeOf: reflect.Int64, Format: gatewaytypes.FormatDuration}, nil
+	}
+
+	// floats are given a format so their precision isn't lost on clients
+	switch kind {
+	case reflect.Float32:
+		return &gatewaytypes.Type{TypeOf: kind, Format: gatewaytypes.FormatFloat}, nil
+	case reflect.Float64:
+		return &gatewaytypes.Type{TypeOf: kind, Format: gatewaytypes.FormatDouble}, nil
+	}
+
+	// Bool through floats encompasses all signed and unsigned integer and float
+	// types, each of which keeps its exact kind. Plus string
 	if (kind >= reflect.Bool && kind <= reflect.Float64) || kind == reflect.String {
 		return &gatewaytypes.Type{TypeOf: kind}, nil
 	}
 
+	if kind == reflect.Complex64 || kind == reflect.Complex128 {
+		return nil, fmt.Errorf("unsupported type: %v, complex numbers can't be encoded as json", t)
+	}
+
 	if kind == reflect.Array || kind == reflect.Slice {
-		innerT, err := processType(t.Elem(), prevTypes)
+		innerT, err := processType(t.Elem(), prevTypes, enums)
 		if err != nil {
 			return nil, err
 		}
@@ -188,7 +435,7 @@ func processType(t reflect.Type, prevTypes []reflect.Type) (*gatewaytypes.Type,
 			return nil, fmt.Errorf("unsupported map type: %v", t)
 		}
 
-		innerT, err := processType(t.Elem(), prevTypes)
+		innerT, err := processType(t.Elem(), prevTypes, enums)
 		if err != nil {
 			return nil, err
 		}
@@ -203,11 +450,13 @@ func processType(t reflect.Type, prevTypes []reflect.Type) (*gatewaytypes.Type,
 		m := map[string]*gatewaytypes.Type{}
 		for i := 0; i < t.NumField(); i++ {
 			f := t.Field(i)
-			if !isExported(f.Name) {
+			// "-" means the field is never encoded, but "-," means it's
+			// literally named "-", same as encoding/json
+			if !isExported(f.Name) || f.Tag.Get("json") == "-" {
 				continue
 			}
 			key := getFieldKey(f)
-			innerT, err := processType(f.Type, prevTypes)
+			innerT, err := processType(f.Type, prevTypes, enums)
 			if err != nil {
 				return nil, err
 			}
@@ -217,6 +466,7 @@ func processType(t reflect.Type, prevTypes []reflect.Type) (*gatewaytypes.Type,
 					m[k] = v
 				}
 			} else {
+				innerT.Optional = isOmitEmpty(f)
 				m[key] = innerT
 			}
 		}
@@ -226,6 +476,17 @@ func processType(t reflect.Type, prevTypes []reflect.Type) (*gatewaytypes.Type,
 	return nil, fmt.Errorf("unsupported type: %v", t)
 }
 
+// isOmitEmpty returns whether the field's json tag has the omitempty option
+func isOmitEmpty(f reflect.StructField) bool {
+	parts := strings.Split(f.Tag.Get("json"), ",")
+	for _, opt := range parts[1:] {
+		if opt == "omitempty" {
+			return true
+		}
+	}
+	return false
+}
+
 func getFieldKey(f reflect.StructField) string {
 	key := f.Name
 	jsonTag := f.Tag.Get("json")
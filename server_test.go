@@ -1,9 +1,12 @@
 package gatewayrpc
 
 import (
+	"bytes"
 	"net/http"
+	"net/http/httptest"
 	"reflect"
 	. "testing"
+	"time"
 
 	"github.com/gorilla/rpc/v2/json2"
 	"github.com/levenlabs/gatewayrpc/gatewaytypes"
@@ -78,7 +81,7 @@ type BuzArgs struct {
 }
 
 var buzArgsType = &gatewaytypes.Type{ObjectOf: map[string]*gatewaytypes.Type{
-	"buzbuz": &gatewaytypes.Type{ArrayOf: &gatewaytypes.Type{CycleOf: &struct{}{}}},
+	"buzbuz": &gatewaytypes.Type{ArrayOf: &gatewaytypes.Type{CycleOf: &struct{}{}, Ref: "BuzArgs"}},
 }}
 
 func (t TestEndpoint) Buz(r *http.Request, args *BuzArgs, _ *struct{}) error {
@@ -114,17 +117,188 @@ func TestGetMethods(t *T) {
 }
 
 func TestProcessType(t *T) {
-	typ, err := processType(reflect.TypeOf(&FooArgs{}), nil)
+	typ, err := processType(reflect.TypeOf(FooArgs{}), nil, nil)
 	require.Nil(t, err)
 	assert.Equal(t, fooArgsType, typ)
 
-	typ, err = processType(reflect.TypeOf(&BarArgs{}), nil)
+	typ, err = processType(reflect.TypeOf(BarArgs{}), nil, nil)
 	require.Nil(t, err)
 	assert.Equal(t, barArgsType, typ)
 
-	typ, err = processType(reflect.TypeOf(&BuzArgs{}), nil)
+	typ, err = processType(reflect.TypeOf(BuzArgs{}), nil, nil)
 	require.Nil(t, err)
 	assert.Equal(t, buzArgsType, typ)
+
+	type timeArgs struct {
+		At      time.Time     `json:"at"`
+		Until   *time.Time    `json:"until"`
+		Timeout time.Duration `json:"timeout"`
+	}
+	typ, err = processType(reflect.TypeOf(timeArgs{}), nil, nil)
+	require.Nil(t, err)
+	assert.Equal(t, &gatewaytypes.Type{ObjectOf: map[string]*gatewaytypes.Type{
+		"at":      {TypeOf: reflect.String, Format: gatewaytypes.FormatDateTime},
+		"until":   {TypeOf: reflect.String, Format: gatewaytypes.FormatDateTime, Nullable: true},
+		"timeout": {TypeOf: reflect.Int64, Format: gatewaytypes.FormatDuration},
+	}}, typ)
+}
+
+type Node struct {
+	Value    string  `json:"value"`
+	Children []*Node `json:"children"`
+	Meta     *struct {
+		Parent *Node `json:"parent"`
+	} `json:"meta"`
+}
+
+func TestProcessTypeRecursive(t *T) {
+	typ, err := processType(reflect.TypeOf(Node{}), nil, nil)
+	require.Nil(t, err)
+	ref := func() *gatewaytypes.Type {
+		return &gatewaytypes.Type{CycleOf: &struct{}{}, Ref: "Node", Nullable: true}
+	}
+	assert.Equal(t, &gatewaytypes.Type{ObjectOf: map[string]*gatewaytypes.Type{
+		"value":    {TypeOf: reflect.String},
+		"children": {ArrayOf: ref()},
+		"meta": {
+			ObjectOf: map[string]*gatewaytypes.Type{"parent": ref()},
+			Nullable: true,
+		},
+	}}, typ)
+}
+
+func TestProcessTypeOmitted(t *T) {
+	type omitArgs struct {
+		A string `json:"a"`
+		B string `json:"-"`
+		C string `json:"-,"`
+	}
+	typ, err := processType(reflect.TypeOf(omitArgs{}), nil, nil)
+	require.Nil(t, err)
+	assert.Equal(t, &gatewaytypes.Type{ObjectOf: map[string]*gatewaytypes.Type{
+		"a": {TypeOf: reflect.String},
+		"-": {TypeOf: reflect.String},
+	}}, typ)
+}
+
+func TestProcessTypeOptional(t *T) {
+	type optionalArgs struct {
+		A string   `json:"a"`
+		B string   `json:"b,omitempty"`
+		C *int     `json:",omitempty"`
+		D []string `json:"d,string,omitempty"`
+		E int
+	}
+	typ, err := processType(reflect.TypeOf(optionalArgs{}), nil, nil)
+	require.Nil(t, err)
+	assert.Equal(t, &gatewaytypes.Type{ObjectOf: map[string]*gatewaytypes.Type{
+		"a": {TypeOf: reflect.String},
+		"b": {TypeOf: reflect.String, Optional: true},
+		"C": {TypeOf: reflect.Int, Optional: true, Nullable: true},
+		"d": {ArrayOf: &gatewaytypes.Type{TypeOf: reflect.String}, Optional: true},
+		"E": {TypeOf: reflect.Int},
+	}}, typ)
+
+	ts, err := gatewaytypes.ServicesToTypeScript([]gatewaytypes.Service{{
+		Name:    "Opt",
+		Methods: map[string]gatewaytypes.Method{"Get": {Name: "Get", Args: typ}},
+	}})
+	require.Nil(t, err)
+	assert.Contains(t, ts, "  a: string;\n")
+	assert.Contains(t, ts, "  b?: string;\n")
+}
+
+func TestProcessTypeNumbers(t *T) {
+	for _, v := range []interface{}{
+		int(0), int8(0), int16(0), int32(0), int64(0),
+		uint(0), uint8(0), uint16(0), uint32(0), uint64(0),
+		float32(0), float64(0),
+	} {
+		typ, err := processType(reflect.TypeOf(v), nil, nil)
+		require.Nil(t, err)
+		assert.Equal(t, reflect.TypeOf(v).Kind(), typ.TypeOf)
+	}
+
+	typ, err := processType(reflect.TypeOf(float32(0)), nil, nil)
+	require.Nil(t, err)
+	assert.Equal(t, gatewaytypes.FormatFloat, typ.Format)
+	typ, err = processType(reflect.TypeOf(float64(0)), nil, nil)
+	require.Nil(t, err)
+	assert.Equal(t, gatewaytypes.FormatDouble, typ.Format)
+	typ, err = processType(reflect.TypeOf(int64(0)), nil, nil)
+	require.Nil(t, err)
+	assert.Empty(t, typ.Format)
+
+	for _, v := range []interface{}{complex64(0), complex128(0)} {
+		_, err := processType(reflect.TypeOf(v), nil, nil)
+		require.NotNil(t, err)
+		assert.Contains(t, err.Error(), "complex numbers can't be encoded as json")
+	}
+}
+
+func TestProcessTypeNullable(t *T) {
+	type nullableArgs struct {
+		A  string            `json:"a"`
+		B  *string           `json:"b"`
+		C  []*FooArgs        `json:"c"`
+		D  map[string]*int   `json:"d"`
+		E  *[]int            `json:"e"`
+		F  map[string]string `json:"f"`
+		GG **bool            `json:"gg"`
+	}
+	typ, err := processType(reflect.TypeOf(nullableArgs{}), nil, nil)
+	require.Nil(t, err)
+
+	nullableFoo := *fooArgsType
+	nullableFoo.Nullable = true
+	assert.Equal(t, &gatewaytypes.Type{ObjectOf: map[string]*gatewaytypes.Type{
+		"a":  {TypeOf: reflect.String},
+		"b":  {TypeOf: reflect.String, Nullable: true},
+		"c":  {ArrayOf: &nullableFoo},
+		"d":  {MapOf: &gatewaytypes.Type{TypeOf: reflect.Int, Nullable: true}},
+		"e":  {ArrayOf: &gatewaytypes.Type{TypeOf: reflect.Int}, Nullable: true},
+		"f":  {MapOf: &gatewaytypes.Type{TypeOf: reflect.String}},
+		"gg": {TypeOf: reflect.Bool, Nullable: true},
+	}}, typ)
+
+	// args and results themselves are always pointers, so aren't nullable
+	s := NewServer()
+	require.Nil(t, s.RegisterService(TestEndpoint{}, ""))
+	m, ok := s.Method("TestEndpoint", "Foo")
+	require.True(t, ok)
+	assert.False(t, m.Args.Nullable)
+	assert.False(t, m.Returns.Nullable)
+}
+
+type Status string
+
+type EnumArgs struct {
+	Status   Status   `json:"status"`
+	Statuses []Status `json:"statuses"`
+	Name     string   `json:"name"`
+}
+
+type EnumEndpoint struct{}
+
+func (EnumEndpoint) Enum(r *http.Request, args *EnumArgs, _ *struct{}) error {
+	return nil
+}
+
+func TestRegisterEnum(t *T) {
+	s := NewServer()
+	assert.NotNil(t, s.RegisterEnum(reflect.TypeOf(0), []string{"a"}))
+	assert.NotNil(t, s.RegisterEnum(reflect.TypeOf(Status("")), nil))
+	require.Nil(t, s.RegisterEnum(reflect.TypeOf(Status("")), []string{"active", "paused", "closed"}))
+	require.Nil(t, s.RegisterService(EnumEndpoint{}, ""))
+
+	statusType := &gatewaytypes.Type{TypeOf: reflect.String, Enum: []string{"active", "paused", "closed"}}
+	m, ok := s.Method("EnumEndpoint", "Enum")
+	require.True(t, ok)
+	assert.Equal(t, &gatewaytypes.Type{ObjectOf: map[string]*gatewaytypes.Type{
+		"status":   statusType,
+		"statuses": {ArrayOf: statusType},
+		"name":     {TypeOf: reflect.String},
+	}}, m.Args)
 }
 
 func TestGetServices(t *T) {
@@ -160,6 +334,7 @@ func TestGetServices(t *T) {
 		},
 	}}
 	assert.Equal(t, expected, res.Services)
+	assert.Equal(t, []string{"application/json"}, res.ContentTypes)
 
 	// Quick check to make sure passthrough of actual methods works too
 	args2 := FooArgs{1, "one"}
@@ -167,3 +342,163 @@ func TestGetServices(t *T) {
 	require.Nil(t, rpcutil.JSONRPC2CallHandler(s, &res2, "TestEndpoint.Foo", &args2))
 	assert.Equal(t, args2, res2.FooArgs)
 }
+
+func TestSetCacheable(t *T) {
+	s := NewServer()
+	s.RegisterService(TestEndpoint{}, "")
+
+	require.Nil(t, s.SetCacheable("TestEndpoint", "Foo", time.Minute))
+	assert.Equal(t, time.Minute, s.services[0].Methods["Foo"].Cacheable)
+	assert.Equal(t, time.Duration(0), s.services[0].Methods["Bar"].Cacheable)
+
+	assert.NotNil(t, s.SetCacheable("TestEndpoint", "Nope", time.Minute))
+	assert.NotNil(t, s.SetCacheable("Nope", "Foo", time.Minute))
+}
+
+func TestMethod(t *T) {
+	s := NewServer()
+	require.Nil(t, s.RegisterService(TestEndpoint{}, ""))
+	require.Nil(t, s.RegisterService(TestEndpoint{}, "Other"))
+	assert.Equal(t, []string{"TestEndpoint", "Other"}, s.Services())
+
+	m, ok := s.Method("TestEndpoint", "Foo")
+	assert.True(t, ok)
+	assert.Equal(t, "Foo", m.Name)
+	assert.Equal(t, fooArgsType, m.Args)
+	assert.Equal(t, fooResType, m.Returns)
+
+	_, ok = s.Method("TestEndpoint", "Nope")
+	assert.False(t, ok)
+	_, ok = s.Method("Nope", "Foo")
+	assert.False(t, ok)
+}
+
+func TestSetDeprecated(t *T) {
+	s := NewServer()
+	s.RegisterService(TestEndpoint{}, "")
+
+	require.Nil(t, s.SetDeprecated("TestEndpoint", "Foo", "use Bar"))
+	m, _ := s.Method("TestEndpoint", "Foo")
+	assert.Equal(t, "use Bar", m.Deprecated)
+	m, _ = s.Method("TestEndpoint", "Bar")
+	assert.Equal(t, "", m.Deprecated)
+
+	assert.NotNil(t, s.SetDeprecated("TestEndpoint", "Nope", "use Bar"))
+	assert.NotNil(t, s.SetDeprecated("Nope", "Foo", "use Bar"))
+}
+
+func TestSetIdempotent(t *T) {
+	s := NewServer()
+	s.RegisterService(TestEndpoint{}, "")
+
+	require.Nil(t, s.SetIdempotent("TestEndpoint", "Foo"))
+	m, _ := s.Method("TestEndpoint", "Foo")
+	assert.True(t, m.Idempotent)
+	m, _ = s.Method("TestEndpoint", "Bar")
+	assert.False(t, m.Idempotent)
+
+	assert.NotNil(t, s.SetIdempotent("Nope", "Foo"))
+}
+
+func TestMarkAuditable(t *T) {
+	s := NewServer()
+	s.RegisterService(TestEndpoint{}, "")
+
+	require.Nil(t, s.MarkAuditable("TestEndpoint", "Bar"))
+	m, _ := s.Method("TestEndpoint", "Bar")
+	assert.True(t, m.Auditable)
+	m, _ = s.Method("TestEndpoint", "Foo")
+	assert.False(t, m.Auditable)
+
+	assert.NotNil(t, s.MarkAuditable("TestEndpoint", "Nope"))
+}
+
+func TestUnregisterService(t *T) {
+	s := NewServer()
+	require.Nil(t, s.RegisterService(TestEndpoint{}, ""))
+	s.RegisterCodec(json2.NewCodec(), "application/json")
+
+	args := FooArgs{1, "one"}
+	var res FooRes
+	require.Nil(t, rpcutil.JSONRPC2CallHandler(s, &res, "TestEndpoint.Foo", &args))
+
+	require.Nil(t, s.UnregisterService("TestEndpoint"))
+	assert.NotNil(t, rpcutil.JSONRPC2CallHandler(s, &res, "TestEndpoint.Foo", &args))
+
+	var servicesRes GetServicesRes
+	require.Nil(t, rpcutil.JSONRPC2CallHandler(s, &servicesRes, "RPC.GetServices", &struct{}{}))
+	assert.Empty(t, servicesRes.Services)
+
+	assert.NotNil(t, s.UnregisterService("TestEndpoint"))
+
+	// it can be registered again afterwards
+	require.Nil(t, s.RegisterService(TestEndpoint{}, ""))
+	require.Nil(t, rpcutil.JSONRPC2CallHandler(s, &res, "TestEndpoint.Foo", &args))
+}
+
+func TestServicesToTypeScript(t *T) {
+	ts, err := gatewaytypes.ServicesToTypeScript([]gatewaytypes.Service{{
+		Name: "TestEndpoint",
+		Methods: map[string]gatewaytypes.Method{
+			"Bar": {
+				Name:    "Bar",
+				Args:    barArgsType,
+				Returns: barResType,
+			},
+		},
+	}})
+	require.Nil(t, err)
+
+	expected := `export interface TestEndpointBarArgs {
+  a: number;
+  aa: number;
+  b: number[];
+  c: {
+    a: number;
+    b: string;
+  }[];
+  d: { [key: string]: any };
+}
+
+export interface TestEndpointBarReturns {}
+
+export interface TestEndpointClient {
+  Bar(args: TestEndpointBarArgs): Promise<TestEndpointBarReturns>;
+}
+
+`
+	assert.Equal(t, expected, ts)
+
+	// keys which aren't valid identifiers are quoted, and keep their type
+	ts, err = gatewaytypes.ServicesToTypeScript([]gatewaytypes.Service{{
+		Name: "Dash",
+		Methods: map[string]gatewaytypes.Method{"Get": {Name: "Get", Args: &gatewaytypes.Type{
+			ObjectOf: map[string]*gatewaytypes.Type{
+				"x-id": {TypeOf: reflect.String, Optional: true},
+			},
+		}}},
+	}})
+	require.Nil(t, err)
+	assert.Contains(t, ts, "  \"x-id\"?: string;\n")
+}
+
+func TestRegisterDefaultCodecs(t *T) {
+	s := NewServer()
+	s.RegisterService(TestEndpoint{}, "")
+	RegisterDefaultCodecs(s)
+
+	for _, ct := range DefaultContentTypes {
+		body, err := json2.EncodeClientRequest("TestEndpoint.Foo", &FooArgs{1, "one"})
+		require.Nil(t, err)
+		r, err := http.NewRequest("POST", "/", bytes.NewBuffer(body))
+		require.Nil(t, err)
+		r.Header.Set("Content-Type", ct)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		assert.Equal(t, 200, w.Code, "content-type: %s", ct)
+
+		var res FooRes
+		require.Nil(t, json2.DecodeClientResponse(w.Body, &res), "content-type: %s", ct)
+		assert.Equal(t, FooArgs{1, "one"}, res.FooArgs)
+	}
+}